@@ -22,8 +22,12 @@ func main() {
 	fmt.Println("=== Revenium Middleware - Fal.ai Tracing Example ===")
 	fmt.Println()
 
-	// Initialize the middleware
-	if err := revenium.Initialize(); err != nil {
+	// Initialize the middleware with default environment and region, so they
+	// don't have to be repeated in every metadata map
+	if err := revenium.Initialize(
+		revenium.WithEnvironment("production"),
+		revenium.WithRegion("us-east-1"),
+	); err != nil {
 		log.Fatalf("Failed to initialize middleware: %v", err)
 	}
 
@@ -91,10 +95,8 @@ func basicTracingExample(client *revenium.ReveniumFal) error {
 			"id":    "user-123",
 			"email": "user@example.com",
 		},
-		// Trace visualization fields
+		// Trace visualization fields (environment and region come from the client defaults)
 		"traceId":         traceID,
-		"environment":     "production",
-		"region":          "us-east-1",
 		"traceType":       "media-pipeline",
 		"traceName":       "Product Image Generation",
 		"credentialAlias": "fal-prod-key",
@@ -122,22 +124,17 @@ func basicTracingExample(client *revenium.ReveniumFal) error {
 }
 
 func distributedTracingExample(client *revenium.ReveniumFal) error {
-	// Parent's traceId - child operations will reference this via parentTransactionId
-	parentTraceID := fmt.Sprintf("parent-%d", time.Now().UnixMilli())
-
-	// Step 1: Generate thumbnail (parent operation)
-	fmt.Println("Step 1: Generating thumbnail (parent)...")
-	ctx1 := context.Background()
-	metadata1 := map[string]interface{}{
+	// StartTrace seeds the traceId and reserves the parent's transaction ID;
+	// Child links later operations to it via parentTransactionId
+	ctx := revenium.WithUsageMetadata(context.Background(), map[string]interface{}{
 		"organizationName": "my-company",
 		"productName":      "media-service",
-		"taskType":         "thumbnail-generation",
-		"traceId":          parentTraceID,
-		"environment":      "production",
 		"traceType":        "media-workflow",
-		"traceName":        "E-commerce Image Pipeline",
-	}
-	ctx1 = revenium.WithUsageMetadata(ctx1, metadata1)
+	})
+	ctx1, trace := client.StartTrace(ctx, "E-commerce Image Pipeline")
+
+	// Step 1: Generate thumbnail (parent operation)
+	fmt.Println("Step 1: Generating thumbnail (parent)...")
 
 	request1 := &revenium.FalRequest{
 		Prompt:    "A small thumbnail of a red sneaker",
@@ -145,29 +142,19 @@ func distributedTracingExample(client *revenium.ReveniumFal) error {
 		NumImages: 1,
 	}
 
-	resp1, err := client.GenerateImage(ctx1, "fal-ai/flux/dev", request1)
+	resp1, err := client.GenerateImage(ctx1, "fal-ai/flux/dev", request1,
+		revenium.WithMetadata(map[string]interface{}{"taskType": "thumbnail-generation"}))
 	if err != nil {
 		return fmt.Errorf("failed to generate thumbnail: %w", err)
 	}
-	fmt.Printf("  Parent trace ID: %s\n", parentTraceID)
+	fmt.Printf("  Parent transaction ID: %s (trace %s)\n", trace.TransactionID, trace.TraceID)
 	if len(resp1.Images) > 0 {
 		fmt.Printf("  Generated thumbnail: %s\n", truncateURL(resp1.Images[0].URL, 50))
 	}
 
 	// Step 2: Generate hero image (child operation linked to parent)
 	fmt.Println("Step 2: Generating hero image (child)...")
-	ctx2 := context.Background()
-	metadata2 := map[string]interface{}{
-		"organizationName":    "my-company",
-		"productName":         "media-service",
-		"taskType":            "hero-image-generation",
-		"traceId":             fmt.Sprintf("child-%d", time.Now().UnixMilli()),
-		"parentTransactionId": parentTraceID, // Pass parent's traceId to link child to parent
-		"environment":         "production",
-		"traceType":           "media-workflow",
-		"traceName":           "E-commerce Image Pipeline",
-	}
-	ctx2 = revenium.WithUsageMetadata(ctx2, metadata2)
+	ctx2, _ := trace.Child(ctx, "Hero Image")
 
 	request2 := &revenium.FalRequest{
 		Prompt:    "A large hero image of a red sneaker with dramatic lighting",
@@ -175,11 +162,12 @@ func distributedTracingExample(client *revenium.ReveniumFal) error {
 		NumImages: 1,
 	}
 
-	resp2, err := client.GenerateImage(ctx2, "fal-ai/flux/dev", request2)
+	resp2, err := client.GenerateImage(ctx2, "fal-ai/flux/dev", request2,
+		revenium.WithMetadata(map[string]interface{}{"taskType": "hero-image-generation"}))
 	if err != nil {
 		return fmt.Errorf("failed to generate hero image: %w", err)
 	}
-	fmt.Printf("  Child linked to parent trace ID: %s\n", parentTraceID)
+	fmt.Printf("  Child linked to parent transaction ID: %s\n", trace.TransactionID)
 	if len(resp2.Images) > 0 {
 		fmt.Printf("  Generated hero image: %s\n", truncateURL(resp2.Images[0].URL, 50))
 	}
@@ -201,7 +189,6 @@ func retryTrackingExample(client *revenium.ReveniumFal) error {
 			"taskType":         "image-generation-with-retry",
 			"traceId":          traceID,
 			"retryNumber":      attempt, // 0 for first attempt, 1+ for retries
-			"environment":      "production",
 			"traceName":        fmt.Sprintf("Image Generation Attempt %d", attempt+1),
 		}
 		ctx = revenium.WithUsageMetadata(ctx, metadata)
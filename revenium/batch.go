@@ -0,0 +1,72 @@
+package revenium
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultMeteringBatchInterval is used when batching is enabled without an interval
+const defaultMeteringBatchInterval = 1 * time.Second
+
+// meteringBatcher accumulates metering payloads and hands them off in batches
+// once maxBatch payloads are pending or maxInterval has elapsed since the
+// first pending payload, whichever comes first.
+type meteringBatcher struct {
+	maxBatch    int
+	maxInterval time.Duration
+	send        func(batch []*MeteringPayload)
+
+	mu      sync.Mutex
+	pending []*MeteringPayload
+	timer   *time.Timer
+}
+
+// newMeteringBatcher creates a batcher that passes full or expired batches to send
+func newMeteringBatcher(maxBatch int, maxInterval time.Duration, send func(batch []*MeteringPayload)) *meteringBatcher {
+	if maxInterval <= 0 {
+		maxInterval = defaultMeteringBatchInterval
+	}
+	return &meteringBatcher{
+		maxBatch:    maxBatch,
+		maxInterval: maxInterval,
+		send:        send,
+	}
+}
+
+// add queues a payload, sending the batch immediately if it is now full
+func (b *meteringBatcher) add(payload *MeteringPayload) {
+	b.mu.Lock()
+	b.pending = append(b.pending, payload)
+	if len(b.pending) >= b.maxBatch {
+		batch := b.take()
+		b.mu.Unlock()
+		b.send(batch)
+		return
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.maxInterval, b.flush)
+	}
+	b.mu.Unlock()
+}
+
+// flush sends any pending payloads as a (possibly partial) batch
+func (b *meteringBatcher) flush() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+
+	if len(batch) > 0 {
+		b.send(batch)
+	}
+}
+
+// take removes and returns the pending payloads. Caller must hold b.mu.
+func (b *meteringBatcher) take() []*MeteringPayload {
+	batch := b.pending
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return batch
+}
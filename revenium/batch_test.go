@@ -0,0 +1,69 @@
+package revenium
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMeteringBatchReducesRequestCount(t *testing.T) {
+	var mu sync.Mutex
+	requests, delivered := 0, 0
+
+	client := newTestClient(t, imageHandler, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/meter/v2/ai/batch" {
+			t.Errorf("unexpected metering path %s", r.URL.Path)
+		}
+		var batch []MeteringPayload
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		requests++
+		delivered += len(batch)
+		mu.Unlock()
+	}, WithMeteringBatch(4, time.Hour))
+
+	for i := 0; i < 10; i++ {
+		if _, err := client.GenerateImage(context.Background(), "fal-ai/flux/dev", &FalRequest{Prompt: "a cat"}); err != nil {
+			t.Fatalf("GenerateImage() error = %v", err)
+		}
+	}
+	// Flush must send the partial batch of 2 without waiting for the interval
+	client.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if delivered != 10 {
+		t.Errorf("delivered %d payloads, want 10", delivered)
+	}
+	if requests != 3 {
+		t.Errorf("made %d metering requests, want 3", requests)
+	}
+}
+
+func TestMeteringBatchFallsBackToIndividualDelivery(t *testing.T) {
+	recorder := &meterRecorder{}
+	client := newTestClient(t, imageHandler, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/meter/v2/ai/batch" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		recorder.ServeHTTP(w, r)
+	}, WithMeteringBatch(2, time.Hour))
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.GenerateImage(context.Background(), "fal-ai/flux/dev", &FalRequest{Prompt: "a cat"}); err != nil {
+			t.Fatalf("GenerateImage() error = %v", err)
+		}
+	}
+	client.Flush()
+
+	if got := len(recorder.recorded()); got != 2 {
+		t.Errorf("recorded %d individual payloads, want 2", got)
+	}
+}
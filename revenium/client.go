@@ -4,12 +4,24 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
+// FalGenerator performs Fal.ai generations. FalClient is the standard
+// implementation; inject a fake with WithFalGenerator to unit-test metering
+// and middleware behavior without calling Fal.ai.
+type FalGenerator interface {
+	GenerateImage(ctx context.Context, model string, request *FalRequest) (*FalImageResponse, error)
+	GenerateVideo(ctx context.Context, model string, request *FalRequest) (*FalVideoResponse, error)
+}
+
 // FalClient handles communication with the Fal.ai API
 type FalClient struct {
 	config     *Config
@@ -42,132 +54,469 @@ func NewFalClient(config *Config) (*FalClient, error) {
 		return nil, err
 	}
 
+	// No client-level Timeout: RequestTimeout is applied to the request context
+	// in execute so a caller's shorter deadline always wins, and so it bounds
+	// the whole operation (including queue polling) rather than each HTTP call.
 	return &FalClient{
 		config: config,
 		httpClient: &http.Client{
-			Timeout: config.RequestTimeout, // Configurable via FAL_REQUEST_TIMEOUT (default: 30 min)
+			Transport: newLoggingRoundTripper(nil, config.KeyRedactionMode),
 		},
 	}, nil
 }
 
 // GenerateImage generates images using a Fal.ai model
 func (c *FalClient) GenerateImage(ctx context.Context, model string, request *FalRequest) (*FalImageResponse, error) {
+	body, err := c.execute(ctx, model, request, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse response
+	var imageResp FalImageResponse
+	if err := json.Unmarshal(body, &imageResp); err != nil {
+		return nil, NewProviderError("failed to parse response", err)
+	}
+
+	return &imageResp, nil
+}
+
+// GenerateVideo generates a video using a Fal.ai model
+func (c *FalClient) GenerateVideo(ctx context.Context, model string, request *FalRequest) (*FalVideoResponse, error) {
+	return c.GenerateVideoWithProgress(ctx, model, request, nil)
+}
+
+// GenerateVideoWithProgress generates a video, calling onProgress with each
+// status update while the job runs. A non-nil onProgress always routes the
+// request through the queue host, since only queued jobs report progress.
+func (c *FalClient) GenerateVideoWithProgress(ctx context.Context, model string, request *FalRequest, onProgress func(ProgressEvent)) (*FalVideoResponse, error) {
+	body, err := c.execute(ctx, model, request, onProgress)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse response
+	var videoResp FalVideoResponse
+	if err := json.Unmarshal(body, &videoResp); err != nil {
+		return nil, NewProviderError("failed to parse response", err)
+	}
+
+	return &videoResp, nil
+}
+
+// execute runs a generation request against the sync or queue host, depending
+// on configuration, and returns the raw result body. onProgress, when set,
+// forces the queue host and receives each status update.
+//
+// The effective timeout is min(context deadline, RequestTimeout): RequestTimeout
+// (FAL_REQUEST_TIMEOUT, default 30 min) is layered onto the caller's context, and
+// context.WithTimeout keeps the caller's deadline when it is earlier.
+func (c *FalClient) execute(ctx context.Context, model string, request *FalRequest, onProgress func(ProgressEvent)) ([]byte, error) {
+	if c.config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.RequestTimeout)
+		defer cancel()
+	}
+
+	requestBody, err := c.marshalRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.config.FalQueueMode || onProgress != nil {
+		return c.runQueued(ctx, model, requestBody, onProgress)
+	}
+
 	// Strip fal-ai/ prefix if present (user may pass canonical name like "fal-ai/flux/dev")
 	// The URL already includes /fal-ai/ so we need just the model path
 	endpoint := fmt.Sprintf("%s/fal-ai/%s", c.config.FalBaseURL, getEndpointPath(model))
+	recordFalEndpoint(ctx, endpoint)
+	return c.do(ctx, "POST", endpoint, requestBody)
+}
 
-	// Marshal request
+// marshalRequest encodes a generation request, enforcing MaxRequestBytes
+func (c *FalClient) marshalRequest(request *FalRequest) ([]byte, error) {
 	requestBody, err := json.Marshal(request)
 	if err != nil {
 		return nil, NewProviderError("failed to marshal request", err)
 	}
+	if limit := c.config.maxRequestBytes(); limit > 0 && int64(len(requestBody)) > limit {
+		return nil, NewValidationError(fmt.Sprintf("Fal request body is %d bytes, exceeding the %d byte limit", len(requestBody), limit), nil)
+	}
+	return requestBody, nil
+}
+
+// falQueueSubmission is the response returned when a request is submitted to the queue
+type falQueueSubmission struct {
+	RequestID   string `json:"request_id"`
+	StatusURL   string `json:"status_url"`
+	ResponseURL string `json:"response_url"`
+}
+
+// falQueueStatus is the response returned when polling a queued request
+type falQueueStatus struct {
+	Status        string        `json:"status"`
+	QueuePosition int           `json:"queue_position,omitempty"`
+	Logs          []falQueueLog `json:"logs,omitempty"`     // Only returned when polled with ?logs=1
+	Progress      *float64      `json:"progress,omitempty"` // Percent complete, when the model reports it
+}
+
+// falQueueLog is a single log line emitted by a queued job
+type falQueueLog struct {
+	Message   string `json:"message"`
+	Timestamp string `json:"timestamp,omitempty"`
+}
+
+// Fal queue statuses
+const (
+	falQueueStatusInQueue    = "IN_QUEUE"
+	falQueueStatusInProgress = "IN_PROGRESS"
+	falQueueStatusCompleted  = "COMPLETED"
+)
+
+// runQueued submits a request to the Fal queue host, polls until it completes,
+// and returns the raw result body. The submit/poll lifecycle is bounded by ctx.
+// When onProgress is set, job logs are requested and each poll is reported.
+func (c *FalClient) runQueued(ctx context.Context, model string, requestBody []byte, onProgress func(ProgressEvent)) ([]byte, error) {
+	queueBaseURL := c.config.FalQueueBaseURL
+	if queueBaseURL == "" {
+		queueBaseURL = defaultFalQueueBaseURL
+	}
+	endpoint := fmt.Sprintf("%s/fal-ai/%s", queueBaseURL, getEndpointPath(model))
+	recordFalEndpoint(ctx, endpoint)
 
-	// Create HTTP request
-	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(requestBody))
+	timing, _ := ctx.Value(queueTimingKey{}).(*queueTiming)
+	timing.submit(time.Now())
+	body, err := c.do(ctx, "POST", endpoint, requestBody)
 	if err != nil {
-		return nil, NewNetworkError("failed to create request", err)
+		return nil, err
 	}
 
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Key %s", c.config.FalAPIKey))
+	var submission falQueueSubmission
+	if err := json.Unmarshal(body, &submission); err != nil {
+		return nil, NewProviderError("failed to parse queue submission", err)
+	}
+	if submission.RequestID == "" {
+		return nil, NewProviderError("queue submission did not return a request_id", nil)
+	}
+
+	// Prefer the URLs returned by Fal; fall back to the documented layout
+	if submission.StatusURL == "" {
+		submission.StatusURL = fmt.Sprintf("%s/requests/%s/status", endpoint, submission.RequestID)
+	}
+	if submission.ResponseURL == "" {
+		submission.ResponseURL = fmt.Sprintf("%s/requests/%s", endpoint, submission.RequestID)
+	}
+	debugCtx(ctx, "Fal queue request %s submitted", submission.RequestID)
 
-	logRequest("POST", endpoint, map[string]string{
-		"Content-Type":  "application/json",
-		"Authorization": "Key [REDACTED]",
-	})
+	pollInterval := c.config.FalQueuePollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultFalQueuePollInterval
+	}
 
-	// Send request
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, NewNetworkError("request failed", err)
+	statusURL := submission.StatusURL
+	if onProgress != nil {
+		statusURL = withQueryParam(statusURL, "logs", "1")
 	}
-	defer resp.Body.Close()
 
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	var progress progressTracker
+	for {
+		body, err := c.do(ctx, "GET", statusURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var status falQueueStatus
+		if err := json.Unmarshal(body, &status); err != nil {
+			return nil, NewProviderError("failed to parse queue status", err)
+		}
+
+		if onProgress != nil {
+			onProgress(progress.update(&status))
+		}
+		if status.Status != falQueueStatusInQueue {
+			timing.start(time.Now())
+		}
+
+		switch status.Status {
+		case falQueueStatusCompleted:
+			return c.do(ctx, "GET", submission.ResponseURL, nil)
+		case falQueueStatusInQueue, falQueueStatusInProgress:
+			debugCtx(ctx, "Fal queue request %s is %s (position %d)", submission.RequestID, status.Status, status.QueuePosition)
+		default:
+			return nil, NewProviderError(fmt.Sprintf("unexpected queue status %q", status.Status), nil)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, NewNetworkError("queue polling cancelled", ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// withQueryParam returns rawURL with the query parameter added
+func withQueryParam(rawURL, key, value string) string {
+	u, err := url.Parse(rawURL)
 	if err != nil {
-		return nil, NewNetworkError("failed to read response", err)
+		return rawURL
 	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
 
-	logResponse(resp.StatusCode, string(body))
+// falHeaderCaptureKey is the context key for a *falHeaderCapture
+type falHeaderCaptureKey struct{}
 
-	// Check for errors
-	if resp.StatusCode >= 400 {
-		var falErr FalError
-		if err := json.Unmarshal(body, &falErr); err == nil {
-			falErr.Status = resp.StatusCode
-			return nil, NewProviderError(fmt.Sprintf("Fal.ai API error: %s", falErr.Error()), &falErr)
+// falHeaderCapture records the headers of the most recent Fal response made
+// with a context returned by withFalHeaderCapture
+type falHeaderCapture struct {
+	mu     sync.Mutex
+	header http.Header
+}
+
+// withFalHeaderCapture returns a context whose Fal responses record their
+// headers into the returned capture
+func withFalHeaderCapture(ctx context.Context) (context.Context, *falHeaderCapture) {
+	capture := &falHeaderCapture{}
+	return context.WithValue(ctx, falHeaderCaptureKey{}, capture), capture
+}
+
+// record stores a copy of header, replacing any earlier response's headers
+func (c *falHeaderCapture) record(header http.Header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header = header.Clone()
+}
+
+// get returns the captured value of the named header, or ""
+func (c *falHeaderCapture) get(name string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.header.Get(name)
+}
+
+// selected returns the captured headers named in names ("*" for all), minus
+// those in denylist, with multiple values joined by ", ". It returns nil when
+// nothing matches.
+func (c *falHeaderCapture) selected(names, denylist []string) map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	denied := make(map[string]bool, len(denylist))
+	for _, name := range denylist {
+		denied[http.CanonicalHeaderKey(name)] = true
+	}
+
+	headers := make(map[string]string)
+	add := func(name string) {
+		name = http.CanonicalHeaderKey(name)
+		if values := c.header.Values(name); len(values) > 0 && !denied[name] {
+			headers[name] = strings.Join(values, ", ")
+		}
+	}
+	for _, name := range names {
+		if name == "*" {
+			for key := range c.header {
+				add(key)
+			}
+			continue
 		}
-		return nil, NewProviderError(fmt.Sprintf("HTTP %d: %s", resp.StatusCode, string(body)), nil)
+		add(name)
 	}
 
-	// Parse response
-	var imageResp FalImageResponse
-	if err := json.Unmarshal(body, &imageResp); err != nil {
-		return nil, NewProviderError("failed to parse response", err)
+	if len(headers) == 0 {
+		return nil
 	}
+	return headers
+}
 
-	return &imageResp, nil
+// TransactionIDHeader carries the metering TransactionID on Fal requests
+// when WithSendTransactionHeader is enabled
+const TransactionIDHeader = "X-Revenium-Transaction-Id"
+
+// transactionHeaderKey is the context key for the TransactionID sent to Fal
+type transactionHeaderKey struct{}
+
+// queueTimingKey is the context key for a *queueTiming
+type queueTimingKey struct{}
+
+// queueTiming records when a queued Fal job was submitted and when it was
+// first seen running, for jobs run with a context returned by withQueueTiming.
+// The start time is when a status poll first reported the job out of the
+// queue, so it is accurate to within one poll interval.
+type queueTiming struct {
+	mu        sync.Mutex
+	submitted time.Time
+	started   time.Time
 }
 
-// GenerateVideo generates a video using a Fal.ai model
-func (c *FalClient) GenerateVideo(ctx context.Context, model string, request *FalRequest) (*FalVideoResponse, error) {
-	// Strip fal-ai/ prefix if present (user may pass canonical name like "fal-ai/kling-video/v1/standard/text-to-video")
-	// The URL already includes /fal-ai/ so we need just the model path
-	endpoint := fmt.Sprintf("%s/fal-ai/%s", c.config.FalBaseURL, getEndpointPath(model))
+// withQueueTiming returns a context whose queued Fal jobs record their
+// timing into the returned queueTiming
+func withQueueTiming(ctx context.Context) (context.Context, *queueTiming) {
+	timing := &queueTiming{}
+	return context.WithValue(ctx, queueTimingKey{}, timing), timing
+}
 
-	// Marshal request
-	requestBody, err := json.Marshal(request)
-	if err != nil {
-		return nil, NewProviderError("failed to marshal request", err)
+// submit records a job submission, discarding an earlier attempt's timing
+func (t *queueTiming) submit(at time.Time) {
+	if t == nil {
+		return
 	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.submitted = at
+	t.started = time.Time{}
+}
 
-	// Create HTTP request
-	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(requestBody))
-	if err != nil {
-		return nil, NewNetworkError("failed to create request", err)
+// start records the first time the submitted job was seen running
+func (t *queueTiming) start(at time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.started.IsZero() {
+		t.started = at
+	}
+}
+
+// times returns the recorded submit and start times (zero when not queued)
+func (t *queueTiming) times() (submitted, started time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.submitted, t.started
+}
+
+// falEndpointKey is the context key for a *falEndpoint
+type falEndpointKey struct{}
+
+// falEndpoint records the generation endpoint called with a context returned
+// by withFalEndpoint. For queued jobs it is the submit URL, not the status or
+// result URLs polled afterwards.
+type falEndpoint struct {
+	mu  sync.Mutex
+	url string
+}
+
+// withFalEndpoint returns a context whose Fal generations record their
+// endpoint into the returned falEndpoint
+func withFalEndpoint(ctx context.Context) (context.Context, *falEndpoint) {
+	endpoint := &falEndpoint{}
+	return context.WithValue(ctx, falEndpointKey{}, endpoint), endpoint
+}
+
+// recordFalEndpoint stores the endpoint of a generation made with ctx,
+// without any credentials, query string, or fragment
+func recordFalEndpoint(ctx context.Context, endpoint string) {
+	e, ok := ctx.Value(falEndpointKey{}).(*falEndpoint)
+	if !ok {
+		return
+	}
+	if u, err := url.Parse(endpoint); err == nil {
+		u.User = nil
+		u.RawQuery = ""
+		u.Fragment = ""
+		endpoint = u.String()
 	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.url = endpoint
+}
 
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Key %s", c.config.FalAPIKey))
+// get returns the recorded endpoint, or "" when none was called
+func (e *falEndpoint) get() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.url
+}
 
-	logRequest("POST", endpoint, map[string]string{
-		"Content-Type":  "application/json",
-		"Authorization": "Key [REDACTED]",
-	})
+// do sends a single authenticated request to Fal.ai and returns the response body
+func (c *FalClient) do(ctx context.Context, method, endpoint string, requestBody []byte) ([]byte, error) {
+	req, err := c.newRequest(ctx, method, endpoint, requestBody)
+	if err != nil {
+		return nil, err
+	}
 
-	// Send request
+	// Send request (logged by the client's transport)
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, NewNetworkError("request failed", err)
 	}
 	defer resp.Body.Close()
 
+	if capture, ok := ctx.Value(falHeaderCaptureKey{}).(*falHeaderCapture); ok {
+		capture.record(resp.Header)
+	}
+
 	// Read response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, NewNetworkError("failed to read response", err)
 	}
 
-	logResponse(resp.StatusCode, string(body))
+	logResponse(ctx, resp.StatusCode, string(body))
 
 	// Check for errors
 	if resp.StatusCode >= 400 {
-		var falErr FalError
-		if err := json.Unmarshal(body, &falErr); err == nil {
-			falErr.Status = resp.StatusCode
-			return nil, NewProviderError(fmt.Sprintf("Fal.ai API error: %s", falErr.Error()), &falErr)
-		}
-		return nil, NewProviderError(fmt.Sprintf("HTTP %d: %s", resp.StatusCode, string(body)), nil)
+		return nil, falStatusError(resp.StatusCode, body)
 	}
 
-	// Parse response
-	var videoResp FalVideoResponse
-	if err := json.Unmarshal(body, &videoResp); err != nil {
-		return nil, NewProviderError("failed to parse response", err)
+	return body, nil
+}
+
+// newRequest creates a Fal.ai API request with authentication and, when
+// enabled, the transaction ID header
+func (c *FalClient) newRequest(ctx context.Context, method, endpoint string, requestBody []byte) (*http.Request, error) {
+	var reqBody io.Reader
+	if requestBody != nil {
+		reqBody = bytes.NewBuffer(requestBody)
 	}
 
-	return &videoResp, nil
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reqBody)
+	if err != nil {
+		return nil, NewNetworkError("failed to create request", err)
+	}
+
+	if requestBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Key %s", c.config.FalAPIKey))
+	if transactionID, ok := ctx.Value(transactionHeaderKey{}).(string); ok {
+		req.Header.Set(TransactionIDHeader, transactionID)
+	}
+	return req, nil
+}
+
+// falStatusError converts a Fal.ai error response into a ProviderError
+// carrying the HTTP status code
+func falStatusError(statusCode int, body []byte) error {
+	var falErr FalError
+	var providerErr *ReveniumError
+	if err := json.Unmarshal(body, &falErr); err == nil {
+		falErr.Status = statusCode
+		providerErr = NewProviderError(fmt.Sprintf("Fal.ai API error: %s", falErr.Error()), &falErr)
+	} else {
+		providerErr = NewProviderError(fmt.Sprintf("HTTP %d: %s", statusCode, string(body)), nil)
+	}
+	providerErr.StatusCode = statusCode
+	return providerErr
+}
+
+// isRetryableFalError reports whether a failed Fal call may succeed if
+// repeated: network failures, rate limiting (429), and server errors (5xx)
+func isRetryableFalError(err error) bool {
+	var revErr *ReveniumError
+	if !errors.As(err, &revErr) {
+		return false
+	}
+	switch revErr.Type {
+	case ErrorTypeNetwork:
+		return true
+	case ErrorTypeProvider:
+		return revErr.StatusCode == http.StatusTooManyRequests || revErr.StatusCode >= 500
+	}
+	return false
 }
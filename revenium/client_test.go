@@ -0,0 +1,277 @@
+package revenium
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGenerateImageQueueMode(t *testing.T) {
+	var polls int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/fal-ai/flux/dev":
+			fmt.Fprintf(w, `{"request_id":"req-1","status_url":"%[1]s/fal-ai/flux/requests/req-1/status","response_url":"%[1]s/fal-ai/flux/requests/req-1"}`, server.URL)
+		case r.Method == "GET" && r.URL.Path == "/fal-ai/flux/requests/req-1/status":
+			if atomic.AddInt32(&polls, 1) < 3 {
+				w.Write([]byte(`{"status":"IN_QUEUE","queue_position":1}`))
+				return
+			}
+			w.Write([]byte(`{"status":"COMPLETED"}`))
+		case r.Method == "GET" && r.URL.Path == "/fal-ai/flux/requests/req-1":
+			w.Write([]byte(`{"images":[{"url":"https://fal.media/1.png","width":512,"height":512}]}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewFalClient(&Config{
+		FalAPIKey:            "fal-test-key",
+		FalBaseURL:           "http://sync-host.invalid",
+		FalQueueMode:         true,
+		FalQueueBaseURL:      server.URL,
+		FalQueuePollInterval: 5 * time.Millisecond,
+		ReveniumAPIKey:       "hak_test_key",
+	})
+	if err != nil {
+		t.Fatalf("NewFalClient() error = %v", err)
+	}
+
+	resp, err := client.GenerateImage(context.Background(), "fal-ai/flux/dev", &FalRequest{Prompt: "a cat"})
+	if err != nil {
+		t.Fatalf("GenerateImage() error = %v", err)
+	}
+	if len(resp.Images) != 1 || resp.Images[0].URL != "https://fal.media/1.png" {
+		t.Errorf("unexpected images: %+v", resp.Images)
+	}
+	if got := atomic.LoadInt32(&polls); got != 3 {
+		t.Errorf("status polled %d times, want 3", got)
+	}
+}
+
+func TestGenerateVideoRespectsContextDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Consume the body so the server notices when the client disconnects
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+			w.Write([]byte(`{"video":{"url":"https://fal.media/1.mp4"}}`))
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewFalClient(&Config{
+		FalAPIKey:      "fal-test-key",
+		FalBaseURL:     server.URL,
+		RequestTimeout: 30 * time.Minute,
+		ReveniumAPIKey: "hak_test_key",
+	})
+	if err != nil {
+		t.Fatalf("NewFalClient() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err = client.GenerateVideo(ctx, "fal-ai/kling-video/v1/standard/text-to-video", &FalRequest{Prompt: "a wave", Duration: "5"})
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GenerateVideo() error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed > 3*time.Second {
+		t.Errorf("GenerateVideo() took %v, want the 1s context deadline to win", elapsed)
+	}
+}
+
+func TestFalValidationErrorDetail(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"detail":[` +
+			`{"loc":["body","num_images"],"msg":"ensure this value is less than or equal to 4","type":"value_error.number.not_le"},` +
+			`{"loc":["body","image_size"],"msg":"value is not a valid enumeration member","type":"type_error.enum"}]}`))
+	}))
+	defer server.Close()
+
+	client, err := NewFalClient(&Config{FalAPIKey: "fal-test-key", FalBaseURL: server.URL, ReveniumAPIKey: "hak_test_key"})
+	if err != nil {
+		t.Fatalf("NewFalClient() error = %v", err)
+	}
+
+	_, err = client.GenerateImage(context.Background(), "fal-ai/flux/dev", &FalRequest{Prompt: "a cat", NumImages: 9})
+
+	var falErr *FalError
+	if !errors.As(err, &falErr) {
+		t.Fatalf("GenerateImage() error = %v, want wrapped *FalError", err)
+	}
+	if falErr.Status != http.StatusUnprocessableEntity {
+		t.Errorf("Status = %d, want 422", falErr.Status)
+	}
+	if len(falErr.Detail) != 2 {
+		t.Fatalf("Detail has %d entries, want 2", len(falErr.Detail))
+	}
+	want := "validation failed: body.num_images: ensure this value is less than or equal to 4; body.image_size: value is not a valid enumeration member"
+	if falErr.Error() != want {
+		t.Errorf("Error() = %q, want %q", falErr.Error(), want)
+	}
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		imageHandler(w, r)
+	}))
+	defer server.Close()
+
+	client, err := NewFalClient(&Config{FalAPIKey: "fal-test-key", FalBaseURL: server.URL, ReveniumAPIKey: "hak_test_key", MaxRequestBytes: 1024})
+	if err != nil {
+		t.Fatalf("NewFalClient() error = %v", err)
+	}
+
+	_, err = client.GenerateImage(context.Background(), "fal-ai/flux/dev", &FalRequest{Prompt: strings.Repeat("a", 2048)})
+	if !IsValidationError(err) {
+		t.Errorf("oversized request: error = %v, want ValidationError", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("oversized request reached Fal %d times, want 0", got)
+	}
+
+	if _, err := client.GenerateImage(context.Background(), "fal-ai/flux/dev", &FalRequest{Prompt: "a cat"}); err != nil {
+		t.Errorf("small request: error = %v", err)
+	}
+}
+
+func TestSubmitVideoWithProgress(t *testing.T) {
+	var polls int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/fal-ai/kling-video":
+			fmt.Fprintf(w, `{"request_id":"req-1","status_url":"%[1]s/fal-ai/kling-video/requests/req-1/status","response_url":"%[1]s/fal-ai/kling-video/requests/req-1"}`, server.URL)
+		case r.Method == "GET" && r.URL.Path == "/fal-ai/kling-video/requests/req-1/status":
+			if r.URL.Query().Get("logs") != "1" {
+				t.Errorf("status polled without logs=1")
+			}
+			switch atomic.AddInt32(&polls, 1) {
+			case 1:
+				w.Write([]byte(`{"status":"IN_QUEUE","queue_position":2}`))
+			case 2:
+				w.Write([]byte(`{"status":"IN_PROGRESS","logs":[{"message":"Rendering 25%"}]}`))
+			case 3:
+				w.Write([]byte(`{"status":"IN_PROGRESS","logs":[{"message":"Rendering 25%"},{"message":"Rendering 70%"}]}`))
+			default:
+				w.Write([]byte(`{"status":"COMPLETED","logs":[{"message":"Rendering 25%"},{"message":"Rendering 70%"},{"message":"Done"}]}`))
+			}
+		case r.Method == "GET" && r.URL.Path == "/fal-ai/kling-video/requests/req-1":
+			w.Write([]byte(`{"video":{"url":"https://fal.media/1.mp4"}}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	falClient, err := NewFalClient(&Config{
+		FalAPIKey:            "fal-test-key",
+		FalQueueBaseURL:      server.URL,
+		FalQueuePollInterval: 5 * time.Millisecond,
+		ReveniumAPIKey:       "hak_test_key",
+	})
+	if err != nil {
+		t.Fatalf("NewFalClient() error = %v", err)
+	}
+	client, meter := newFakeClient(t, nil, WithFalGenerator(falClient))
+
+	progress, result := client.SubmitVideoWithProgress(context.Background(), "fal-ai/kling-video", &FalRequest{Prompt: "a cat"})
+
+	var events []ProgressEvent
+	for ev := range progress {
+		events = append(events, ev)
+	}
+	res := <-result
+	if res.Err != nil {
+		t.Fatalf("SubmitVideoWithProgress() error = %v", res.Err)
+	}
+	if res.Response == nil || res.Response.Video.URL != "https://fal.media/1.mp4" {
+		t.Errorf("unexpected response: %+v", res.Response)
+	}
+
+	wantPercent := []float64{0, 25, 70, 100}
+	if len(events) != len(wantPercent) {
+		t.Fatalf("got %d progress events, want %d: %+v", len(events), len(wantPercent), events)
+	}
+	for i, want := range wantPercent {
+		if events[i].Percent != want {
+			t.Errorf("event %d percent = %v, want %v", i, events[i].Percent, want)
+		}
+	}
+	if events[0].QueuePosition != 2 {
+		t.Errorf("queue position = %d, want 2", events[0].QueuePosition)
+	}
+	if events[3].Message != "Done" {
+		t.Errorf("final message = %q, want %q", events[3].Message, "Done")
+	}
+
+	client.Flush()
+	if got := len(meter.recorded()); got != 1 {
+		t.Errorf("metering sent %d times, want 1", got)
+	}
+}
+
+func TestSubmitVideoWithProgressCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "POST" {
+			w.Write([]byte(`{"request_id":"req-1","status_url":"` + "http://" + r.Host + `/status","response_url":"http://` + r.Host + `/result"}`))
+			return
+		}
+		w.Write([]byte(`{"status":"IN_PROGRESS"}`))
+	}))
+	defer server.Close()
+
+	falClient, err := NewFalClient(&Config{
+		FalAPIKey:            "fal-test-key",
+		FalQueueBaseURL:      server.URL,
+		FalQueuePollInterval: 5 * time.Millisecond,
+		ReveniumAPIKey:       "hak_test_key",
+	})
+	if err != nil {
+		t.Fatalf("NewFalClient() error = %v", err)
+	}
+	client, meter := newFakeClient(t, nil, WithFalGenerator(falClient))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	progress, result := client.SubmitVideoWithProgress(ctx, "fal-ai/kling-video", &FalRequest{Prompt: "a cat"})
+	<-progress
+	cancel()
+
+	for range progress {
+	}
+	res := <-result
+	if !errors.Is(res.Err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", res.Err)
+	}
+	if _, ok := <-result; ok {
+		t.Error("result channel not closed")
+	}
+
+	client.Flush()
+	if got := len(meter.recorded()); got != 0 {
+		t.Errorf("metering sent %d times for a cancelled job, want 0", got)
+	}
+}
@@ -0,0 +1,163 @@
+package revenium
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// CoalescedMeteringMode selects how coalesced calls are metered; see
+// WithCoalescedMetering
+type CoalescedMeteringMode int
+
+const (
+	// CoalescedMeterEach meters every logical request, including those that
+	// shared another call's result (default)
+	CoalescedMeterEach CoalescedMeteringMode = iota
+	// CoalescedMeterOnce meters only the call that reached Fal.ai, recording
+	// how many requests shared it
+	CoalescedMeterOnce
+)
+
+// coalescer collapses concurrent identical calls into one, in the manner of
+// singleflight: the first caller for a key runs the call and later callers
+// wait for and share its result
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is an in-flight call and its result
+type coalescedCall struct {
+	wg      sync.WaitGroup
+	result  interface{}
+	err     error
+	callers int
+}
+
+// do runs call once for all concurrent callers with the same key. leader
+// reports whether this caller ran call; callers is how many callers shared
+// the result, including the leader. A panic in call is returned as an error to
+// every caller. A follower whose own ctx is still live when the leader failed
+// with a context error (the leader's caller gave up) runs call itself.
+func (c *coalescer) do(ctx context.Context, key string, call func() (interface{}, error)) (result interface{}, leader bool, callers int, err error) {
+	c.mu.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]*coalescedCall)
+	}
+	if inflight, ok := c.calls[key]; ok {
+		inflight.callers++
+		c.mu.Unlock()
+		inflight.wg.Wait()
+		if isContextError(inflight.err) && ctx.Err() == nil {
+			result, err = call()
+			return result, true, 1, err
+		}
+		return inflight.result, false, inflight.callers, inflight.err
+	}
+	inflight := &coalescedCall{callers: 1}
+	inflight.wg.Add(1)
+	c.calls[key] = inflight
+	c.mu.Unlock()
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			inflight.result, inflight.err = nil, fmt.Errorf("coalesced call panicked: %v", rec)
+		}
+		// Stop accepting followers before releasing them, so callers is final
+		c.mu.Lock()
+		delete(c.calls, key)
+		callers = inflight.callers
+		c.mu.Unlock()
+		inflight.wg.Done()
+
+		result, leader, err = inflight.result, true, inflight.err
+	}()
+
+	inflight.result, inflight.err = call()
+	return
+}
+
+// isContextError reports whether err comes from a cancelled or expired context
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// coalesceKey identifies identical generations: the same operation and model
+// with the same request parameters
+func coalesceKey(opType OperationType, model string, request *FalRequest) (string, bool) {
+	encoded, err := json.Marshal(struct {
+		Request *FalRequest            `json:"request"`
+		Params  map[string]interface{} `json:"params,omitempty"`
+	}{request, requestAdditionalParams(request)})
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(append([]byte(string(opType)+"|"+model+"|"), encoded...))
+	return hex.EncodeToString(sum[:]), true
+}
+
+// requestAdditionalParams returns the request's AdditionalParams, or nil
+func requestAdditionalParams(request *FalRequest) map[string]interface{} {
+	if request == nil {
+		return nil
+	}
+	return request.AdditionalParams
+}
+
+// coalesce runs call through the client's coalescer when request coalescing
+// is enabled, otherwise directly. It returns the result, whether this caller
+// shared another caller's result, and how many callers shared it.
+func (r *ReveniumFal) coalesce(ctx context.Context, opType OperationType, model string, request *FalRequest, call func() (interface{}, error)) (result interface{}, follower bool, callers int, err error) {
+	key, ok := "", false
+	if r.config.RequestCoalescing {
+		key, ok = coalesceKey(opType, model, request)
+	}
+	if !ok {
+		result, err = call()
+		return result, false, 1, err
+	}
+	result, leader, callers, err := r.coalescer.do(ctx, key, call)
+	return result, !leader, callers, err
+}
+
+// applyCoalescing records how a coalesced call was shared in the payload's
+// attributes and reports whether the payload should be metered at all
+func (r *ReveniumFal) applyCoalescing(payload *MeteringPayload, follower bool, callers int) bool {
+	if callers <= 1 {
+		return true
+	}
+	if follower {
+		if r.config.CoalescedMetering == CoalescedMeterOnce {
+			return false
+		}
+		payload.setAttribute("coalesced", true)
+	}
+	payload.setAttribute("coalescedRequests", callers)
+	return true
+}
+
+// cloneImageResponse copies resp so callers sharing a coalesced result can
+// modify their response (e.g. image URLs) independently
+func cloneImageResponse(resp *FalImageResponse) *FalImageResponse {
+	if resp == nil {
+		return nil
+	}
+	clone := *resp
+	clone.Images = append([]FalImage(nil), resp.Images...)
+	return &clone
+}
+
+// cloneVideoResponse copies resp for a caller sharing a coalesced result
+func cloneVideoResponse(resp *FalVideoResponse) *FalVideoResponse {
+	if resp == nil {
+		return nil
+	}
+	clone := *resp
+	clone.Segments = append([]FalVideo(nil), resp.Segments...)
+	return &clone
+}
@@ -0,0 +1,194 @@
+package revenium
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runIdenticalImageCalls starts n identical GenerateImage calls at once and
+// waits for them, failing the test on any error
+func runIdenticalImageCalls(t *testing.T, client *ReveniumFal, n int) []*FalImageResponse {
+	t.Helper()
+
+	responses := make([]*FalImageResponse, n)
+	errs := make([]error, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			responses[i], errs[i] = client.GenerateImage(context.Background(), "fal-ai/flux/dev", &FalRequest{Prompt: "a cat", NumImages: 1})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("call %d error = %v", i, err)
+		}
+	}
+	return responses
+}
+
+func TestRequestCoalescing(t *testing.T) {
+	var falCalls int32
+	falHandler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&falCalls, 1)
+		time.Sleep(200 * time.Millisecond) // keep the call in flight while the others arrive
+		imageHandler(w, r)
+	}
+
+	const callers = 20
+	t.Run("meter each", func(t *testing.T) {
+		atomic.StoreInt32(&falCalls, 0)
+		meter := &meterRecorder{}
+		client := newTestClient(t, falHandler, meter.ServeHTTP, WithRequestCoalescing(true))
+
+		responses := runIdenticalImageCalls(t, client, callers)
+		client.Flush()
+
+		if got := atomic.LoadInt32(&falCalls); got != 1 {
+			t.Fatalf("Fal server received %d requests, want 1", got)
+		}
+		// Each caller owns its response
+		responses[0].Images[0].URL = "changed"
+		if responses[1].Images[0].URL != "https://fal.media/1.png" {
+			t.Error("coalesced callers share one response object")
+		}
+
+		payloads := meter.recorded()
+		if len(payloads) != callers {
+			t.Fatalf("got %d metering records, want one per logical request (%d)", len(payloads), callers)
+		}
+		followers := 0
+		for _, p := range payloads {
+			if p.Attributes["coalescedRequests"] != float64(callers) {
+				t.Errorf("coalescedRequests = %v, want %d", p.Attributes["coalescedRequests"], callers)
+			}
+			if p.Attributes["coalesced"] == true {
+				followers++
+			}
+		}
+		if followers != callers-1 {
+			t.Errorf("%d records marked coalesced, want %d", followers, callers-1)
+		}
+	})
+
+	t.Run("meter once", func(t *testing.T) {
+		atomic.StoreInt32(&falCalls, 0)
+		meter := &meterRecorder{}
+		client := newTestClient(t, falHandler, meter.ServeHTTP,
+			WithRequestCoalescing(true), WithCoalescedMetering(CoalescedMeterOnce))
+
+		runIdenticalImageCalls(t, client, callers)
+		client.Flush()
+
+		if got := atomic.LoadInt32(&falCalls); got != 1 {
+			t.Fatalf("Fal server received %d requests, want 1", got)
+		}
+		payloads := meter.recorded()
+		if len(payloads) != 1 || payloads[0].Attributes["coalescedRequests"] != float64(callers) {
+			t.Errorf("got %d metering records (%v), want 1 covering %d requests", len(payloads), payloads, callers)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		atomic.StoreInt32(&falCalls, 0)
+		client := newTestClient(t, falHandler, (&meterRecorder{}).ServeHTTP)
+
+		runIdenticalImageCalls(t, client, 3)
+		client.Flush()
+		if got := atomic.LoadInt32(&falCalls); got != 3 {
+			t.Errorf("Fal server received %d requests without coalescing, want 3", got)
+		}
+	})
+}
+
+func TestCoalescerLeaderFailures(t *testing.T) {
+	// startFollower calls do for key in the background, reporting its error
+	startFollower := func(c *coalescer, ctx context.Context, key string, call func() (interface{}, error)) chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, _, _, err := c.do(ctx, key, call)
+			done <- err
+		}()
+		return done
+	}
+	// waitCallers blocks until want callers have joined key's in-flight call
+	waitCallers := func(c *coalescer, key string, want int) {
+		for {
+			c.mu.Lock()
+			inflight, ok := c.calls[key]
+			joined := ok && inflight.callers == want
+			c.mu.Unlock()
+			if joined {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("leader panic", func(t *testing.T) {
+		var c coalescer
+		release := make(chan struct{})
+		leaderErr := make(chan error, 1)
+		go func() {
+			_, _, _, err := c.do(context.Background(), "k", func() (interface{}, error) {
+				<-release
+				panic("boom")
+			})
+			leaderErr <- err
+		}()
+		waitCallers(&c, "k", 1)
+		follower := startFollower(&c, context.Background(), "k", nil)
+		waitCallers(&c, "k", 2)
+		close(release)
+
+		for name, ch := range map[string]chan error{"leader": leaderErr, "follower": follower} {
+			select {
+			case err := <-ch:
+				if err == nil {
+					t.Errorf("%s error = nil, want the panic as an error", name)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("%s blocked after the leader panicked", name)
+			}
+		}
+		if _, _, _, err := c.do(context.Background(), "k", func() (interface{}, error) { return "ok", nil }); err != nil {
+			t.Errorf("later call error = %v, want a fresh call", err)
+		}
+	})
+
+	t.Run("leader cancelled", func(t *testing.T) {
+		var c coalescer
+		leaderCtx, cancel := context.WithCancel(context.Background())
+		release := make(chan struct{})
+		go c.do(leaderCtx, "k", func() (interface{}, error) {
+			<-release
+			return nil, leaderCtx.Err()
+		})
+		waitCallers(&c, "k", 1)
+		var reruns int32
+		follower := startFollower(&c, context.Background(), "k", func() (interface{}, error) {
+			atomic.AddInt32(&reruns, 1)
+			return "ok", nil
+		})
+		waitCallers(&c, "k", 2)
+		cancel()
+		close(release)
+
+		if err := <-follower; err != nil {
+			t.Errorf("follower error = %v, want its own call to succeed", err)
+		}
+		if got := atomic.LoadInt32(&reruns); got != 1 {
+			t.Errorf("follower ran the call %d times, want 1", got)
+		}
+	})
+}
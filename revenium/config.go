@@ -1,8 +1,15 @@
 package revenium
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,99 +24,1299 @@ type Config struct {
 	FalBaseURL     string
 	RequestTimeout time.Duration // HTTP request timeout (default: 1800s / 30 min for video generation)
 
+	// FalCredentialAlias names the configured Fal key in metering records;
+	// see WithFalCredentialAlias
+	FalCredentialAlias string
+
+	// Fal.ai queue configuration. When FalQueueMode is true, requests are
+	// submitted to the queue host and polled until completion instead of
+	// holding a single HTTP connection open on the sync host.
+	// Environment variables: FAL_QUEUE_MODE=true, FAL_QUEUE_BASE_URL
+	FalQueueMode         bool
+	falQueueModeSet      bool
+	FalQueueBaseURL      string
+	FalQueuePollInterval time.Duration // Status polling interval (default: 1s)
+
 	// Revenium metering configuration
 	ReveniumAPIKey    string
 	ReveniumBaseURL   string
 	ReveniumOrgID     string
 	ReveniumProductID string
+	ReveniumRegion    string // Data-residency region ("us", "eu"); see WithReveniumRegion
+
+	// OptionalMetering lets the middleware run without a valid Revenium API
+	// key, with metering disabled; see WithOptionalMetering
+	OptionalMetering bool
+
+	// MeteringSampleRate is the fraction of metering records to send (0.0-1.0,
+	// default 1.0); see WithMeteringSampleRate
+	MeteringSampleRate    float64
+	meteringSampleRateSet bool
+
+	// RetryBudgetRatio caps metering retries at this fraction of total metering
+	// requests, client-wide; see WithRetryBudget
+	RetryBudgetRatio float64
+	retryBudgetSet   bool
+
+	// SyncMeteringWarmup makes the first N metering sends blocking; see WithSyncMeteringWarmup
+	SyncMeteringWarmup int
+
+	// OrderedMeteringPerTrace delivers payloads sharing a TraceID one at a
+	// time, in submission order; see WithOrderedMeteringPerTrace
+	OrderedMeteringPerTrace bool
+
+	// SyncMeteringBudget is how long a generation call waits for its metering
+	// before leaving it to the background; see WithSyncMeteringBudget
+	SyncMeteringBudget time.Duration
+
+	// Batched metering delivery (MeteringBatchSize <= 1 disables batching)
+	MeteringBatchSize     int
+	MeteringBatchInterval time.Duration
+
+	// Built-in retry of failed Fal calls (FalMaxRetries 0 disables); see WithFalRetry
+	FalMaxRetries   int
+	FalRetryBackoff time.Duration
+
+	// MaxRequestBytes caps the marshaled size of a Fal request body (default:
+	// 10 MiB, negative disables); see WithMaxRequestBytes
+	MaxRequestBytes int64
+
+	// GenerationConcurrency bounds parallel Fal calls in GenerateVideoBatch and
+	// GenerateImageSeedSweep (default: 4)
+	GenerationConcurrency int
+
+	// Meterer replaces the default MeteringClient (e.g. with a test fake)
+	Meterer Meterer
+
+	// FalGenerator replaces the default FalClient (e.g. with a test fake)
+	FalGenerator FalGenerator
+
+	// Metering transport connection pool (zero values use the shared defaults)
+	MeteringMaxIdleConns        int
+	MeteringMaxIdleConnsPerHost int
+	MeteringIdleConnTimeout     time.Duration
+
+	// DisableHTMLEscaping sends <, >, and & literally in metering JSON instead
+	// of as \u003c, \u003e, and \u0026; see WithDisableHTMLEscaping
+	DisableHTMLEscaping bool
+
+	// MeteringTimeout bounds each metering request (default: 10s); see WithMeteringTimeout
+	MeteringTimeout time.Duration
+
+	// Prompt capture configuration (opt-in for analytics)
+	// When enabled, the following fields are added to metering payloads:
+	//   - inputMessages: JSON array with [{"role": "user", "content": "<prompt>"}] format
+	//   - outputResponse: Generated content URL(s)
+	//   - promptsTruncated: true if prompt exceeded 50,000 characters
+	// Environment variable: REVENIUM_CAPTURE_PROMPTS=true
+	CapturePrompts bool // When true, captures generation prompts for analytics (default: false)
+
+	// Internal: tracks whether CapturePrompts was explicitly set via WithCapturePrompts.
+	// When true, environment variable will NOT override the programmatic setting.
+	capturePromptsSet bool
+
+	// PromptHashing records a SHA-256 of the normalized prompt in
+	// attributes["promptHash"] instead of capturing prompt text; see
+	// WithPromptHashing
+	PromptHashing bool
+
+	// CaptureOutputs captures generated output URLs in outputResponse
+	// independently of CapturePrompts. Unless set via WithCaptureOutputs,
+	// outputs are captured whenever CapturePrompts is enabled.
+	CaptureOutputs bool
+
+	// Internal: tracks whether CaptureOutputs was explicitly set via WithCaptureOutputs
+	captureOutputsSet bool
+
+	// CaptureRequestParams adds the serialized Fal request to metering attributes
+	// under "falRequest" (default: false). The prompt is omitted unless
+	// CapturePrompts is also enabled.
+	CaptureRequestParams bool
+
+	// SanitizePrompts trims surrounding whitespace and strips control and
+	// zero-width characters from prompts before sending and capture (default: false)
+	SanitizePrompts bool
+
+	// DurationSource selects what drives RequestDuration (default: DurationSourceWallClock)
+	DurationSource DurationSource
+
+	// TraceIDExtractor derives a trace ID from the call context (e.g. from an
+	// active OpenTelemetry span); see WithTraceIDExtractor
+	TraceIDExtractor func(ctx context.Context) string
+
+	// Transaction ID customization; see WithTransactionIDPrefix and
+	// WithTransactionIDGenerator
+	TransactionIDPrefix    string
+	TransactionIDGenerator func() string
+
+	// NormalizeSubscriberFields maps subscriber field aliases onto the canonical
+	// schema before metering (default: false); see NormalizeSubscriber
+	NormalizeSubscriberFields bool
+
+	// ResponseEnricher is invoked after a successful Fal call and before the
+	// metering payload is built; see WithResponseEnricher
+	ResponseEnricher ResponseEnricher
+
+	// MeteringEventLog receives a MeteringEvent for every delivery attempt made
+	// by the default MeteringClient; see WithMeteringEventLog
+	MeteringEventLog func(MeteringEvent)
+
+	// PerImageMetering emits one metering record per generated image instead of
+	// a single aggregated record per request (default: false)
+	PerImageMetering bool
+
+	// DefaultCostType replaces the "AI" costType for payloads whose metadata
+	// has no "costType" key; see WithDefaultCostType
+	DefaultCostType string
+
+	// Default environment and region for payloads whose metadata omits them;
+	// see WithEnvironment and WithRegion
+	DefaultEnvironment string
+	DefaultRegion      string
+
+	// CostAllocationTags are merged into attributes["tags"] on every payload;
+	// see WithCostAllocationTags
+	CostAllocationTags map[string]string
+
+	// ModelTierClassifier records the model's pricing tier in
+	// attributes["modelTier"] when set; see WithModelTierClassifier
+	ModelTierClassifier func(model string) string
+
+	// OutputUploader copies each generated image to the caller's storage;
+	// see WithOutputUploader
+	OutputUploader OutputUploader
+
+	// OutputDownloadTimeout bounds each output download made for
+	// OutputUploader or OutputHashSHA256OfBytes (default: 30s); see
+	// WithOutputDownloadTimeout
+	OutputDownloadTimeout time.Duration
+
+	// MetricsRecorder receives generation and metering queue metrics; see
+	// WithMetricsRecorder
+	MetricsRecorder MetricsRecorder
+
+	// ModelDefaults holds per-model request defaults, keyed by Fal endpoint
+	// ID; see WithModelDefaults
+	ModelDefaults map[string]FalRequest
+
+	// Build metadata added to every payload as attributes["buildVersion"] and
+	// attributes["gitCommit"]; see WithBuildInfo
+	BuildVersion string
+	GitCommit    string
+
+	// DisableQualityScoreClamp sends responseQualityScore as given instead of
+	// clamping it into [0.0, 1.0]; see WithQualityScoreClamp
+	DisableQualityScoreClamp bool
+
+	// SubscriberQuota reports a subscriber's remaining generations; calls it
+	// cannot cover fail with QuotaExceededError. See WithSubscriberQuota
+	SubscriberQuota func(subscriberID string) (remaining int, ok bool)
+
+	// CaptureModerationData records detected NSFW concept labels in
+	// attributes["nsfwConcepts"] (default: false); see WithCaptureModerationData
+	CaptureModerationData bool
+
+	// DisableContentTypeNormalization records outputs' content types as Fal
+	// reports them; see WithContentTypeNormalization
+	DisableContentTypeNormalization bool
+
+	// ModelFallbacks maps a model to the models tried, in order, when it fails
+	// with a retryable error; see WithModelFallback
+	ModelFallbacks map[string][]string
+
+	// RequestCoalescing shares one Fal call among concurrent identical
+	// requests; see WithRequestCoalescing
+	RequestCoalescing bool
+
+	// CoalescedMetering selects how coalesced requests are metered (default:
+	// CoalescedMeterEach); see WithCoalescedMetering
+	CoalescedMetering CoalescedMeteringMode
+
+	// CaptureOutputExpiry records when presigned output URLs expire in
+	// attributes["outputExpiresAt"]; see WithCaptureOutputExpiry
+	CaptureOutputExpiry bool
+
+	// SendTransactionHeader sends each call's metering TransactionID to Fal as
+	// the X-Revenium-Transaction-Id header; see WithSendTransactionHeader
+	SendTransactionHeader bool
+
+	// OutputHashing records a hash of each output in attributes["outputHashes"]
+	// (default: OutputHashNone); see WithOutputHashing
+	OutputHashing OutputHashMode
+
+	// Fal response headers copied into attributes["falHeaders"], minus any in
+	// FalHeaderDenylist; see WithCaptureFalHeaders
+	CaptureFalHeaders []string
+	FalHeaderDenylist []string
+
+	// CaptureGPUInfo records the GPU a job ran on in attributes["gpuType"],
+	// from the response body or the GPUInfoHeader response header (default:
+	// DefaultGPUInfoHeader); see WithCaptureGPUInfo
+	CaptureGPUInfo bool
+	GPUInfoHeader  string
+
+	// MeterErrors sends a metering record for failed Fal calls, with StopReason
+	// "TIMEOUT" for deadline errors and "ERROR" otherwise (default: false)
+	MeterErrors bool
+
+	// Logging configuration
+	LogLevel         string
+	VerboseStartup   bool
+	KeyRedactionMode KeyRedactionMode // How API keys appear in debug logs (default: KeyRedactionFull)
+
+	// AllowedHosts lists the hosts the Fal.ai and Revenium base URLs may point
+	// at (default: the production hosts plus localhost); see WithAllowedHosts
+	AllowedHosts []string
+
+	// VerifyConnectivity makes Initialize connect to the Fal.ai and Revenium
+	// base URLs before returning; see WithVerifyConnectivity
+	VerifyConnectivity bool
+
+	// StrictInit makes a repeated Initialize call with conflicting options
+	// return an error instead of logging a warning
+	StrictInit bool
+
+	// DotEnvPaths lists the exact .env files to load. When empty, .env.local and
+	// .env are searched in the current directory and its parent (legacy behavior).
+	DotEnvPaths []string
+}
+
+// Option is a functional option for configuring Config
+type Option func(*Config)
+
+// WithFalAPIKey sets the Fal.ai API key
+func WithFalAPIKey(key string) Option {
+	return func(c *Config) {
+		c.FalAPIKey = key
+	}
+}
+
+// WithFalCredentialAlias sets the alias of the configured Fal key, used as the
+// payload's credentialAlias when the usage metadata doesn't set one. This ties
+// spend to the key that paid for it when running several Fal keys, without
+// repeating the alias on every request.
+//
+// Example:
+//
+//	revenium.Initialize(
+//	    revenium.WithFalAPIKey(os.Getenv("FAL_KEY_TEAM_A")),
+//	    revenium.WithFalCredentialAlias("fal-team-a"),
+//	)
+func WithFalCredentialAlias(alias string) Option {
+	return func(c *Config) {
+		c.FalCredentialAlias = alias
+	}
+}
+
+// WithFalQueueMode routes generation requests through Fal's queue host
+// (queue.fal.run) instead of the synchronous host (fal.run).
+//
+// The sync host holds one HTTP connection open for the whole generation, which
+// is simplest for fast image models. The queue host is better suited to slow
+// jobs such as video generation, where long-lived connections are prone to
+// being dropped by proxies and load balancers. The submit/poll lifecycle is
+// handled transparently and the same response types are returned; metering is
+// still sent once, timed across the full queue lifecycle.
+//
+// Example:
+//
+//	revenium.Initialize(
+//	    revenium.WithFalQueueMode(true),
+//	)
+//
+// Environment variable alternative: FAL_QUEUE_MODE=true. An explicit
+// WithFalQueueMode(false) takes precedence over the environment variable.
+func WithFalQueueMode(enabled bool) Option {
+	return func(c *Config) {
+		c.FalQueueMode = enabled
+		c.falQueueModeSet = true
+	}
+}
+
+// WithFalQueuePollInterval sets how often queued requests are polled for completion
+func WithFalQueuePollInterval(interval time.Duration) Option {
+	return func(c *Config) {
+		c.FalQueuePollInterval = interval
+	}
+}
+
+// WithRequestTimeout sets the HTTP request timeout for Fal.ai API calls
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.RequestTimeout = timeout
+	}
+}
+
+// WithReveniumAPIKey sets the Revenium API key
+func WithReveniumAPIKey(key string) Option {
+	return func(c *Config) {
+		c.ReveniumAPIKey = key
+	}
+}
+
+// WithReveniumBaseURL sets the Revenium base URL
+func WithReveniumBaseURL(url string) Option {
+	return func(c *Config) {
+		c.ReveniumBaseURL = url
+	}
+}
+
+// reveniumRegionBaseURLs maps supported data-residency regions to base URLs
+var reveniumRegionBaseURLs = map[string]string{
+	"us": "https://api.revenium.ai",
+	"eu": "https://api.eu.revenium.ai",
+}
+
+// WithReveniumRegion routes metering to a regional Revenium endpoint for
+// data-residency requirements. Supported regions: "us", "eu".
+// An explicit WithReveniumBaseURL takes precedence when both are set.
+// Unknown regions are rejected by Validate.
+func WithReveniumRegion(region string) Option {
+	return func(c *Config) {
+		c.ReveniumRegion = region
+	}
+}
+
+// WithReveniumOrgID sets the Revenium organization ID, used as the payload's
+// organizationId when the usage metadata sets neither organizationId nor
+// organizationName
+func WithReveniumOrgID(id string) Option {
+	return func(c *Config) {
+		c.ReveniumOrgID = id
+	}
+}
+
+// WithOptionalMetering allows initialization without a valid Revenium API
+// key. When enabled and REVENIUM_METERING_API_KEY is missing or malformed, the
+// middleware starts with metering disabled (logging a warning once) instead of
+// failing: Fal.ai calls, retries, and batching work as usual, but no metering
+// records are sent. With a valid key, metering runs normally.
+//
+// Example:
+//
+//	// Local development without a Revenium account
+//	revenium.Initialize(revenium.WithOptionalMetering(true))
+func WithOptionalMetering(optional bool) Option {
+	return func(c *Config) {
+		c.OptionalMetering = optional
+	}
+}
+
+// WithReveniumProductID sets the Revenium product ID, used as the payload's
+// productId when the usage metadata sets neither productId nor productName
+func WithReveniumProductID(id string) Option {
+	return func(c *Config) {
+		c.ReveniumProductID = id
+	}
+}
+
+// WithMeteringSampleRate meters only a random sample of operations, for very
+// high-volume, low-value workloads (e.g. millions of thumbnails) where metering
+// every call isn't worth the cost. rate is the probability (0.0-1.0) that a
+// payload is sent. Sent payloads have their image counts, video durations,
+// totalCost, credits, and inference seconds scaled by 1/rate so aggregate
+// totals are preserved, and carry attributes["sampled"]=rate.
+// Default is 1.0 (no sampling); 0.0 disables metering entirely.
+func WithMeteringSampleRate(rate float64) Option {
+	return func(c *Config) {
+		c.MeteringSampleRate = rate
+		c.meteringSampleRateSet = true
+	}
+}
+
+// WithRetryBudget caps metering retries across the whole client at ratio of
+// total metering requests (e.g. 0.1 allows one retry per ten requests), like
+// gRPC retry throttling. Without it every failed request retries, which during
+// a partial Revenium outage multiplies the load on the struggling service.
+// A small reserve lets isolated failures retry; once the budget is exhausted,
+// failed requests are dropped without retrying. Negative ratios are treated
+// as 0. By default retries are unlimited.
+//
+// Example:
+//
+//	revenium.Initialize(revenium.WithRetryBudget(0.1))
+func WithRetryBudget(ratio float64) Option {
+	return func(c *Config) {
+		if ratio < 0 {
+			ratio = 0
+		}
+		c.RetryBudgetRatio = ratio
+		c.retryBudgetSet = true
+	}
+}
+
+// WithSyncMeteringWarmup makes the first n metering sends synchronous: the
+// generation call doesn't return until its metering has been delivered (or has
+// failed, with a prominent error log). After n sends the client reverts to the
+// fire-and-forget path. This surfaces misconfiguration, such as a wrong API key
+// or base URL, right at startup without permanently slowing the hot path.
+func WithSyncMeteringWarmup(n int) Option {
+	return func(c *Config) {
+		c.SyncMeteringWarmup = n
+	}
+}
+
+// WithSyncMeteringBudget makes each generation call wait up to d for its
+// metering to be delivered before returning, then leave any unfinished send to
+// continue in the background. When Revenium is healthy the payload is
+// delivered (and any MeteringEventLog callback has run) by the time the call
+// returns; when it is slow, the call is delayed by at most d. Default is 0:
+// fully asynchronous. Has no effect on payloads queued for batched delivery.
+//
+// Example:
+//
+//	revenium.Initialize(
+//	    revenium.WithSyncMeteringBudget(200 * time.Millisecond),
+//	)
+func WithSyncMeteringBudget(d time.Duration) Option {
+	return func(c *Config) {
+		c.SyncMeteringBudget = d
+	}
+}
+
+// WithOrderedMeteringPerTrace delivers metering for payloads that share a
+// TraceID one at a time, in the order the calls completed, so a parent
+// generation's record always reaches Revenium before its children's. Payloads
+// from different traces, and payloads without a TraceID, are still delivered
+// in parallel.
+//
+// The trade-off is throughput within a trace: each payload waits for the
+// previous one's delivery, including its retries, so a slow or failing send
+// delays the rest of the trace. Batched delivery (WithMeteringBatch) takes
+// precedence, and ordered payloads do not wait for WithSyncMeteringBudget.
+func WithOrderedMeteringPerTrace(enabled bool) Option {
+	return func(c *Config) {
+		c.OrderedMeteringPerTrace = enabled
+	}
+}
+
+// WithMeterer injects a custom Meterer in place of the default MeteringClient.
+// This is mainly useful in tests, to capture payloads without a metering server.
+//
+// Example:
+//
+//	type fakeMeterer struct{ payloads []*revenium.MeteringPayload }
+//
+//	func (f *fakeMeterer) SendImageMetering(p *revenium.MeteringPayload) error {
+//	    f.payloads = append(f.payloads, p)
+//	    return nil
+//	}
+//	// ... SendVideoMetering likewise
+//
+//	revenium.Initialize(revenium.WithMeterer(&fakeMeterer{}))
+func WithMeterer(meterer Meterer) Option {
+	return func(c *Config) {
+		c.Meterer = meterer
+	}
+}
+
+// WithFalGenerator injects a custom FalGenerator in place of the default
+// FalClient, so tests can return canned Fal.ai responses and assert the
+// resulting metering payloads deterministically.
+func WithFalGenerator(generator FalGenerator) Option {
+	return func(c *Config) {
+		c.FalGenerator = generator
+	}
+}
+
+// WithMeteringBatch enables batched metering delivery. Payloads are accumulated
+// and sent as a single JSON array to /meter/v2/ai/batch when maxBatch payloads
+// are pending or maxInterval has passed since the first one (default: 1s).
+// Flush, Close, and Drain send partial batches immediately. If the batch
+// endpoint fails, the payloads are retried individually on their regular
+// image/video endpoints.
+//
+// Example:
+//
+//	revenium.Initialize(
+//	    revenium.WithMeteringBatch(50, 2*time.Second),
+//	)
+func WithMeteringBatch(maxBatch int, maxInterval time.Duration) Option {
+	return func(c *Config) {
+		c.MeteringBatchSize = maxBatch
+		c.MeteringBatchInterval = maxInterval
+	}
+}
+
+// WithFalRetry retries Fal calls that fail with a network error, 429, or 5xx
+// response, up to maxRetries times, waiting backoff before the first retry
+// and doubling it each time (default 500ms when backoff is zero). Only the
+// attempt that succeeds is metered, with retryNumber set to its attempt index
+// (0 for the first), overriding any retryNumber in the usage metadata. With
+// WithMeterErrors, each failed attempt is also metered with its own index.
+//
+// Example:
+//
+//	revenium.Initialize(revenium.WithFalRetry(2, time.Second))
+func WithFalRetry(maxRetries int, backoff time.Duration) Option {
+	return func(c *Config) {
+		c.FalMaxRetries = maxRetries
+		c.FalRetryBackoff = backoff
+	}
+}
+
+// WithGenerationConcurrency bounds how many Fal calls GenerateVideoBatch and
+// GenerateImageSeedSweep run at once (default: 4).
+func WithGenerationConcurrency(n int) Option {
+	return func(c *Config) {
+		c.GenerationConcurrency = n
+	}
+}
+
+// WithMeteringTransport sizes the connection pool used for metering requests.
+// The defaults (100 idle connections, 10 per host, 90s idle timeout) can become
+// a bottleneck for high-throughput worker pools, causing connection churn.
+// Each client owns its transport, so different clients can be tuned
+// independently. Zero values keep the corresponding default.
+//
+// Example:
+//
+//	revenium.Initialize(
+//	    revenium.WithMeteringTransport(500, 100, 2*time.Minute),
+//	)
+func WithMeteringTransport(maxIdleConns, maxIdleConnsPerHost int, idleTimeout time.Duration) Option {
+	return func(c *Config) {
+		c.MeteringMaxIdleConns = maxIdleConns
+		c.MeteringMaxIdleConnsPerHost = maxIdleConnsPerHost
+		c.MeteringIdleConnTimeout = idleTimeout
+	}
+}
+
+// WithMeteringTimeout sets how long each metering request may take before it
+// is abandoned and retried (default: 10s). Raise it when Revenium responses
+// are legitimately slow on your network, so they aren't cut off and re-sent.
+// Zero or negative values keep the default.
+func WithMeteringTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.MeteringTimeout = timeout
+	}
+}
+
+// WithDisableHTMLEscaping controls whether metering payloads are sent with
+// <, >, and & written literally (true) or escaped as \u003c, \u003e, and
+// \u0026 (false, the encoding/json default). Enable it when Revenium
+// ingestion or signature verification needs prompts such as
+// "<script>" to appear byte-for-byte in inputMessages.
+func WithDisableHTMLEscaping(disable bool) Option {
+	return func(c *Config) {
+		c.DisableHTMLEscaping = disable
+	}
+}
+
+// WithKeyRedactionMode controls how API keys appear in debug request logs.
+// KeyRedactionFull (default) hides the whole value; KeyRedactionPartial shows
+// the auth scheme and last 4 characters (e.g. "Key ...a1b2") to help debug
+// auth issues without leaking secrets.
+func WithKeyRedactionMode(mode KeyRedactionMode) Option {
+	return func(c *Config) {
+		c.KeyRedactionMode = mode
+	}
+}
+
+// WithCapturePrompts enables/disables prompt capture for analytics.
+// When enabled, generation prompts are captured and sent with metering data.
+// Default is false (opt-in for privacy).
+//
+// Note: When this option is used, it takes precedence over the
+// REVENIUM_CAPTURE_PROMPTS environment variable. This ensures predictable
+// behavior when the caller explicitly configures this setting.
+//
+// Fields added to metering payload when enabled:
+//   - inputMessages: JSON array with [{"role": "user", "content": "<prompt>"}] format
+//   - outputResponse: Generated content URL(s) (images/videos)
+//   - promptsTruncated: true if prompt exceeded 50,000 characters
+//
+// Example:
+//
+//	revenium.Initialize(
+//	    revenium.WithCapturePrompts(true),
+//	)
+//
+// Environment variable alternative: REVENIUM_CAPTURE_PROMPTS=true
+func WithCapturePrompts(capture bool) Option {
+	return func(c *Config) {
+		c.CapturePrompts = capture
+		c.capturePromptsSet = true // Mark as explicitly set - env var won't override
+	}
+}
+
+// WithPromptHashing records a SHA-256 hash of each prompt in
+// attributes["promptHash"] instead of its text, so duplicate prompts can be
+// detected and spend grouped by prompt without storing prompt content. The
+// prompt is normalized first (control characters stripped, lowercased,
+// whitespace collapsed), so prompts differing only in formatting share a hash.
+//
+// Prompt hashing takes precedence over WithCapturePrompts: inputMessages is
+// left empty and the prompt is omitted from the "falRequest" attribute.
+// Output capture is unaffected.
+//
+// Example:
+//
+//	revenium.Initialize(revenium.WithPromptHashing(true))
+func WithPromptHashing(enabled bool) Option {
+	return func(c *Config) {
+		c.PromptHashing = enabled
+	}
+}
+
+// WithCaptureOutputs enables/disables capture of generated output URLs in
+// outputResponse, independently of prompt capture. Use it for asset tracking
+// without recording prompts:
+//
+//	revenium.Initialize(
+//	    revenium.WithCaptureOutputs(true), // outputResponse only, no inputMessages
+//	)
+//
+// When this option is not used, outputs are captured exactly when
+// WithCapturePrompts is enabled. WithCaptureOutputs(false) alongside
+// WithCapturePrompts(true) captures prompts without outputs.
+func WithCaptureOutputs(capture bool) Option {
+	return func(c *Config) {
+		c.CaptureOutputs = capture
+		c.captureOutputsSet = true
+	}
+}
+
+// WithDotEnvPaths sets the exact .env files to load during initialization.
+// When set, no directory walking occurs: only the given files are considered,
+// in order, and missing files are skipped. Earlier files take precedence since
+// .env loading never overrides variables that are already set.
+//
+// Example:
+//
+//	revenium.Initialize(
+//	    revenium.WithDotEnvPaths([]string{".env"}),
+//	)
+func WithDotEnvPaths(paths []string) Option {
+	return func(c *Config) {
+		c.DotEnvPaths = paths
+	}
+}
+
+// WithCaptureRequestParams adds the exact Fal request parameters to metering
+// attributes under "falRequest", which helps when debugging cost anomalies
+// (e.g. unexpected image sizes or step counts). The prompt is excluded unless
+// prompt capture is also enabled via WithCapturePrompts.
+func WithCaptureRequestParams(capture bool) Option {
+	return func(c *Config) {
+		c.CaptureRequestParams = capture
+	}
+}
+
+// WithPromptSanitization trims leading/trailing whitespace and strips control
+// and zero-width characters from prompts before they are sent to Fal.ai and
+// captured. Newlines and tabs inside the prompt are kept. When a prompt is
+// changed, attributes["promptSanitized"] is set to true.
+func WithPromptSanitization(enabled bool) Option {
+	return func(c *Config) {
+		c.SanitizePrompts = enabled
+	}
+}
+
+// DurationSource selects how the metered RequestDuration is measured
+type DurationSource int
+
+const (
+	// DurationSourceWallClock uses the middleware's own timer around the Fal call (default)
+	DurationSourceWallClock DurationSource = iota
+	// DurationSourceProcessingTime uses Fal's reported processing time (timeTaken)
+	DurationSourceProcessingTime
+)
+
+// WithDurationSource selects whether RequestDuration is derived from the
+// middleware's wall-clock timer or from Fal's reported processing time
+// (timeTaken), for billing models where processing seconds drive cost.
+// When processing time is selected but Fal reports none, the wall-clock
+// duration is used and a warning is logged.
+func WithDurationSource(source DurationSource) Option {
+	return func(c *Config) {
+		c.DurationSource = source
+	}
+}
+
+// WithTraceIDExtractor sets a function that derives the metering TraceID from
+// the call context when the usage metadata has no explicit traceId. Use it to
+// tie Fal.ai spend to an active OpenTelemetry span without this package
+// depending on OpenTelemetry:
+//
+//	revenium.Initialize(
+//	    revenium.WithTraceIDExtractor(func(ctx context.Context) string {
+//	        if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+//	            return sc.TraceID().String()
+//	        }
+//	        return ""
+//	    }),
+//	)
+//
+// A traceparent stored with WithTraceparent is used as a fallback.
+func WithTraceIDExtractor(extractor func(ctx context.Context) string) Option {
+	return func(c *Config) {
+		c.TraceIDExtractor = extractor
+	}
+}
+
+// WithTransactionIDPrefix prepends a prefix (e.g. "mediagen-") to the default
+// generated transaction IDs for cross-system correlation. Uniqueness is
+// unaffected since the default ID is kept in full.
+func WithTransactionIDPrefix(prefix string) Option {
+	return func(c *Config) {
+		c.TransactionIDPrefix = prefix
+	}
+}
+
+// WithTransactionIDGenerator takes full control of transaction ID generation.
+// The generator must return a unique ID on every call (e.g. a UUID) and be
+// safe for concurrent use. It takes precedence over WithTransactionIDPrefix.
+func WithTransactionIDGenerator(generator func() string) Option {
+	return func(c *Config) {
+		c.TransactionIDGenerator = generator
+	}
+}
+
+// WithSubscriberFieldNormalization maps common subscriber field aliases (e.g.
+// tier/accountTier/plan) onto a canonical schema so dashboards see consistent
+// keys. Original keys are preserved. See NormalizeSubscriber for the mapping.
+func WithSubscriberFieldNormalization(enabled bool) Option {
+	return func(c *Config) {
+		c.NormalizeSubscriberFields = enabled
+	}
+}
+
+// ResponseEnricher adds metadata derived from a Fal response. resp is the
+// *FalImageResponse or *FalVideoResponse returned by the call, and metadata is
+// a copy of the request's usage metadata that the enricher may mutate freely.
+type ResponseEnricher func(resp interface{}, metadata map[string]interface{})
+
+// WithResponseEnricher sets a hook that enriches usage metadata from the Fal
+// response before the metering payload is built. Use it for fields that are
+// only known after the call, such as a quality score computed from the output.
+//
+// Example:
+//
+//	revenium.Initialize(
+//	    revenium.WithResponseEnricher(func(resp interface{}, metadata map[string]interface{}) {
+//	        if img, ok := resp.(*revenium.FalImageResponse); ok {
+//	            metadata["responseQualityScore"] = scoreImages(img.Images)
+//	        }
+//	    }),
+//	)
+func WithResponseEnricher(enricher ResponseEnricher) Option {
+	return func(c *Config) {
+		c.ResponseEnricher = enricher
+	}
+}
+
+// WithPerImageMetering emits one metering record per generated image.
+// When a response contains N images, N payloads are sent, each with
+// ActualImageCount 1, a distinct TransactionID, and that image's dimensions
+// and URL. They share the same TraceID so they can be grouped in Revenium.
+// Default is false: a single aggregated record per request.
+func WithPerImageMetering(enabled bool) Option {
+	return func(c *Config) {
+		c.PerImageMetering = enabled
+	}
+}
+
+// WithDefaultCostType sets the costType recorded on payloads (default "AI"),
+// for customers that categorize Fal spend differently (e.g. "MEDIA"). A
+// "costType" key in the usage metadata still overrides it per request.
+func WithDefaultCostType(costType string) Option {
+	return func(c *Config) {
+		c.DefaultCostType = costType
+	}
+}
+
+// WithMaxRequestBytes caps the marshaled size of a Fal request body (default
+// 10 MiB). Requests over the limit, e.g. from a large base64 image passed in
+// by mistake, fail with a ValidationError before anything is sent to Fal.ai.
+// A negative value disables the check.
+func WithMaxRequestBytes(n int64) Option {
+	return func(c *Config) {
+		c.MaxRequestBytes = n
+	}
+}
+
+// WithCostAllocationTags sets cost-allocation tags (e.g. campaignId,
+// costCenter) recorded on every payload as attributes["tags"], like cloud
+// cost-allocation tagging. Tags in a request's "tags" metadata are merged in
+// and take precedence for matching keys.
+//
+// Example:
+//
+//	revenium.Initialize(
+//	    revenium.WithCostAllocationTags(map[string]string{"costCenter": "marketing"}),
+//	)
+//
+//	ctx = revenium.WithUsageMetadata(ctx, map[string]interface{}{
+//	    "tags": map[string]string{"campaignId": "spring-launch"},
+//	})
+func WithCostAllocationTags(tags map[string]string) Option {
+	return func(c *Config) {
+		c.CostAllocationTags = tags
+	}
+}
+
+// WithEnvironment sets the default deployment environment (e.g. "production")
+// recorded on payloads whose usage metadata has no "environment" key.
+// Per-request metadata still takes precedence.
+func WithEnvironment(environment string) Option {
+	return func(c *Config) {
+		c.DefaultEnvironment = environment
+	}
+}
+
+// WithRegion sets the default cloud region (e.g. "us-east-1") recorded on
+// payloads whose usage metadata has no "region" key. Per-request metadata
+// still takes precedence. This is unrelated to WithReveniumRegion, which
+// selects the Revenium API endpoint.
+func WithRegion(region string) Option {
+	return func(c *Config) {
+		c.DefaultRegion = region
+	}
+}
+
+// WithModelTierClassifier records the pricing tier of each payload's model in
+// attributes["modelTier"], so cost dashboards can group by model class. The
+// classifier receives the Fal endpoint ID (e.g. "fal-ai/flux/dev"); an empty
+// result is recorded as "unknown". Pass nil to use DefaultModelTier.
+//
+// Example:
+//
+//	revenium.Initialize(revenium.WithModelTierClassifier(func(model string) string {
+//	    if strings.HasPrefix(model, "fal-ai/recraft") {
+//	        return "pro"
+//	    }
+//	    return revenium.DefaultModelTier(model)
+//	}))
+func WithModelTierClassifier(classifier func(model string) string) Option {
+	return func(c *Config) {
+		if classifier == nil {
+			classifier = DefaultModelTier
+		}
+		c.ModelTierClassifier = classifier
+	}
+}
+
+// WithOutputUploader uploads every generated image to your own storage (S3,
+// GCS, ...) after generation. Each image is downloaded and passed to uploader,
+// which returns the URL it is now served from; up to 4 images are handled at
+// once. The response's image URLs are replaced with the returned URLs, and
+// both URLs are recorded in attributes["outputUploads"] as
+// {"index", "falUrl", "url"} entries.
+//
+// Upload failures never fail the generation: they are logged, and the image
+// keeps its Fal URL. Uploads run before the call returns, so they add to its
+// latency but not to the metered duration.
+//
+// Example:
+//
+//	revenium.Initialize(revenium.WithOutputUploader(func(ctx context.Context, img revenium.DownloadedImage) (string, error) {
+//	    key := fmt.Sprintf("renders/%s-%d.png", jobID, img.Index)
+//	    if err := bucket.Put(ctx, key, img.Data, img.ContentType); err != nil {
+//	        return "", err
+//	    }
+//	    return "https://cdn.example.com/" + key, nil
+//	}))
+func WithOutputUploader(uploader OutputUploader) Option {
+	return func(c *Config) {
+		c.OutputUploader = uploader
+	}
+}
+
+// WithOutputDownloadTimeout bounds each download of a generated output made
+// for WithOutputUploader or OutputHashSHA256OfBytes. Default is 30 seconds;
+// raise it for large videos.
+func WithOutputDownloadTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.OutputDownloadTimeout = timeout
+	}
+}
+
+// WithMetricsRecorder reports operational metrics to recorder: one
+// RecordGeneration call per image or video generation, with its duration and
+// outcome, and AddQueueDepth as metering records are queued and delivered.
+//
+// Example:
+//
+//	revenium.Initialize(revenium.WithMetricsRecorder(myRecorder))
+func WithMetricsRecorder(recorder MetricsRecorder) Option {
+	return func(c *Config) {
+		c.MetricsRecorder = recorder
+	}
+}
+
+// WithModelDefaults sets default request parameters per model, keyed by Fal
+// endpoint ID. Before a request is sent, each zero-valued field (including a
+// nil Seed and empty LoRAs) is filled from its model's defaults.
+// AdditionalParams is not sent to Fal and is not merged. Fields set on the
+// request always win, and the caller's request is never modified.
+//
+// Example:
+//
+//	revenium.Initialize(revenium.WithModelDefaults(map[string]revenium.FalRequest{
+//	    "fal-ai/flux/schnell": {NumInferenceSteps: 4},
+//	    "fal-ai/flux/dev":     {NumInferenceSteps: 28, GuidanceScale: 3.5},
+//	}))
+//
+// A boolean default such as EnableSafetyChecker cannot be turned off per
+// request, since false is indistinguishable from unset.
+func WithModelDefaults(defaults map[string]FalRequest) Option {
+	return func(c *Config) {
+		c.ModelDefaults = make(map[string]FalRequest, len(defaults))
+		for model, request := range defaults {
+			c.ModelDefaults[model] = request
+		}
+	}
+}
 
-	// Prompt capture configuration (opt-in for analytics)
-	// When enabled, the following fields are added to metering payloads:
-	//   - inputMessages: JSON array with [{"role": "user", "content": "<prompt>"}] format
-	//   - outputResponse: Generated content URL(s)
-	//   - promptsTruncated: true if prompt exceeded 50,000 characters
-	// Environment variable: REVENIUM_CAPTURE_PROMPTS=true
-	CapturePrompts bool // When true, captures generation prompts for analytics (default: false)
+// WithBuildInfo adds the application's version and git commit to every
+// metering payload as attributes["buildVersion"] and attributes["gitCommit"],
+// so cost changes can be correlated with deploys. Empty arguments are filled
+// from the build information embedded by the Go toolchain (the main module
+// version and vcs.revision), when available.
+//
+// Example:
+//
+//	// Set at build time with -ldflags "-X main.version=... -X main.commit=..."
+//	revenium.Initialize(revenium.WithBuildInfo(version, commit))
+//
+//	// Or rely on the toolchain's embedded build info
+//	revenium.Initialize(revenium.WithBuildInfo("", ""))
+func WithBuildInfo(version, commit string) Option {
+	return func(c *Config) {
+		if version == "" || commit == "" {
+			buildVersion, buildCommit := applicationBuildInfo()
+			if version == "" {
+				version = buildVersion
+			}
+			if commit == "" {
+				commit = buildCommit
+			}
+		}
+		c.BuildVersion = version
+		c.GitCommit = commit
+	}
+}
 
-	// Internal: tracks whether CapturePrompts was explicitly set via WithCapturePrompts.
-	// When true, environment variable will NOT override the programmatic setting.
-	capturePromptsSet bool
+// WithQualityScoreClamp controls whether responseQualityScore metadata is
+// clamped into [0.0, 1.0] before metering (default: true). Revenium rejects
+// out-of-range scores, so heuristic values such as 1.02 are coerced to 1.0
+// with a debug log instead of being sent as-is.
+func WithQualityScoreClamp(enabled bool) Option {
+	return func(c *Config) {
+		c.DisableQualityScoreClamp = !enabled
+	}
+}
 
-	// Logging configuration
-	LogLevel       string
-	VerboseStartup bool
+// WithMeterErrors sends a metering record when a Fal call fails, so timed-out
+// (but possibly still charged) operations are visible in Revenium. Calls that
+// hit their context deadline are metered with StopReason "TIMEOUT", other
+// failures with "ERROR". The record carries the elapsed duration and the
+// requested image count or video duration, but no produced output.
+//
+// Each record also has attributes["errorCategory"] (provider_4xx,
+// provider_5xx, network, timeout, validation, or unknown) and
+// attributes["errorMessage"], the error text with credentials and URL query
+// strings removed, so error rates can be broken down by category.
+func WithMeterErrors(enabled bool) Option {
+	return func(c *Config) {
+		c.MeterErrors = enabled
+	}
 }
 
-// Option is a functional option for configuring Config
-type Option func(*Config)
+// WithMeteringEventLog registers a callback that receives a MeteringEvent for
+// every delivery attempt, carrying the payload, endpoint, attempt number,
+// response status code, and whether it was delivered. Batched payloads each
+// get their own event. The callback runs on the metering goroutine, so it
+// should be fast and safe for concurrent use. It only applies to the default
+// MeteringClient, not to a Meterer injected with WithMeterer.
+func WithMeteringEventLog(fn func(MeteringEvent)) Option {
+	return func(c *Config) {
+		c.MeteringEventLog = fn
+	}
+}
 
-// WithFalAPIKey sets the Fal.ai API key
-func WithFalAPIKey(key string) Option {
+// WithCaptureModerationData records the NSFW concept labels some models
+// return (nsfw_concepts) in attributes["nsfwConcepts"], one list per image, for
+// content-moderation analytics. Default is false: like prompts, the labels
+// describe generated content, so only enable it where your safety and
+// compliance policies allow storing that data with usage records.
+func WithCaptureModerationData(enabled bool) Option {
 	return func(c *Config) {
-		c.FalAPIKey = key
+		c.CaptureModerationData = enabled
 	}
 }
 
-// WithRequestTimeout sets the HTTP request timeout for Fal.ai API calls
-func WithRequestTimeout(timeout time.Duration) Option {
+// OutputHashMode selects how generated outputs are hashed for deduplication analytics
+type OutputHashMode int
+
+const (
+	// OutputHashNone records no output hashes (default)
+	OutputHashNone OutputHashMode = iota
+	// OutputHashSHA256OfURL hashes each output's URL string; no network calls are made
+	OutputHashSHA256OfURL
+	// OutputHashSHA256OfBytes downloads each output and hashes its content
+	OutputHashSHA256OfBytes
+)
+
+// WithOutputHashing records a hex SHA-256 of each generated image or video in
+// attributes["outputHashes"], in output order, so duplicate generations can be
+// detected across the fleet. OutputHashSHA256OfURL is the recommended mode: it
+// hashes the URL string and costs nothing. OutputHashSHA256OfBytes catches
+// identical content served from different URLs, but downloads every output
+// before the generation call returns; outputs that fail to download get an
+// empty hash and a warning.
+func WithOutputHashing(mode OutputHashMode) Option {
 	return func(c *Config) {
-		c.RequestTimeout = timeout
+		c.OutputHashing = mode
 	}
 }
 
-// WithReveniumAPIKey sets the Revenium API key
-func WithReveniumAPIKey(key string) Option {
+// WithContentTypeNormalization controls whether the output MIME type recorded
+// in attributes["contentType"] is normalized (default: true), so dashboards
+// can group by format reliably. Normalization lowercases the type, drops
+// parameters, resolves aliases such as "image/jpg" to "image/jpeg", and infers
+// the type from the URL's extension when Fal reports none. Unknown types pass
+// through. When disabled, the reported type is recorded as-is.
+func WithContentTypeNormalization(enabled bool) Option {
 	return func(c *Config) {
-		c.ReveniumAPIKey = key
+		c.DisableContentTypeNormalization = !enabled
 	}
 }
 
-// WithReveniumBaseURL sets the Revenium base URL
-func WithReveniumBaseURL(url string) Option {
+// WithModelFallback sets the models GenerateImage falls back to, in order,
+// when primary fails with a retryable error (rate limiting, 5xx, or a network
+// failure), so an overloaded model doesn't fail the request. Built-in retries
+// (WithFalRetry) run on each model before moving on. The record for the model
+// that succeeds is metered under that model with attributes["fallbackFrom"]
+// set to primary. Use the option once per primary model.
+//
+// Example:
+//
+//	revenium.Initialize(revenium.WithModelFallback("fal-ai/flux-pro",
+//	    []string{"fal-ai/flux/dev", "fal-ai/flux/schnell"}))
+func WithModelFallback(primary string, fallbacks []string) Option {
 	return func(c *Config) {
-		c.ReveniumBaseURL = url
+		if c.ModelFallbacks == nil {
+			c.ModelFallbacks = make(map[string][]string)
+		}
+		c.ModelFallbacks[primary] = append([]string(nil), fallbacks...)
 	}
 }
 
-// WithReveniumOrgID sets the Revenium organization ID
-func WithReveniumOrgID(id string) Option {
+// WithRequestCoalescing collapses concurrent identical generations (same
+// operation, model, and request parameters) into a single Fal call whose
+// result is shared, protecting Fal.ai and your spend from thundering herds
+// such as cache-miss stampedes. Only calls in flight at the same time are
+// coalesced; nothing is cached once a call completes. Each caller receives its
+// own copy of the response. If the call fails, every sharer gets the error,
+// except that when the caller whose call reached Fal.ai is cancelled, sharers
+// whose own context is still live make their own call instead.
+// Streaming image calls and video calls reporting progress are never coalesced.
+//
+// Metering: by default every logical request is still metered
+// (CoalescedMeterEach), so per-customer attribution is unchanged. When a call
+// was shared, each record has attributes["coalescedRequests"] set to the
+// number of sharers, and records for requests that did not reach Fal.ai have
+// attributes["coalesced"] = true. Use WithCoalescedMetering(CoalescedMeterOnce)
+// to meter only the call that reached Fal.ai.
+func WithRequestCoalescing(enabled bool) Option {
 	return func(c *Config) {
-		c.ReveniumOrgID = id
+		c.RequestCoalescing = enabled
 	}
 }
 
-// WithReveniumProductID sets the Revenium product ID
-func WithReveniumProductID(id string) Option {
+// WithCoalescedMetering selects how requests coalesced by
+// WithRequestCoalescing are metered: CoalescedMeterEach (default) meters every
+// logical request, CoalescedMeterOnce only the one Fal call actually made.
+func WithCoalescedMetering(mode CoalescedMeteringMode) Option {
 	return func(c *Config) {
-		c.ReveniumProductID = id
+		c.CoalescedMetering = mode
 	}
 }
 
-// WithCapturePrompts enables/disables prompt capture for analytics.
-// When enabled, generation prompts are captured and sent with metering data.
-// Default is false (opt-in for privacy).
+// WithCaptureOutputExpiry records when presigned output URLs expire in
+// attributes["outputExpiresAt"] (RFC 3339, UTC), so downstream systems know to
+// re-fetch outputs before their links stop working. The expiry is parsed from
+// the URL's query parameters for AWS S3 (SigV4 X-Amz-Date/X-Amz-Expires and
+// legacy Expires), Google Cloud Storage (X-Goog-Date/X-Goog-Expires), and
+// Azure SAS (se) URLs. With several outputs the earliest expiry is recorded;
+// URLs without a parseable expiry are skipped.
+func WithCaptureOutputExpiry(enabled bool) Option {
+	return func(c *Config) {
+		c.CaptureOutputExpiry = enabled
+	}
+}
+
+// WithSendTransactionHeader sends each generation's metering TransactionID
+// to Fal as the X-Revenium-Transaction-Id request header, so Fal support can
+// correlate a job with its Revenium record. The ID is chosen before the Fal
+// call and used for the successful call's payload. With per-image metering the
+// per-image records get their own IDs and carry this one as their
+// parentTransactionId (and, unless a traceId is already set, as their
+// traceId). Default is false.
+func WithSendTransactionHeader(enabled bool) Option {
+	return func(c *Config) {
+		c.SendTransactionHeader = enabled
+	}
+}
+
+// WithCaptureFalHeaders copies the named Fal response headers (e.g.
+// "X-Fal-Request-Id" or rate-limit headers) into attributes["falHeaders"] on
+// each generation's payload, keyed by canonical header name. Use "*" to
+// capture every header. Nothing is redacted by default; see
+// WithFalHeaderDenylist.
 //
-// Note: When this option is used, it takes precedence over the
-// REVENIUM_CAPTURE_PROMPTS environment variable. This ensures predictable
-// behavior when the caller explicitly configures this setting.
+// Example:
 //
-// Fields added to metering payload when enabled:
-//   - inputMessages: JSON array with [{"role": "user", "content": "<prompt>"}] format
-//   - outputResponse: Generated content URL(s) (images/videos)
-//   - promptsTruncated: true if prompt exceeded 50,000 characters
+//	revenium.Initialize(
+//	    revenium.WithCaptureFalHeaders([]string{"X-Fal-Request-Id", "X-RateLimit-Remaining"}),
+//	)
+func WithCaptureFalHeaders(headers []string) Option {
+	return func(c *Config) {
+		c.CaptureFalHeaders = headers
+	}
+}
+
+// WithFalHeaderDenylist excludes the named headers from the ones captured by
+// WithCaptureFalHeaders, which is mainly useful together with "*".
+func WithFalHeaderDenylist(headers ...string) Option {
+	return func(c *Config) {
+		c.FalHeaderDenylist = headers
+	}
+}
+
+// DefaultGPUInfoHeader is the Fal response header read for the GPU type when
+// no other header is configured with WithGPUInfoHeader
+const DefaultGPUInfoHeader = "X-Fal-Gpu-Type"
+
+// WithCaptureGPUInfo records the GPU a job ran on (e.g. "H100", "A100") in
+// attributes["gpuType"], since it correlates with cost. The value is taken
+// from the response body's gpu_type field when present, otherwise from the
+// GPU info header (X-Fal-Gpu-Type unless set with WithGPUInfoHeader).
+// Responses carrying neither are metered without the attribute.
+//
+// Example:
+//
+//	revenium.Initialize(revenium.WithCaptureGPUInfo(true))
+func WithCaptureGPUInfo(enabled bool) Option {
+	return func(c *Config) {
+		c.CaptureGPUInfo = enabled
+	}
+}
+
+// WithGPUInfoHeader sets the Fal response header WithCaptureGPUInfo reads the
+// GPU type from.
+func WithGPUInfoHeader(name string) Option {
+	return func(c *Config) {
+		c.GPUInfoHeader = name
+	}
+}
+
+// gpuInfoHeader returns the header the GPU type is read from
+func (c *Config) gpuInfoHeader() string {
+	if c.GPUInfoHeader == "" {
+		return DefaultGPUInfoHeader
+	}
+	return c.GPUInfoHeader
+}
+
+// WithSubscriberQuota enforces a client-side quota before calling Fal.ai. The
+// function is consulted with the subscriber ID from the usage metadata
+// (metadata["subscriber"]["id"]) and returns the generations the subscriber
+// has left, or ok=false when no quota applies. Image calls need one unit per
+// requested image (NumImages, at least 1) and video calls one unit; a call
+// that does not fit returns a *QuotaExceededError without reaching Fal.ai or
+// being metered. Calls without a subscriber ID are not checked.
+//
+// The function is not told about completed generations, so the caller keeps
+// its counts up to date (e.g. from its own usage store).
 //
 // Example:
 //
 //	revenium.Initialize(
-//	    revenium.WithCapturePrompts(true),
+//	    revenium.WithSubscriberQuota(func(subscriberID string) (int, bool) {
+//	        return quotas.Remaining(subscriberID)
+//	    }),
 //	)
+func WithSubscriberQuota(quota func(subscriberID string) (remaining int, ok bool)) Option {
+	return func(c *Config) {
+		c.SubscriberQuota = quota
+	}
+}
+
+// WithAllowedHosts restricts the hosts that the Fal.ai and Revenium base URLs
+// may point at, replacing the default allowlist (fal.run, queue.fal.run,
+// api.revenium.ai, api.eu.revenium.ai, and localhost). Initialize and
+// NewReveniumFal return a ConfigError when a base URL, including one set
+// through an environment variable, names any other host, so a tampered
+// environment can't redirect API keys to an attacker-controlled server. Entries match hostnames exactly
+// and case-insensitively; a "*.example.com" entry matches any subdomain.
 //
-// Environment variable alternative: REVENIUM_CAPTURE_PROMPTS=true
-func WithCapturePrompts(capture bool) Option {
+// Example:
+//
+//	revenium.Initialize(revenium.WithAllowedHosts([]string{
+//	    "fal.run", "queue.fal.run", "metering.internal.example.com",
+//	}))
+func WithAllowedHosts(hosts []string) Option {
 	return func(c *Config) {
-		c.CapturePrompts = capture
-		c.capturePromptsSet = true // Mark as explicitly set - env var won't override
+		c.AllowedHosts = hosts
+	}
+}
+
+// WithVerifyConnectivity makes Initialize open a TCP (and, for https, TLS)
+// connection to the Fal.ai and Revenium base URLs, returning a ConfigError
+// naming the unreachable URL instead of discovering a typo'd or internal-only
+// host later through failed requests. No API call or authentication check is
+// made. Off by default to keep startup fast.
+func WithVerifyConnectivity(enabled bool) Option {
+	return func(c *Config) {
+		c.VerifyConnectivity = enabled
+	}
+}
+
+// WithStrictInit makes Initialize return an error, rather than log a warning,
+// when called again after initialization with options that differ from the
+// active configuration.
+func WithStrictInit() Option {
+	return func(c *Config) {
+		c.StrictInit = true
+	}
+}
+
+// conflictingConfigFields lists the exported fields explicitly set in requested
+// that differ from active. Only field names are reported, never values, so API
+// keys are not leaked into logs. Function-valued fields cannot be compared and
+// are reported whenever they are set.
+func conflictingConfigFields(active, requested *Config) []string {
+	var conflicts []string
+
+	activeVal := reflect.ValueOf(active).Elem()
+	requestedVal := reflect.ValueOf(requested).Elem()
+	for i := 0; i < requestedVal.NumField(); i++ {
+		field := requestedVal.Type().Field(i)
+		if !field.IsExported() || field.Name == "StrictInit" {
+			continue
+		}
+
+		value := requestedVal.Field(i)
+		if value.IsZero() {
+			// Not set by the new options, except an explicit WithCapturePrompts(false)
+			// or WithFalQueueMode(false)
+			if field.Name == "CapturePrompts" && requested.capturePromptsSet && active.CapturePrompts {
+				conflicts = append(conflicts, field.Name)
+			}
+			if field.Name == "FalQueueMode" && requested.falQueueModeSet && active.FalQueueMode {
+				conflicts = append(conflicts, field.Name)
+			}
+			continue
+		}
+		if value.Kind() == reflect.Func || !reflect.DeepEqual(value.Interface(), activeVal.Field(i).Interface()) {
+			conflicts = append(conflicts, field.Name)
+		}
 	}
+
+	return conflicts
 }
 
 // loadFromEnv loads configuration from environment variables and .env files
@@ -125,6 +1332,12 @@ func (c *Config) loadFromEnv() error {
 	if c.FalBaseURL == "" {
 		c.FalBaseURL = getEnvOrDefault("FAL_BASE_URL", "https://fal.run")
 	}
+	if c.FalQueueBaseURL == "" {
+		c.FalQueueBaseURL = getEnvOrDefault("FAL_QUEUE_BASE_URL", defaultFalQueueBaseURL)
+	}
+	if !c.falQueueModeSet {
+		c.FalQueueMode = os.Getenv("FAL_QUEUE_MODE") == "true" || os.Getenv("FAL_QUEUE_MODE") == "1"
+	}
 	if c.RequestTimeout == 0 {
 		c.RequestTimeout = parseDurationFromEnv("FAL_REQUEST_TIMEOUT", 1800*time.Second) // 30 min for video generation
 	}
@@ -132,6 +1345,11 @@ func (c *Config) loadFromEnv() error {
 	if c.ReveniumAPIKey == "" {
 		c.ReveniumAPIKey = os.Getenv("REVENIUM_METERING_API_KEY")
 	}
+	if c.ReveniumBaseURL == "" && c.ReveniumRegion != "" {
+		if baseURL, ok := regionBaseURL(c.ReveniumRegion); ok {
+			c.ReveniumBaseURL = baseURL
+		}
+	}
 	if c.ReveniumBaseURL == "" {
 		baseURL := getEnvOrDefault("REVENIUM_METERING_BASE_URL", "https://api.revenium.ai")
 		c.ReveniumBaseURL = NormalizeReveniumBaseURL(baseURL)
@@ -171,6 +1389,20 @@ func (c *Config) loadFromEnv() error {
 
 // loadEnvFiles loads environment variables from .env files
 func (c *Config) loadEnvFiles() {
+	for _, envPath := range c.envFilePaths() {
+		if _, err := os.Stat(envPath); err == nil {
+			godotenv.Load(envPath)
+		}
+	}
+}
+
+// envFilePaths returns the candidate .env files in load order.
+// Explicit DotEnvPaths take precedence over the default directory search.
+func (c *Config) envFilePaths() []string {
+	if len(c.DotEnvPaths) > 0 {
+		return c.DotEnvPaths
+	}
+
 	envFiles := []string{
 		".env.local", // Local overrides (highest priority)
 		".env",       // Main env file
@@ -189,14 +1421,59 @@ func (c *Config) loadEnvFiles() {
 		filepath.Join(cwd, ".."),
 	}
 
+	var paths []string
 	for _, dir := range searchDirs {
 		for _, envFile := range envFiles {
-			envPath := filepath.Join(dir, envFile)
-			if _, err := os.Stat(envPath); err == nil {
-				godotenv.Load(envPath)
-			}
+			paths = append(paths, filepath.Join(dir, envFile))
 		}
 	}
+	return paths
+}
+
+// Fal.ai queue defaults, used when the corresponding Config field is not set
+const (
+	defaultFalQueueBaseURL      = "https://queue.fal.run"
+	defaultFalQueuePollInterval = 1 * time.Second
+)
+
+// defaultFalRetryBackoff is the wait before the first Fal retry when FalRetryBackoff is unset
+const defaultFalRetryBackoff = 500 * time.Millisecond
+
+// defaultGenerationConcurrency bounds batch generation when GenerationConcurrency is unset
+const defaultGenerationConcurrency = 4
+
+// defaultMaxRequestBytes caps Fal request bodies when MaxRequestBytes is unset
+const defaultMaxRequestBytes = 10 << 20
+
+// maxRequestBytes returns the Fal request size limit, or 0 when disabled
+func (c *Config) maxRequestBytes() int64 {
+	switch {
+	case c.MaxRequestBytes < 0:
+		return 0
+	case c.MaxRequestBytes == 0:
+		return defaultMaxRequestBytes
+	}
+	return c.MaxRequestBytes
+}
+
+// generationConcurrency returns the configured batch concurrency or the default
+func (c *Config) generationConcurrency() int {
+	if c.GenerationConcurrency <= 0 {
+		return defaultGenerationConcurrency
+	}
+	return c.GenerationConcurrency
+}
+
+// defaultOutputDownloadTimeout bounds output downloads when
+// OutputDownloadTimeout is unset
+const defaultOutputDownloadTimeout = 30 * time.Second
+
+// outputDownloadTimeout returns the configured output download timeout
+func (c *Config) outputDownloadTimeout() time.Duration {
+	if c.OutputDownloadTimeout <= 0 {
+		return defaultOutputDownloadTimeout
+	}
+	return c.OutputDownloadTimeout
 }
 
 // Validate validates the configuration
@@ -205,17 +1482,359 @@ func (c *Config) Validate() error {
 		return NewConfigError("FAL_API_KEY is required", nil)
 	}
 
-	if c.ReveniumAPIKey == "" {
+	if c.ReveniumAPIKey == "" && !c.OptionalMetering {
 		return NewConfigError("REVENIUM_METERING_API_KEY is required", nil)
 	}
 
-	if !isValidReveniumAPIKey(c.ReveniumAPIKey) {
+	if !isValidReveniumAPIKey(c.ReveniumAPIKey) && !c.OptionalMetering {
 		return NewConfigError("invalid Revenium API key format (must start with 'hak_')", nil)
 	}
 
+	if c.meteringSampleRateSet && (c.MeteringSampleRate < 0 || c.MeteringSampleRate > 1) {
+		return NewConfigError(fmt.Sprintf("metering sample rate must be between 0.0 and 1.0, got %v", c.MeteringSampleRate), nil)
+	}
+
+	if c.ReveniumRegion != "" {
+		if _, ok := regionBaseURL(c.ReveniumRegion); !ok {
+			return NewConfigError(fmt.Sprintf("unknown Revenium region %q (supported: %s)",
+				c.ReveniumRegion, strings.Join(supportedReveniumRegions(), ", ")), nil)
+		}
+	}
+
+	return nil
+}
+
+// connectivityTimeout bounds each connection made by verifyConnectivity
+const connectivityTimeout = 5 * time.Second
+
+// verifyConnectivity connects to each configured base URL, returning a
+// ConfigError for the first one that cannot be reached
+func (c *Config) verifyConnectivity() error {
+	falName, falURL := "Fal.ai", c.FalBaseURL
+	if c.FalQueueMode {
+		falName, falURL = "Fal.ai queue", c.FalQueueBaseURL
+	}
+	targets := []struct{ name, baseURL string }{
+		{falName, falURL},
+	}
+	if !c.meteringDisabled() {
+		targets = append(targets, struct{ name, baseURL string }{"Revenium", c.ReveniumBaseURL})
+	}
+
+	for _, target := range targets {
+		if err := dialBaseURL(target.baseURL); err != nil {
+			return NewConfigError(fmt.Sprintf("%s base URL %s is unreachable", target.name, target.baseURL), err)
+		}
+		Debug("Connectivity check passed for %s base URL %s", target.name, target.baseURL)
+	}
+	return nil
+}
+
+// dialBaseURL opens and closes a TCP connection to baseURL's host, completing
+// a TLS handshake for https URLs
+func dialBaseURL(baseURL string) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: connectivityTimeout}
+	var conn net.Conn
+	if u.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// defaultAllowedHosts are the hosts base URLs may point at unless WithAllowedHosts is set
+var defaultAllowedHosts = []string{
+	"fal.run",
+	"queue.fal.run",
+	"api.revenium.ai",
+	"api.eu.revenium.ai",
+	"localhost",
+	"127.0.0.1",
+	"::1",
+}
+
+// checkAllowedHosts returns a ConfigError if any base URL's host is not in
+// the allowlist, so an overridden base URL can't send API keys elsewhere
+func (c *Config) checkAllowedHosts() error {
+	allowed := c.AllowedHosts
+	if allowed == nil {
+		allowed = defaultAllowedHosts
+	}
+
+	targets := []struct{ name, baseURL string }{
+		{"Fal.ai", c.FalBaseURL},
+		{"Fal.ai queue", c.FalQueueBaseURL},
+		{"Revenium", c.ReveniumBaseURL},
+	}
+	for _, target := range targets {
+		if target.baseURL == "" {
+			continue
+		}
+		u, err := url.Parse(target.baseURL)
+		if err != nil {
+			return NewConfigError(fmt.Sprintf("invalid %s base URL %s", target.name, target.baseURL), err)
+		}
+		if !hostAllowed(u.Hostname(), allowed) {
+			return NewConfigError(fmt.Sprintf("%s base URL host %q is not in the allowed hosts (see WithAllowedHosts)", target.name, u.Hostname()), nil)
+		}
+	}
 	return nil
 }
 
+// hostAllowed reports whether host matches an allowlist entry, either exactly
+// or, for "*.example.com" entries, as a subdomain
+func hostAllowed(host string, allowed []string) bool {
+	host = strings.ToLower(host)
+	for _, entry := range allowed {
+		entry = strings.ToLower(entry)
+		if suffix, ok := strings.CutPrefix(entry, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if host == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCustomTransactionIDs reports whether transaction ID generation is customized
+func (c *Config) hasCustomTransactionIDs() bool {
+	return c.TransactionIDGenerator != nil || c.TransactionIDPrefix != ""
+}
+
+// newTransactionID generates a transaction ID honoring the configured
+// generator or prefix
+func (c *Config) newTransactionID() string {
+	if c.TransactionIDGenerator != nil {
+		return c.TransactionIDGenerator()
+	}
+	return c.TransactionIDPrefix + generateTransactionID()
+}
+
+// capturePromptText reports whether prompt text is captured in metering,
+// which prompt hashing overrides
+func (c *Config) capturePromptText() bool {
+	return c.CapturePrompts && !c.PromptHashing
+}
+
+// captureOutputs reports whether output URLs are captured in outputResponse
+func (c *Config) captureOutputs() bool {
+	if !c.captureOutputsSet {
+		return c.CapturePrompts
+	}
+	return c.CaptureOutputs
+}
+
+// meteringDisabled reports whether metering is off because OptionalMetering
+// is set and there is no valid Revenium API key
+func (c *Config) meteringDisabled() bool {
+	return c.OptionalMetering && !isValidReveniumAPIKey(c.ReveniumAPIKey)
+}
+
+// sampleRate returns the effective metering sample rate (1.0 unless configured)
+func (c *Config) sampleRate() float64 {
+	if !c.meteringSampleRateSet {
+		return 1.0
+	}
+	return c.MeteringSampleRate
+}
+
+// logStartupSummary logs the effective configuration at Info when
+// VerboseStartup is set. API keys are reported only as present or missing.
+func (c *Config) logStartupSummary() {
+	if !c.VerboseStartup {
+		return
+	}
+
+	meteringTimeout := c.MeteringTimeout
+	if meteringTimeout <= 0 {
+		meteringTimeout = defaultMeteringTimeout
+	}
+
+	Info("Startup configuration:")
+	Info("  Fal.ai base URL: %s (queue mode: %t, queue base URL: %s)", redactURL(c.FalBaseURL), c.FalQueueMode, redactURL(c.FalQueueBaseURL))
+	Info("  Revenium base URL: %s", redactURL(c.ReveniumBaseURL))
+	Info("  Fal.ai API key: %s, Revenium API key: %s", presence(c.FalAPIKey), presence(c.ReveniumAPIKey))
+	Info("  Timeouts: request %v, metering %v", c.RequestTimeout, meteringTimeout)
+	Info("  Capture prompts: %t, capture outputs: %t", c.CapturePrompts, c.captureOutputs())
+	Info("  Generation concurrency: %d, metering batch size: %d, metering sample rate: %v",
+		c.generationConcurrency(), c.MeteringBatchSize, c.sampleRate())
+	Info("  Log level: %s", GetLogLevel())
+}
+
+// ConfigSnapshot is a read-only view of a client's resolved configuration for
+// support and debugging, returned by EffectiveConfig. Defaults are filled in,
+// API keys are masked to their last 4 characters (or [REDACTED] when too
+// short), and URLs have embedded credentials removed, so a snapshot is safe
+// to log or attach to a support ticket.
+type ConfigSnapshot struct {
+	// Fal.ai
+	FalAPIKey             string // Masked, e.g. "...a1b2"
+	FalCredentialAlias    string
+	FalBaseURL            string
+	FalQueueMode          bool
+	FalQueueBaseURL       string
+	FalQueuePollInterval  time.Duration
+	RequestTimeout        time.Duration
+	FalMaxRetries         int
+	FalRetryBackoff       time.Duration
+	MaxRequestBytes       int64 // 0 when the limit is disabled
+	GenerationConcurrency int
+
+	// Revenium metering
+	ReveniumAPIKey          string // Masked, e.g. "...a1b2"
+	ReveniumBaseURL         string
+	ReveniumRegion          string
+	ReveniumOrgID           string
+	ReveniumProductID       string
+	MeteringDisabled        bool // Set when OptionalMetering found no valid key
+	MeteringTimeout         time.Duration
+	MeteringSampleRate      float64
+	MeteringBatchSize       int
+	MeteringBatchInterval   time.Duration
+	SyncMeteringWarmup      int
+	SyncMeteringBudget      time.Duration
+	OrderedMeteringPerTrace bool
+
+	// Feature flags
+	CapturePrompts        bool // False under PromptHashing, which records hashes instead
+	PromptHashing         bool
+	CaptureOutputs        bool
+	CaptureRequestParams  bool
+	SanitizePrompts       bool
+	PerImageMetering      bool
+	MeterErrors           bool
+	RequestCoalescing     bool
+	CaptureOutputExpiry   bool
+	CaptureGPUInfo        bool
+	CaptureModerationData bool
+	SendTransactionHeader bool
+	CaptureFalHeaders     []string
+	DefaultEnvironment    string
+	DefaultRegion         string
+	LogLevel              string
+	AllowedHosts          []string
+}
+
+// snapshot builds the ConfigSnapshot for c
+func (c *Config) snapshot() ConfigSnapshot {
+	pollInterval := c.FalQueuePollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultFalQueuePollInterval
+	}
+	retryBackoff := c.FalRetryBackoff
+	if retryBackoff <= 0 {
+		retryBackoff = defaultFalRetryBackoff
+	}
+	meteringTimeout := c.MeteringTimeout
+	if meteringTimeout <= 0 {
+		meteringTimeout = defaultMeteringTimeout
+	}
+
+	return ConfigSnapshot{
+		FalAPIKey:             redactCredential(c.FalAPIKey, KeyRedactionPartial),
+		FalCredentialAlias:    c.FalCredentialAlias,
+		FalBaseURL:            redactURL(c.FalBaseURL),
+		FalQueueMode:          c.FalQueueMode,
+		FalQueueBaseURL:       redactURL(c.FalQueueBaseURL),
+		FalQueuePollInterval:  pollInterval,
+		RequestTimeout:        c.RequestTimeout,
+		FalMaxRetries:         c.FalMaxRetries,
+		FalRetryBackoff:       retryBackoff,
+		MaxRequestBytes:       c.maxRequestBytes(),
+		GenerationConcurrency: c.generationConcurrency(),
+
+		ReveniumAPIKey:          redactCredential(c.ReveniumAPIKey, KeyRedactionPartial),
+		ReveniumBaseURL:         redactURL(c.ReveniumBaseURL),
+		ReveniumRegion:          c.ReveniumRegion,
+		ReveniumOrgID:           c.ReveniumOrgID,
+		ReveniumProductID:       c.ReveniumProductID,
+		MeteringDisabled:        c.meteringDisabled(),
+		MeteringTimeout:         meteringTimeout,
+		MeteringSampleRate:      c.sampleRate(),
+		MeteringBatchSize:       c.MeteringBatchSize,
+		MeteringBatchInterval:   c.MeteringBatchInterval,
+		SyncMeteringWarmup:      c.SyncMeteringWarmup,
+		SyncMeteringBudget:      c.SyncMeteringBudget,
+		OrderedMeteringPerTrace: c.OrderedMeteringPerTrace,
+
+		CapturePrompts:        c.capturePromptText(),
+		PromptHashing:         c.PromptHashing,
+		CaptureOutputs:        c.captureOutputs(),
+		CaptureRequestParams:  c.CaptureRequestParams,
+		SanitizePrompts:       c.SanitizePrompts,
+		PerImageMetering:      c.PerImageMetering,
+		MeterErrors:           c.MeterErrors,
+		RequestCoalescing:     c.RequestCoalescing,
+		CaptureOutputExpiry:   c.CaptureOutputExpiry,
+		CaptureGPUInfo:        c.CaptureGPUInfo,
+		CaptureModerationData: c.CaptureModerationData,
+		SendTransactionHeader: c.SendTransactionHeader,
+		CaptureFalHeaders:     append([]string(nil), c.CaptureFalHeaders...),
+		DefaultEnvironment:    c.DefaultEnvironment,
+		DefaultRegion:         c.DefaultRegion,
+		LogLevel:              GetLogLevel().String(),
+		AllowedHosts:          append([]string(nil), c.AllowedHosts...),
+	}
+}
+
+// redactURL hides any credentials embedded in a URL
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[invalid URL]"
+	}
+	return u.Redacted()
+}
+
+// presence describes a secret as "yes" when set and "no" otherwise
+func presence(secret string) string {
+	if secret == "" {
+		return "no"
+	}
+	return "yes"
+}
+
+// regionBaseURL returns the base URL for a Revenium region (case-insensitive)
+func regionBaseURL(region string) (string, bool) {
+	baseURL, ok := reveniumRegionBaseURLs[strings.ToLower(strings.TrimSpace(region))]
+	return baseURL, ok
+}
+
+// supportedReveniumRegions returns the known region names in sorted order
+func supportedReveniumRegions() []string {
+	regions := make([]string, 0, len(reveniumRegionBaseURLs))
+	for region := range reveniumRegionBaseURLs {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	return regions
+}
+
 // isValidReveniumAPIKey checks if the API key has a valid format
 func isValidReveniumAPIKey(key string) bool {
 	if len(key) < 4 {
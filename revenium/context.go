@@ -1,12 +1,22 @@
 package revenium
 
-import "context"
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
 
 // contextKey is a custom type for context keys to avoid collisions
 type contextKey string
 
 const (
 	usageMetadataKey contextKey = "revenium_usage_metadata"
+	traceparentKey   contextKey = "revenium_traceparent"
+	requestIDKey     contextKey = "revenium_request_id"
+	traceHandleKey   contextKey = "revenium_trace_handle"
+	logLevelKey      contextKey = "revenium_log_level"
 )
 
 // WithUsageMetadata adds usage metadata to the context
@@ -28,6 +38,191 @@ func GetUsageMetadata(ctx context.Context) map[string]interface{} {
 	return metadata
 }
 
+// WithRequestID attaches a caller-supplied request ID (e.g. one assigned by an
+// API gateway) to the context. It is included in Fal.ai request logs and in
+// metering attributes as "requestId". This is distinct from the Revenium
+// transaction ID, which is generated per metering record.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// WithLogLevel overrides the log level for calls made with the returned
+// context, including their metering delivery, without changing the global
+// level. Use it to debug a single suspicious request:
+//
+//	ctx = revenium.WithLogLevel(ctx, revenium.LogLevelDebug)
+//	resp, err := client.GenerateImage(ctx, "fal-ai/flux/dev", req)
+//
+// Only the middleware's per-call logs honor the override; startup and other
+// logs not tied to a call still use the global level.
+func WithLogLevel(ctx context.Context, level LogLevel) context.Context {
+	return context.WithValue(ctx, logLevelKey, level)
+}
+
+// logLevelOverride returns the WithLogLevel level of ctx, or nil if unset
+func logLevelOverride(ctx context.Context) *LogLevel {
+	if ctx == nil {
+		return nil
+	}
+	if level, ok := ctx.Value(logLevelKey).(LogLevel); ok {
+		return &level
+	}
+	return nil
+}
+
+// GetRequestID retrieves the request ID stored by WithRequestID
+func GetRequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// TraceIDFromTraceparent extracts the trace-id from a W3C Trace Context
+// traceparent header value ("00-<32 hex trace-id>-<16 hex parent-id>-<2 hex flags>").
+// It returns "" when the value is malformed or the trace-id is all zeros.
+func TraceIDFromTraceparent(traceparent string) string {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 {
+		return ""
+	}
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+
+	// Version ff is forbidden; version 00 must have exactly four fields
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return ""
+	}
+	if !isLowerHex(traceID, 32) || !isLowerHex(parentID, 16) || !isLowerHex(flags, 2) {
+		return ""
+	}
+	if strings.Trim(traceID, "0") == "" || strings.Trim(parentID, "0") == "" {
+		return ""
+	}
+	return traceID
+}
+
+// isLowerHex reports whether s is exactly n lowercase hex characters
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// WithTraceparent stores a W3C traceparent value in the context. When the usage
+// metadata has no explicit traceId, its trace-id is used as the metering TraceID.
+func WithTraceparent(ctx context.Context, traceparent string) context.Context {
+	return context.WithValue(ctx, traceparentKey, traceparent)
+}
+
+// GetTraceparent retrieves the traceparent value stored by WithTraceparent
+func GetTraceparent(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	traceparent, _ := ctx.Value(traceparentKey).(string)
+	return traceparent
+}
+
+// TraceHandle identifies one metered operation within a trace. Calls made with
+// the context returned alongside it are metered with the handle's TraceID,
+// Name (as traceName), and TransactionID, and with ParentTransactionID linking
+// it to its parent.
+//
+// A handle's context is single-use: every call made with it is metered under
+// the handle's TransactionID, so reusing it for several calls gives them all
+// the same ID. Derive a context with Child for each further call. Under
+// WithPerImageMetering, the per-image records get their own transaction IDs
+// and carry the handle's TransactionID as ParentTransactionID.
+//
+// Example:
+//
+//	ctx, trace := revenium.StartTrace(ctx, "E-commerce Image Pipeline")
+//	thumb, err := client.GenerateImage(ctx, model, thumbReq)
+//
+//	childCtx, _ := trace.Child(ctx, "Hero Image")
+//	hero, err := client.GenerateImage(childCtx, model, heroReq) // parentTransactionId = thumbnail's transactionId
+type TraceHandle struct {
+	TraceID             string
+	TransactionID       string
+	ParentTransactionID string
+	Name                string
+
+	// newID generates the IDs of the handle's children; nil uses the
+	// default generator
+	newID func() string
+}
+
+// StartTrace seeds a new trace and returns a context carrying its root handle.
+// Its IDs come from the default generator; use ReveniumFal.StartTrace to honor
+// a client's WithTransactionIDPrefix or WithTransactionIDGenerator.
+func StartTrace(ctx context.Context, name string) (context.Context, TraceHandle) {
+	return startTrace(ctx, name, generateTransactionID)
+}
+
+// StartTrace seeds a new trace like the package-level StartTrace, generating
+// the trace's IDs, and those of its children, with the client's configured
+// transaction ID prefix or generator
+func (r *ReveniumFal) StartTrace(ctx context.Context, name string) (context.Context, TraceHandle) {
+	return startTrace(ctx, name, r.config.newTransactionID)
+}
+
+// startTrace seeds a trace whose IDs come from newID
+func startTrace(ctx context.Context, name string, newID func() string) (context.Context, TraceHandle) {
+	handle := TraceHandle{
+		TraceID:       newID(),
+		TransactionID: newID(),
+		Name:          name,
+		newID:         newID,
+	}
+	return context.WithValue(ctx, traceHandleKey, handle), handle
+}
+
+// Child derives a handle for an operation caused by h, sharing its trace and
+// recording h's transaction ID as the parent
+func (h TraceHandle) Child(ctx context.Context, name string) (context.Context, TraceHandle) {
+	newID := h.newID
+	if newID == nil {
+		newID = generateTransactionID
+	}
+	child := TraceHandle{
+		TraceID:             h.TraceID,
+		TransactionID:       newID(),
+		ParentTransactionID: h.TransactionID,
+		Name:                name,
+		newID:               newID,
+	}
+	return context.WithValue(ctx, traceHandleKey, child), child
+}
+
+// GetTraceHandle retrieves the trace handle from the context, if any
+func GetTraceHandle(ctx context.Context) (TraceHandle, bool) {
+	if ctx == nil {
+		return TraceHandle{}, false
+	}
+	handle, ok := ctx.Value(traceHandleKey).(TraceHandle)
+	return handle, ok
+}
+
+// traceHandleMetadata fills in the handle's trace fields for keys the
+// metadata doesn't already set
+func traceHandleMetadata(metadata map[string]interface{}, handle TraceHandle) map[string]interface{} {
+	defaults := map[string]interface{}{"traceId": handle.TraceID}
+	if handle.Name != "" {
+		defaults["traceName"] = handle.Name
+	}
+	if handle.ParentTransactionID != "" {
+		defaults["parentTransactionId"] = handle.ParentTransactionID
+	}
+	return MergeMetadata(defaults, metadata)
+}
+
 // MergeMetadata merges two metadata maps, with priority to the second map
 func MergeMetadata(base, override map[string]interface{}) map[string]interface{} {
 	if base == nil && override == nil {
@@ -52,3 +247,380 @@ func MergeMetadata(base, override map[string]interface{}) map[string]interface{}
 
 	return result
 }
+
+// MetadataScope holds usage metadata shared by every call of one logical job,
+// such as a pipeline run that fans out into many Fal.ai calls. Put the common
+// fields (subscriber, organizationId, productId, traceId, traceName, ...) in
+// the base once and derive a call-ready context per call with Context.
+//
+// Example:
+//
+//	scope := revenium.NewMetadataScope(map[string]interface{}{
+//		"organizationId": "acme",
+//		"traceId":        jobID,
+//		"subscriber":     map[string]interface{}{"id": userID},
+//	})
+//	heroCtx := scope.Context(ctx, map[string]interface{}{"taskType": "hero"})
+//	thumbCtx := scope.Context(ctx, map[string]interface{}{"taskType": "thumbnail"})
+//
+// A scope is immutable after creation and safe for concurrent use.
+type MetadataScope struct {
+	base map[string]interface{}
+}
+
+// NewMetadataScope creates a scope from a copy of base, so later changes to
+// base do not affect it
+func NewMetadataScope(base map[string]interface{}) *MetadataScope {
+	return &MetadataScope{base: copyMetadataMap(base)}
+}
+
+// Metadata returns a copy of the scope's base metadata
+func (s *MetadataScope) Metadata() map[string]interface{} {
+	if s == nil {
+		return nil
+	}
+	return copyMetadataMap(s.base)
+}
+
+// Context returns ctx carrying the scope's base metadata deep-merged with
+// overrides: nested maps such as subscriber are merged key by key, and any
+// other override value replaces the base value. Neither the base nor
+// overrides is modified, and each returned context gets its own copy.
+func (s *MetadataScope) Context(ctx context.Context, overrides map[string]interface{}) context.Context {
+	return WithUsageMetadata(ctx, deepMergeMetadata(s.Metadata(), overrides))
+}
+
+// deepMergeMetadata merges override into a copy of base, recursing into maps
+// present on both sides
+func deepMergeMetadata(base, override map[string]interface{}) map[string]interface{} {
+	result := copyMetadataMap(base)
+	if result == nil {
+		result = make(map[string]interface{}, len(override))
+	}
+	for k, v := range override {
+		if overrideMap, ok := v.(map[string]interface{}); ok {
+			if baseMap, ok := result[k].(map[string]interface{}); ok {
+				result[k] = deepMergeMetadata(baseMap, overrideMap)
+				continue
+			}
+		}
+		result[k] = copyMetadataValue(v)
+	}
+	return result
+}
+
+// subscriberFieldAliases maps canonical subscriber fields to the aliases
+// commonly used for them, in precedence order
+var subscriberFieldAliases = []struct {
+	canonical string
+	aliases   []string
+}{
+	{"id", []string{"userId", "user_id", "subscriberId"}},
+	{"email", []string{"emailAddress", "email_address"}},
+	{"subscriptionTier", []string{"tier", "accountTier", "plan"}},
+}
+
+// NormalizeSubscriber returns a copy of subscriber with common field aliases
+// mapped onto the canonical subscriber schema:
+//
+//	id               <- userId, user_id, subscriberId
+//	email            <- emailAddress, email_address
+//	subscriptionTier <- tier, accountTier, plan
+//
+// Original keys are preserved and unknown keys pass through untouched. A
+// canonical field that is already set is never overwritten; when several
+// aliases are present, the first in the list above wins.
+func NormalizeSubscriber(subscriber map[string]interface{}) map[string]interface{} {
+	if subscriber == nil {
+		return nil
+	}
+
+	normalized := make(map[string]interface{}, len(subscriber)+len(subscriberFieldAliases))
+	for k, v := range subscriber {
+		normalized[k] = v
+	}
+
+	for _, field := range subscriberFieldAliases {
+		if _, exists := normalized[field.canonical]; exists {
+			continue
+		}
+		for _, alias := range field.aliases {
+			if value, ok := subscriber[alias]; ok {
+				normalized[field.canonical] = value
+				break
+			}
+		}
+	}
+
+	return normalized
+}
+
+// Subscriber identifies the end user of a call, using the canonical subscriber
+// schema. Empty fields are omitted from metering.
+type Subscriber struct {
+	ID               string
+	Email            string
+	SubscriptionTier string
+}
+
+// toMap converts the subscriber to the metadata map form
+func (s Subscriber) toMap() map[string]interface{} {
+	subscriber := make(map[string]interface{})
+	if s.ID != "" {
+		subscriber["id"] = s.ID
+	}
+	if s.Email != "" {
+		subscriber["email"] = s.Email
+	}
+	if s.SubscriptionTier != "" {
+		subscriber["subscriptionTier"] = s.SubscriptionTier
+	}
+	return subscriber
+}
+
+// CallOption sets usage metadata for a single GenerateImage or GenerateVideo
+// call, as an alternative to carrying it on the context. Call options are
+// merged over context metadata, overriding keys that appear in both.
+type CallOption func(*callConfig)
+
+type callConfig struct {
+	metadata       map[string]interface{}
+	cost           *float64
+	meteringCancel context.Context
+	meteringDone   *sync.WaitGroup
+	attributes     map[string]interface{}
+}
+
+// WithMetadata adds usage metadata to a single call.
+//
+// Example:
+//
+//	resp, err := client.GenerateImage(ctx, model, req,
+//	    revenium.WithMetadata(map[string]interface{}{"taskType": "thumbnail"}),
+//	)
+func WithMetadata(metadata map[string]interface{}) CallOption {
+	return func(c *callConfig) {
+		c.metadata = MergeMetadata(c.metadata, metadata)
+	}
+}
+
+// WithSubscriber sets the subscriber for a single call, replacing any
+// subscriber in the context metadata.
+func WithSubscriber(subscriber Subscriber) CallOption {
+	return func(c *callConfig) {
+		c.metadata = MergeMetadata(c.metadata, map[string]interface{}{"subscriber": subscriber.toMap()})
+	}
+}
+
+// WithCost sets the total cost of a single call, for callers that price
+// operations themselves. It takes precedence over any "totalCost" metadata,
+// whether from the context or WithMetadata.
+func WithCost(cost float64) CallOption {
+	return func(c *callConfig) {
+		c.cost = &cost
+	}
+}
+
+// WithMeteringCancellation ties a call's metering to ctx: if ctx is done
+// before the metering payload is sent, the payload is discarded ("don't bill
+// this"), e.g. when the caller's own request was aborted after Fal succeeded.
+//
+// The check happens when the metering worker picks the payload up (or when a
+// metering batch is sent), so there is a race window: a cancellation that
+// arrives after the send has started cannot recall the payload and the
+// operation is still billed.
+func WithMeteringCancellation(ctx context.Context) CallOption {
+	return func(c *callConfig) {
+		c.meteringCancel = ctx
+	}
+}
+
+// callMeteringCancellation returns the WithMeteringCancellation context, if any
+func callMeteringCancellation(opts []CallOption) context.Context {
+	cfg := &callConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg.meteringCancel
+}
+
+// awaitMetering makes each of a call's dispatched payloads register with wg
+// until its delivery finishes
+func awaitMetering(wg *sync.WaitGroup) CallOption {
+	return func(c *callConfig) {
+		c.meteringDone = wg
+	}
+}
+
+// withCallAttribute sets a metering attribute on a call's payloads
+func withCallAttribute(key string, value interface{}) CallOption {
+	return func(c *callConfig) {
+		if c.attributes == nil {
+			c.attributes = make(map[string]interface{})
+		}
+		c.attributes[key] = value
+	}
+}
+
+// callExtraAttributes returns the attributes set with withCallAttribute
+func callExtraAttributes(opts []CallOption) map[string]interface{} {
+	cfg := &callConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg.attributes
+}
+
+// callMeteringDone returns the awaitMetering wait group, if any
+func callMeteringDone(opts []CallOption) *sync.WaitGroup {
+	cfg := &callConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg.meteringDone
+}
+
+// callMetadata merges call option metadata over the context metadata
+func callMetadata(metadata map[string]interface{}, opts []CallOption) map[string]interface{} {
+	if len(opts) == 0 {
+		return metadata
+	}
+	cfg := &callConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	metadata = MergeMetadata(metadata, cfg.metadata)
+	if cfg.cost != nil {
+		metadata = MergeMetadata(metadata, map[string]interface{}{"totalCost": *cfg.cost})
+	}
+	return metadata
+}
+
+// RequestMetadataOption customizes how MetadataFromHTTPRequest extracts metadata
+type RequestMetadataOption func(*requestMetadataConfig)
+
+type requestMetadataConfig struct {
+	headers    map[string]string // header name -> metadata key
+	subscriber func(r *http.Request) map[string]interface{}
+	extra      func(r *http.Request) map[string]interface{}
+}
+
+// defaultRequestMetadataHeaders maps common request headers to metadata keys.
+// Earlier entries win when several headers map to the same key.
+var defaultRequestMetadataHeaders = []struct {
+	header string
+	key    string
+}{
+	{"X-Request-ID", "traceId"},
+	{"X-Correlation-ID", "traceId"},
+	{"X-Revenium-Trace-Name", "traceName"},
+	{"X-Region", "region"},
+	{"X-Environment", "environment"},
+}
+
+// WithMetadataHeader maps an additional request header to a metadata key.
+// Custom mappings take precedence over the defaults.
+func WithMetadataHeader(header, key string) RequestMetadataOption {
+	return func(c *requestMetadataConfig) {
+		c.headers[header] = key
+	}
+}
+
+// WithSubscriberFromRequest sets a function that derives the subscriber from
+// the request, typically from authentication claims placed there by middleware.
+func WithSubscriberFromRequest(fn func(r *http.Request) map[string]interface{}) RequestMetadataOption {
+	return func(c *requestMetadataConfig) {
+		c.subscriber = fn
+	}
+}
+
+// WithRequestMetadataFunc sets a function that contributes arbitrary metadata.
+// Its values override any extracted from headers.
+func WithRequestMetadataFunc(fn func(r *http.Request) map[string]interface{}) RequestMetadataOption {
+	return func(c *requestMetadataConfig) {
+		c.extra = fn
+	}
+}
+
+// MetadataFromHTTPRequest builds usage metadata from an incoming HTTP request.
+//
+// By default it extracts:
+//   - traceId from the W3C traceparent header, else X-Request-ID (or X-Correlation-ID)
+//   - traceName from X-Revenium-Trace-Name
+//   - region from X-Region, falling back to the REVENIUM_REGION environment variable
+//   - environment from X-Environment, falling back to REVENIUM_ENVIRONMENT
+//
+// Example:
+//
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//	    ctx := revenium.WithUsageMetadataFromRequest(r.Context(), r)
+//	    resp, err := client.GenerateImage(ctx, "fal-ai/flux/dev", req)
+//	    ...
+//	}
+func MetadataFromHTTPRequest(r *http.Request, opts ...RequestMetadataOption) map[string]interface{} {
+	if r == nil {
+		return nil
+	}
+
+	cfg := &requestMetadataConfig{headers: make(map[string]string)}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	metadata := make(map[string]interface{})
+
+	// Custom header mappings first so they take precedence
+	for header, key := range cfg.headers {
+		if value := strings.TrimSpace(r.Header.Get(header)); value != "" {
+			metadata[key] = value
+		}
+	}
+	if _, exists := metadata["traceId"]; !exists {
+		if traceID := TraceIDFromTraceparent(r.Header.Get("traceparent")); traceID != "" {
+			metadata["traceId"] = traceID
+		}
+	}
+	for _, h := range defaultRequestMetadataHeaders {
+		if _, exists := metadata[h.key]; exists {
+			continue
+		}
+		if value := strings.TrimSpace(r.Header.Get(h.header)); value != "" {
+			metadata[h.key] = value
+		}
+	}
+
+	// Environment fallbacks for deployment-level fields
+	if _, exists := metadata["region"]; !exists {
+		if region := os.Getenv("REVENIUM_REGION"); region != "" {
+			metadata["region"] = region
+		}
+	}
+	if _, exists := metadata["environment"]; !exists {
+		if environment := os.Getenv("REVENIUM_ENVIRONMENT"); environment != "" {
+			metadata["environment"] = environment
+		}
+	}
+
+	if cfg.subscriber != nil {
+		if subscriber := cfg.subscriber(r); len(subscriber) > 0 {
+			metadata["subscriber"] = subscriber
+		}
+	}
+	if cfg.extra != nil {
+		for k, v := range cfg.extra(r) {
+			metadata[k] = v
+		}
+	}
+
+	return metadata
+}
+
+// WithUsageMetadataFromRequest adds metadata extracted from an HTTP request to
+// the context, merged over any usage metadata the context already carries.
+func WithUsageMetadataFromRequest(ctx context.Context, r *http.Request, opts ...RequestMetadataOption) context.Context {
+	metadata := MergeMetadata(GetUsageMetadata(ctx), MetadataFromHTTPRequest(r, opts...))
+	if metadata == nil {
+		return ctx
+	}
+	return WithUsageMetadata(ctx, metadata)
+}
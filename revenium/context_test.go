@@ -0,0 +1,149 @@
+package revenium
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetadataFromHTTPRequest(t *testing.T) {
+	t.Setenv("REVENIUM_REGION", "us-east-1")
+	t.Setenv("REVENIUM_ENVIRONMENT", "")
+
+	r := httptest.NewRequest("POST", "/generate", nil)
+	r.Header.Set("X-Request-ID", "req-42")
+	r.Header.Set("X-Environment", "staging")
+	r.Header.Set("X-Tenant", "acme")
+
+	metadata := MetadataFromHTTPRequest(r,
+		WithMetadataHeader("X-Tenant", "organizationName"),
+		WithSubscriberFromRequest(func(r *http.Request) map[string]interface{} {
+			return map[string]interface{}{"id": "user-1"}
+		}),
+	)
+
+	want := map[string]string{
+		"traceId":          "req-42",
+		"environment":      "staging",
+		"region":           "us-east-1",
+		"organizationName": "acme",
+	}
+	for key, value := range want {
+		if metadata[key] != value {
+			t.Errorf("metadata[%q] = %v, want %q", key, metadata[key], value)
+		}
+	}
+	subscriber, ok := metadata["subscriber"].(map[string]interface{})
+	if !ok || subscriber["id"] != "user-1" {
+		t.Errorf("metadata[subscriber] = %v, want id user-1", metadata["subscriber"])
+	}
+
+	ctx := WithUsageMetadata(context.Background(), map[string]interface{}{"taskType": "image"})
+	ctx = WithUsageMetadataFromRequest(ctx, r)
+	merged := GetUsageMetadata(ctx)
+	if merged["taskType"] != "image" || merged["traceId"] != "req-42" {
+		t.Errorf("merged metadata = %v, want taskType and traceId", merged)
+	}
+}
+
+func TestNormalizeSubscriber(t *testing.T) {
+	subscriber := map[string]interface{}{
+		"id":         "user-1",
+		"tier":       "enterprise",
+		"department": "marketing",
+	}
+
+	normalized := NormalizeSubscriber(subscriber)
+
+	if normalized["subscriptionTier"] != "enterprise" {
+		t.Errorf("subscriptionTier = %v, want enterprise", normalized["subscriptionTier"])
+	}
+	if normalized["tier"] != "enterprise" {
+		t.Errorf("tier = %v, want original key preserved", normalized["tier"])
+	}
+	if normalized["department"] != "marketing" {
+		t.Errorf("department = %v, want unknown key untouched", normalized["department"])
+	}
+	if normalized["id"] != "user-1" {
+		t.Errorf("id = %v, want user-1", normalized["id"])
+	}
+	if _, mutated := subscriber["subscriptionTier"]; mutated {
+		t.Error("NormalizeSubscriber modified its input")
+	}
+}
+
+func TestTraceIDFromTraceparent(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		expected    string
+	}{
+		{"valid", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"surrounding whitespace", " 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00 ", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"empty", "", ""},
+		{"too few fields", "00-4bf92f3577b34da6a3ce929d0e0e4736", ""},
+		{"short trace id", "00-4bf92f3577b34da6-00f067aa0ba902b7-01", ""},
+		{"uppercase hex", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", ""},
+		{"all-zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", ""},
+		{"forbidden version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TraceIDFromTraceparent(tt.traceparent); got != tt.expected {
+				t.Errorf("TraceIDFromTraceparent(%q) = %q, want %q", tt.traceparent, got, tt.expected)
+			}
+		})
+	}
+
+	r := httptest.NewRequest("POST", "/generate", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set("X-Request-ID", "req-42")
+	if got := MetadataFromHTTPRequest(r)["traceId"]; got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("MetadataFromHTTPRequest traceId = %v, want traceparent trace-id", got)
+	}
+}
+
+func TestMetadataScope(t *testing.T) {
+	base := map[string]interface{}{
+		"organizationId": "acme",
+		"traceId":        "job-1",
+		"subscriber":     map[string]interface{}{"id": "user-1", "email": "a@example.com"},
+	}
+	scope := NewMetadataScope(base)
+
+	hero := GetUsageMetadata(scope.Context(context.Background(), map[string]interface{}{
+		"taskType":   "hero",
+		"subscriber": map[string]interface{}{"email": "b@example.com"},
+	}))
+	thumb := GetUsageMetadata(scope.Context(context.Background(), map[string]interface{}{
+		"taskType": "thumbnail",
+	}))
+
+	if hero["organizationId"] != "acme" || hero["traceId"] != "job-1" || hero["taskType"] != "hero" {
+		t.Errorf("hero metadata = %v, want base plus taskType=hero", hero)
+	}
+	subscriber := hero["subscriber"].(map[string]interface{})
+	if subscriber["id"] != "user-1" || subscriber["email"] != "b@example.com" {
+		t.Errorf("hero subscriber = %v, want id from base and overridden email", subscriber)
+	}
+	if thumb["taskType"] != "thumbnail" || thumb["traceId"] != "job-1" {
+		t.Errorf("thumbnail metadata = %v, want base plus taskType=thumbnail", thumb)
+	}
+	if email := thumb["subscriber"].(map[string]interface{})["email"]; email != "a@example.com" {
+		t.Errorf("thumbnail subscriber email = %v, want base email", email)
+	}
+
+	// Mutating a derived map must not leak into the base or other contexts
+	subscriber["id"] = "mutated"
+	if _, ok := base["taskType"]; ok {
+		t.Error("base gained taskType from an override")
+	}
+	if id := base["subscriber"].(map[string]interface{})["id"]; id != "user-1" {
+		t.Errorf("base subscriber id = %v, want user-1", id)
+	}
+	if id := scope.Metadata()["subscriber"].(map[string]interface{})["id"]; id != "user-1" {
+		t.Errorf("scope subscriber id = %v, want user-1", id)
+	}
+}
@@ -1,8 +1,10 @@
 package revenium
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/http"
 )
 
 // ErrorType represents the type of error that occurred
@@ -125,6 +127,19 @@ func NewValidationError(message string, err error) *ReveniumError {
 	}
 }
 
+// QuotaExceededError is returned when a generation is blocked because the
+// subscriber's quota, checked with WithSubscriberQuota, cannot cover it
+type QuotaExceededError struct {
+	SubscriberID string
+	Remaining    int
+	Requested    int
+}
+
+// Error implements the error interface
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded for subscriber %s: %d remaining, %d requested", e.SubscriberID, e.Remaining, e.Requested)
+}
+
 // IsConfigError checks if an error is a configuration error
 func IsConfigError(err error) bool {
 	var revErr *ReveniumError
@@ -137,8 +152,78 @@ func IsMeteringError(err error) bool {
 	return errors.As(err, &revErr) && revErr.Type == ErrorTypeMetering
 }
 
+// IsQuotaExceededError checks if an error is a subscriber quota error
+func IsQuotaExceededError(err error) bool {
+	var quotaErr *QuotaExceededError
+	return errors.As(err, &quotaErr)
+}
+
 // IsValidationError checks if an error is a validation error
 func IsValidationError(err error) bool {
 	var revErr *ReveniumError
 	return errors.As(err, &revErr) && revErr.Type == ErrorTypeValidation
 }
+
+// HTTPStatusFromError maps an error returned by the middleware to the status
+// an API gateway wrapping it should return to its own client:
+//
+//   - Fal.ai 429 and client errors (400, 404, 413, 422, ...) pass through, since
+//     they are caused by the caller's request
+//   - Fal.ai 401/403 (our credentials) and other Fal.ai or network failures
+//     are 502 Bad Gateway; a Fal.ai 504 or an expired deadline is 504
+//   - QuotaExceededError is 429, validation errors 400, and ErrShuttingDown 503
+//   - anything else (configuration, metering, internal) is 500
+//
+// A nil error maps to 200.
+func HTTPStatusFromError(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+
+	var quotaErr *QuotaExceededError
+	switch {
+	case errors.As(err, &quotaErr):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrShuttingDown):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+
+	var falErr *FalError
+	if errors.As(err, &falErr) && falErr.Status != 0 {
+		return upstreamStatus(falErr.Status)
+	}
+
+	var revErr *ReveniumError
+	if !errors.As(err, &revErr) {
+		return http.StatusInternalServerError
+	}
+	switch revErr.Type {
+	case ErrorTypeProvider:
+		if revErr.StatusCode != 0 {
+			return upstreamStatus(revErr.StatusCode)
+		}
+		return http.StatusBadGateway
+	case ErrorTypeNetwork:
+		return http.StatusBadGateway
+	case ErrorTypeValidation:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// upstreamStatus maps a Fal.ai response status to a gateway status
+func upstreamStatus(status int) int {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return http.StatusBadGateway
+	case status == http.StatusGatewayTimeout:
+		return http.StatusGatewayTimeout
+	case status >= 400 && status < 500:
+		return status
+	default:
+		return http.StatusBadGateway
+	}
+}
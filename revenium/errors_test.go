@@ -0,0 +1,51 @@
+package revenium
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestHTTPStatusFromError(t *testing.T) {
+	falError := func(status int) error {
+		err := NewProviderError("Fal.ai API error", &FalError{ErrorText: "failed", Status: status})
+		err.StatusCode = status
+		return err
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, http.StatusOK},
+		{"fal rate limit", falError(http.StatusTooManyRequests), http.StatusTooManyRequests},
+		{"fal bad request", falError(http.StatusBadRequest), http.StatusBadRequest},
+		{"fal validation", falError(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity},
+		{"fal unauthorized", falError(http.StatusUnauthorized), http.StatusBadGateway},
+		{"fal server error", falError(http.StatusInternalServerError), http.StatusBadGateway},
+		{"fal gateway timeout", falError(http.StatusGatewayTimeout), http.StatusGatewayTimeout},
+		{"provider error with non-JSON body", &ReveniumError{Type: ErrorTypeProvider, StatusCode: http.StatusNotFound}, http.StatusNotFound},
+		{"provider error without status", NewProviderError("failed to parse response", nil), http.StatusBadGateway},
+		{"network", NewNetworkError("request failed", errors.New("connection refused")), http.StatusBadGateway},
+		{"deadline", NewNetworkError("request failed", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{"validation", NewValidationError("request too large", nil), http.StatusBadRequest},
+		{"quota", &QuotaExceededError{SubscriberID: "sub-1"}, http.StatusTooManyRequests},
+		{"shutting down", ErrShuttingDown, http.StatusServiceUnavailable},
+		{"config", NewConfigError("FAL_API_KEY is required", nil), http.StatusInternalServerError},
+		{"metering", NewMeteringError("send failed", nil), http.StatusInternalServerError},
+		{"internal", &ReveniumError{Type: ErrorTypeInternal}, http.StatusInternalServerError},
+		{"unknown", errors.New("boom"), http.StatusInternalServerError},
+		{"wrapped", fmt.Errorf("request 2: %w", falError(http.StatusTooManyRequests)), http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HTTPStatusFromError(tt.err); got != tt.want {
+				t.Errorf("HTTPStatusFromError(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package revenium
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyWindowSize is how many recent Fal call durations are kept per
+// operation type, bounding the memory used by LatencyStats
+const latencyWindowSize = 1024
+
+// LatencyPercentiles summarizes recent Fal call durations for one operation type
+type LatencyPercentiles struct {
+	Count int // Samples in the window (at most 1024)
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+}
+
+// LatencyReport holds latency percentiles keyed by operation type. Operation
+// types with no successful calls yet are absent.
+type LatencyReport map[OperationType]LatencyPercentiles
+
+// latencyWindow is a ring buffer of the most recent call durations
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+// latencyRecorder tracks per-operation latency windows; the zero value is ready to use
+type latencyRecorder struct {
+	mu      sync.Mutex
+	windows map[OperationType]*latencyWindow
+}
+
+// record adds a successful Fal call's duration, evicting the oldest sample
+// once the window is full
+func (l *latencyRecorder) record(opType OperationType, duration time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.windows == nil {
+		l.windows = make(map[OperationType]*latencyWindow)
+	}
+	w, ok := l.windows[opType]
+	if !ok {
+		w = &latencyWindow{}
+		l.windows[opType] = w
+	}
+
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, duration)
+		return
+	}
+	w.samples[w.next] = duration
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// report computes percentiles over each window
+func (l *latencyRecorder) report() LatencyReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	report := make(LatencyReport, len(l.windows))
+	for opType, w := range l.windows {
+		sorted := append([]time.Duration(nil), w.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		report[opType] = LatencyPercentiles{
+			Count: len(sorted),
+			P50:   percentile(sorted, 50),
+			P95:   percentile(sorted, 95),
+			P99:   percentile(sorted, 99),
+		}
+	}
+	return report
+}
+
+// percentile returns the nearest-rank pth percentile of sorted samples
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// LatencyStats reports p50/p95/p99 of successful Fal call durations per
+// operation type, over the most recent 1024 calls of each type. It is meant
+// for environments without a metrics pipeline; durations are measured around
+// the successful attempt, like the metered RequestDuration.
+//
+// Example:
+//
+//	for opType, p := range client.LatencyStats() {
+//	    log.Printf("%s: p50=%v p95=%v p99=%v (n=%d)", opType, p.P50, p.P95, p.P99, p.Count)
+//	}
+func (r *ReveniumFal) LatencyStats() LatencyReport {
+	return r.latency.report()
+}
@@ -0,0 +1,87 @@
+package revenium
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// delayGenerator is a FalGenerator that takes as many milliseconds as the
+// request's prompt says
+type delayGenerator struct{}
+
+func (delayGenerator) delay(request *FalRequest) {
+	ms, _ := strconv.Atoi(request.Prompt)
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+}
+
+func (g delayGenerator) GenerateImage(ctx context.Context, model string, request *FalRequest) (*FalImageResponse, error) {
+	g.delay(request)
+	return &FalImageResponse{Images: []FalImage{{URL: "https://fal.media/1.png"}}}, nil
+}
+
+func (g delayGenerator) GenerateVideo(ctx context.Context, model string, request *FalRequest) (*FalVideoResponse, error) {
+	g.delay(request)
+	return &FalVideoResponse{Video: FalVideo{URL: "https://fal.media/1.mp4"}}, nil
+}
+
+func TestLatencyStats(t *testing.T) {
+	client, _ := newFakeClient(t, nil, WithFalGenerator(delayGenerator{}))
+
+	// 100 image calls taking 2ms..200ms, run concurrently to keep the test fast
+	var wg sync.WaitGroup
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+		go func(ms int) {
+			defer wg.Done()
+			if _, err := client.GenerateImage(context.Background(), "fal-ai/flux/dev", &FalRequest{Prompt: strconv.Itoa(ms)}); err != nil {
+				t.Errorf("GenerateImage() error = %v", err)
+			}
+		}(2 * i)
+	}
+	wg.Wait()
+	if _, err := client.GenerateVideo(context.Background(), "fal-ai/kling-video", &FalRequest{Prompt: "20"}); err != nil {
+		t.Fatalf("GenerateVideo() error = %v", err)
+	}
+	client.Flush()
+
+	report := client.LatencyStats()
+	image, ok := report[OperationTypeImage]
+	if !ok || image.Count != 100 {
+		t.Fatalf("image stats = %+v, want 100 samples", image)
+	}
+	const tolerance = 30 * time.Millisecond
+	for name, tc := range map[string]struct{ got, want time.Duration }{
+		"p50": {image.P50, 100 * time.Millisecond},
+		"p95": {image.P95, 190 * time.Millisecond},
+		"p99": {image.P99, 198 * time.Millisecond},
+	} {
+		if tc.got < tc.want || tc.got > tc.want+tolerance {
+			t.Errorf("image %s = %v, want about %v", name, tc.got, tc.want)
+		}
+	}
+
+	video := report[OperationTypeVideo]
+	if video.Count != 1 || video.P50 < 20*time.Millisecond || video.P99 != video.P50 {
+		t.Errorf("video stats = %+v, want one ~20ms sample", video)
+	}
+}
+
+func TestLatencyWindowIsBounded(t *testing.T) {
+	var l latencyRecorder
+	for i := 0; i < latencyWindowSize; i++ {
+		l.record(OperationTypeImage, time.Hour)
+	}
+	for i := 0; i < latencyWindowSize; i++ {
+		l.record(OperationTypeImage, time.Millisecond)
+	}
+
+	if n := len(l.windows[OperationTypeImage].samples); n != latencyWindowSize {
+		t.Errorf("window holds %d samples, want %d", n, latencyWindowSize)
+	}
+	if p99 := l.report()[OperationTypeImage].P99; p99 != time.Millisecond {
+		t.Errorf("P99 = %v, want old samples evicted", p99)
+	}
+}
@@ -1,7 +1,9 @@
 package revenium
 
 import (
+	"context"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 )
@@ -112,30 +114,114 @@ func (l LogLevel) String() string {
 	}
 }
 
+// KeyRedactionMode controls how credential headers appear in debug logs
+type KeyRedactionMode int
+
+const (
+	// KeyRedactionFull replaces the whole credential with [REDACTED] (default)
+	KeyRedactionFull KeyRedactionMode = iota
+	// KeyRedactionPartial keeps the auth scheme and the last 4 characters of
+	// the key (e.g. "Key ...a1b2"), enough to tell which key is in use
+	KeyRedactionPartial
+)
+
+// credentialHeaders are headers whose values are always redacted in logs
+var credentialHeaders = map[string]bool{
+	"Authorization": true,
+	"X-Api-Key":     true,
+}
+
+// redactCredential redacts a credential header value according to mode.
+// Partial mode still fully redacts keys too short to reveal a suffix safely.
+func redactCredential(value string, mode KeyRedactionMode) string {
+	if value == "" {
+		return ""
+	}
+
+	scheme, secret := "", value
+	if i := strings.IndexByte(value, ' '); i >= 0 {
+		scheme, secret = value[:i+1], value[i+1:]
+	}
+
+	if mode != KeyRedactionPartial || len(secret) < 12 {
+		return scheme + "[REDACTED]"
+	}
+	return scheme + "..." + secret[len(secret)-4:]
+}
+
+// loggingRoundTripper logs outgoing requests at debug level, redacting
+// credential headers according to mode
+type loggingRoundTripper struct {
+	base http.RoundTripper
+	mode KeyRedactionMode
+}
+
+// newLoggingRoundTripper wraps base (or http.DefaultTransport when nil)
+func newLoggingRoundTripper(base http.RoundTripper, mode KeyRedactionMode) *loggingRoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &loggingRoundTripper{base: base, mode: mode}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *loggingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	logRequest(req.Context(), req.Method, req.URL.String(), req.Header, t.mode)
+	return t.base.RoundTrip(req)
+}
+
+// CloseIdleConnections closes idle connections on the wrapped transport
+func (t *loggingRoundTripper) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
 // logRequest logs an HTTP request for debugging
-func logRequest(method, url string, headers map[string]string) {
-	Debug("HTTP %s %s", method, url)
-	if currentLogLevel <= LogLevelDebug {
-		for k, v := range headers {
+func logRequest(ctx context.Context, method, url string, headers http.Header, mode KeyRedactionMode) {
+	debugCtx(ctx, "HTTP %s %s", method, url)
+	if logLevelFor(ctx) <= LogLevelDebug {
+		for k := range headers {
 			// Don't log full API keys
-			if k == "Authorization" || k == "x-api-key" {
-				Debug("  %s: [REDACTED]", k)
+			if credentialHeaders[http.CanonicalHeaderKey(k)] {
+				debugCtx(ctx, "  %s: %s", k, redactCredential(headers.Get(k), mode))
 			} else {
-				Debug("  %s: %s", k, v)
+				debugCtx(ctx, "  %s: %s", k, headers.Get(k))
 			}
 		}
 	}
 }
 
+// logLevelFor returns the log level in effect for ctx: its WithLogLevel
+// override, or the global level
+func logLevelFor(ctx context.Context) LogLevel {
+	if level := logLevelOverride(ctx); level != nil {
+		return *level
+	}
+	return currentLogLevel
+}
+
+// debugCtx logs a debug message prefixed with the context's request ID, if
+// any, honoring the context's WithLogLevel override
+func debugCtx(ctx context.Context, format string, v ...interface{}) {
+	if logLevelFor(ctx) > LogLevelDebug {
+		return
+	}
+	if requestID := GetRequestID(ctx); requestID != "" {
+		format = "[requestId=" + requestID + "] " + format
+	}
+	logger.Printf("[DEBUG] "+format, v...)
+}
+
 // logResponse logs an HTTP response for debugging
-func logResponse(statusCode int, body string) {
-	Debug("HTTP Response: %d", statusCode)
-	if currentLogLevel <= LogLevelDebug && body != "" {
+func logResponse(ctx context.Context, statusCode int, body string) {
+	debugCtx(ctx, "HTTP Response: %d", statusCode)
+	if logLevelFor(ctx) <= LogLevelDebug && body != "" {
 		// Truncate long responses
 		if len(body) > 500 {
-			Debug("  Body: %s... (truncated)", body[:500])
+			debugCtx(ctx, "  Body: %s... (truncated)", body[:500])
 		} else {
-			Debug("  Body: %s", body)
+			debugCtx(ctx, "  Body: %s", body)
 		}
 	}
 }
@@ -146,8 +232,6 @@ func logError(context string, err error) {
 }
 
 // logMeteringPayload logs a metering payload for debugging
-func logMeteringPayload(payload interface{}) {
-	if currentLogLevel <= LogLevelDebug {
-		Debug("Metering payload: %+v", payload)
-	}
+func logMeteringPayload(ctx context.Context, payload interface{}) {
+	debugCtx(ctx, "Metering payload: %+v", payload)
 }
@@ -0,0 +1,33 @@
+package revenium
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactCredential(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		mode     KeyRedactionMode
+		expected string
+	}{
+		{"full hides fal key", "Key fal-secret-key-a1b2", KeyRedactionFull, "Key [REDACTED]"},
+		{"full hides bare key", "hak_secret_key_a1b2", KeyRedactionFull, "[REDACTED]"},
+		{"partial shows scheme and suffix", "Key fal-secret-key-a1b2", KeyRedactionPartial, "Key ...a1b2"},
+		{"partial shows bare key suffix", "hak_secret_key_c3d4", KeyRedactionPartial, "...c3d4"},
+		{"partial fully redacts short keys", "Key short", KeyRedactionPartial, "Key [REDACTED]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactCredential(tt.value, tt.mode)
+			if got != tt.expected {
+				t.Errorf("redactCredential(%q) = %q, want %q", tt.value, got, tt.expected)
+			}
+			if strings.Contains(got, "secret") {
+				t.Errorf("redactCredential(%q) leaked secret material: %q", tt.value, got)
+			}
+		})
+	}
+}
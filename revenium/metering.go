@@ -4,31 +4,103 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 )
 
-// Package-level HTTP client with connection pooling for metering requests.
-// This prevents creating a new client for each metering call, avoiding
-// file descriptor exhaustion and TCP handshake overhead under high load.
-var meteringHTTPClient = &http.Client{
-	Timeout: 10 * time.Second,
-	Transport: &http.Transport{
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 10,
-		IdleConnTimeout:     90 * time.Second,
+// Default connection pool settings for the metering transport
+const (
+	defaultMeteringMaxIdleConns        = 100
+	defaultMeteringMaxIdleConnsPerHost = 10
+	defaultMeteringIdleConnTimeout     = 90 * time.Second
+)
+
+// defaultMeteringTimeout bounds each metering request unless WithMeteringTimeout is set
+const defaultMeteringTimeout = 10 * time.Second
+
+// newMeteringHTTPClient creates a metering HTTP client using the pool and
+// timeout settings from config, falling back to the defaults for any unset value.
+// Each MeteringClient owns one of these and reuses it across requests, which
+// avoids file descriptor exhaustion and TCP handshake overhead under high load
+// while keeping transport settings independent between instances.
+func newMeteringHTTPClient(config *Config) *http.Client {
+	transport := &http.Transport{
+		MaxIdleConns:        defaultMeteringMaxIdleConns,
+		MaxIdleConnsPerHost: defaultMeteringMaxIdleConnsPerHost,
+		IdleConnTimeout:     defaultMeteringIdleConnTimeout,
 		DisableCompression:  true, // JSON is already small
-	},
+	}
+	if config.MeteringMaxIdleConns > 0 {
+		transport.MaxIdleConns = config.MeteringMaxIdleConns
+	}
+	if config.MeteringMaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = config.MeteringMaxIdleConnsPerHost
+	}
+	if config.MeteringIdleConnTimeout > 0 {
+		transport.IdleConnTimeout = config.MeteringIdleConnTimeout
+	}
+
+	timeout := defaultMeteringTimeout
+	if config.MeteringTimeout > 0 {
+		timeout = config.MeteringTimeout
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: newLoggingRoundTripper(transport, config.KeyRedactionMode),
+	}
+}
+
+// Meterer delivers metering payloads to Revenium. MeteringClient is the
+// standard implementation; inject a fake with WithMeterer to test code that
+// uses ReveniumFal without a metering server.
+type Meterer interface {
+	SendImageMetering(payload *MeteringPayload) error
+	SendVideoMetering(payload *MeteringPayload) error
+}
+
+// disabledMeterer discards payloads; it stands in for MeteringClient when
+// WithOptionalMetering is set and there is no valid Revenium API key
+type disabledMeterer struct{}
+
+// SendImageMetering discards the payload
+func (disabledMeterer) SendImageMetering(payload *MeteringPayload) error {
+	Debug("Metering disabled, dropping transaction %s", payload.TransactionID)
+	return nil
+}
+
+// SendVideoMetering discards the payload
+func (disabledMeterer) SendVideoMetering(payload *MeteringPayload) error {
+	Debug("Metering disabled, dropping transaction %s", payload.TransactionID)
+	return nil
+}
+
+// BatchMeterer is a Meterer that can also deliver payloads in batches.
+// Batched delivery (WithMeteringBatch) is only used when the Meterer supports it.
+type BatchMeterer interface {
+	Meterer
+	SendBatchMetering(payloads []*MeteringPayload) error
 }
 
 // MeteringClient handles communication with the Revenium metering API
 type MeteringClient struct {
-	config *Config
+	config      *Config
+	httpClient  *http.Client
+	retryBudget *retryBudget // nil when retries are unlimited
 }
 
 // NewMeteringClient creates a new metering client
@@ -38,37 +110,79 @@ func NewMeteringClient(config *Config) (*MeteringClient, error) {
 	}
 
 	return &MeteringClient{
-		config: config,
+		config:      config,
+		httpClient:  newMeteringHTTPClient(config),
+		retryBudget: newRetryBudget(config),
 	}, nil
 }
 
+// Close releases idle connections held by the metering transport
+func (mc *MeteringClient) Close() {
+	mc.httpClient.CloseIdleConnections()
+}
+
 // SendImageMetering sends image generation metering data to Revenium
 func (mc *MeteringClient) SendImageMetering(payload *MeteringPayload) error {
 	url := fmt.Sprintf("%s/meter/v2/ai/images", mc.config.ReveniumBaseURL)
+	payload.formatCapturedPrompt(!mc.config.DisableHTMLEscaping)
+	sanitizePayload(payload)
 	return mc.sendMetering(url, payload)
 }
 
 // SendVideoMetering sends video generation metering data to Revenium
 func (mc *MeteringClient) SendVideoMetering(payload *MeteringPayload) error {
 	url := fmt.Sprintf("%s/meter/v2/ai/video", mc.config.ReveniumBaseURL)
+	payload.formatCapturedPrompt(!mc.config.DisableHTMLEscaping)
+	sanitizePayload(payload)
 	return mc.sendMetering(url, payload)
 }
 
-// sendMetering sends metering data to the specified endpoint with retry logic
-func (mc *MeteringClient) sendMetering(url string, payload *MeteringPayload) error {
+// SendBatchMetering sends several image and/or video payloads to Revenium
+// as a single JSON array
+func (mc *MeteringClient) SendBatchMetering(payloads []*MeteringPayload) error {
+	url := fmt.Sprintf("%s/meter/v2/ai/batch", mc.config.ReveniumBaseURL)
+	for _, payload := range payloads {
+		payload.formatCapturedPrompt(!mc.config.DisableHTMLEscaping)
+		sanitizePayload(payload)
+	}
+	return mc.sendMetering(url, payloads)
+}
+
+// sanitizePayload drops caller-supplied values that can't be serialized so
+// one bad value doesn't lose the whole record
+func sanitizePayload(payload *MeteringPayload) {
+	payload.Subscriber = sanitizeJSONMap("subscriber", payload.Subscriber)
+	payload.Attributes = sanitizeJSONMap("attributes", payload.Attributes)
+}
+
+// sendMetering sends metering data to the specified endpoint with retry logic.
+// payload is a single *MeteringPayload or a slice of them for batch delivery.
+func (mc *MeteringClient) sendMetering(url string, payload interface{}) error {
+	ctx := context.Background()
+	if p, ok := payload.(*MeteringPayload); ok && p.logLevel != nil {
+		ctx = WithLogLevel(ctx, *p.logLevel)
+	}
+
 	const maxRetries = 3
 	const initialBackoff = 100 * time.Millisecond
 
 	var lastErr error
 	backoff := initialBackoff
+	mc.retryBudget.deposit()
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
+			if !mc.retryBudget.withdraw() {
+				Debug("Retry budget exhausted, not retrying metering request")
+				return NewMeteringError("metering failed, retry budget exhausted", lastErr)
+			}
 			time.Sleep(backoff)
 			backoff *= 2
 		}
 
-		err := mc.sendMeteringRequest(url, payload)
+		sentAt := time.Now()
+		statusCode, err := mc.sendMeteringRequest(ctx, url, payload)
+		mc.logEvents(url, payload, sentAt, attempt+1, statusCode, err)
 		if err == nil {
 			return nil
 		}
@@ -87,21 +201,99 @@ func (mc *MeteringClient) sendMetering(url string, payload *MeteringPayload) err
 	)
 }
 
-// sendMeteringRequest sends a single metering request
-func (mc *MeteringClient) sendMeteringRequest(url string, payload *MeteringPayload) error {
+// retryBudgetMaxTokens caps the retries a retryBudget can bank, bounding the
+// burst of retries allowed at the start of an outage
+const retryBudgetMaxTokens = 10
+
+// retryBudget is a token bucket shared by all requests of a MeteringClient.
+// Every request deposits ratio tokens and every retry withdraws one, so
+// retries stay at roughly ratio of total requests however many are failing.
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+// newRetryBudget returns a full budget, or nil (unlimited) when WithRetryBudget
+// was not used
+func newRetryBudget(config *Config) *retryBudget {
+	if !config.retryBudgetSet {
+		return nil
+	}
+	return &retryBudget{ratio: config.RetryBudgetRatio, tokens: retryBudgetMaxTokens}
+}
+
+// deposit credits the budget for a new request
+func (b *retryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.tokens+b.ratio, retryBudgetMaxTokens)
+}
+
+// withdraw takes a token for a retry, reporting false when none are left
+func (b *retryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// logEvents reports a delivery attempt to the configured MeteringEventLog,
+// one event per payload
+func (mc *MeteringClient) logEvents(url string, payload interface{}, sentAt time.Time, attempt, statusCode int, err error) {
+	if mc.config.MeteringEventLog == nil {
+		return
+	}
+
+	var payloads []*MeteringPayload
+	switch p := payload.(type) {
+	case *MeteringPayload:
+		payloads = []*MeteringPayload{p}
+	case []*MeteringPayload:
+		payloads = p
+	}
+
+	for _, p := range payloads {
+		event := MeteringEvent{
+			Payload:    p,
+			SentAt:     sentAt,
+			Endpoint:   url,
+			Attempt:    attempt,
+			StatusCode: statusCode,
+			Delivered:  err == nil,
+		}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		mc.config.MeteringEventLog(event)
+	}
+}
+
+// sendMeteringRequest sends a single metering request, returning the response
+// status code (0 if no response was received)
+func (mc *MeteringClient) sendMeteringRequest(ctx context.Context, url string, payload interface{}) (int, error) {
 	// Marshal payload
-	jsonData, err := json.Marshal(payload)
+	jsonData, err := encodeJSON(payload, !mc.config.DisableHTMLEscaping)
 	if err != nil {
-		return NewMeteringError("failed to marshal metering payload", err)
+		return 0, NewMeteringError("failed to marshal metering payload", err)
 	}
 
-	logMeteringPayload(payload)
-	Debug("Sending metering data to %s", url)
+	logMeteringPayload(ctx, payload)
 
-	// Create request with background context for fire-and-forget
-	req, err := http.NewRequestWithContext(context.Background(), "POST", url, bytes.NewBuffer(jsonData))
+	// Create request with a background-derived context for fire-and-forget;
+	// it only carries the call's log level
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return NewNetworkError("failed to create metering request", err)
+		return 0, NewNetworkError("failed to create metering request", err)
 	}
 
 	// Set headers
@@ -109,39 +301,123 @@ func (mc *MeteringClient) sendMeteringRequest(url string, payload *MeteringPaylo
 	req.Header.Set("x-api-key", mc.config.ReveniumAPIKey)
 	req.Header.Set("User-Agent", "revenium-middleware-fal-go/1.0")
 
-	// Send request using pooled client (avoids creating new client per instance)
-	resp, err := meteringHTTPClient.Do(req)
+	// Send request using the instance's pooled client
+	resp, err := mc.httpClient.Do(req)
 	if err != nil {
-		return NewNetworkError("metering request failed", err)
+		return 0, NewNetworkError("metering request failed", err)
 	}
 	defer resp.Body.Close()
 
 	// Read response
 	body, _ := io.ReadAll(resp.Body)
 
-	logResponse(resp.StatusCode, string(body))
+	logResponse(ctx, resp.StatusCode, string(body))
 
 	// Check status
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
-			return NewValidationError(
+			return resp.StatusCode, NewValidationError(
 				fmt.Sprintf("metering API returned %d: %s", resp.StatusCode, string(body)),
 				nil,
 			)
 		}
-		return NewMeteringError(
+		return resp.StatusCode, NewMeteringError(
 			fmt.Sprintf("metering API error: %d", resp.StatusCode),
 			fmt.Errorf("status %d: %s", resp.StatusCode, string(body)),
 		)
 	}
 
 	Info("Metering data sent successfully")
-	return nil
+	return resp.StatusCode, nil
+}
+
+// encodeJSON marshals v like json.Marshal, optionally without escaping <, >,
+// and & as \u003c, \u003e, and \u0026
+func encodeJSON(v interface{}, escapeHTML bool) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(escapeHTML)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	// Encode terminates the value with a newline; json.Marshal does not
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// transactionSeq disambiguates transaction IDs generated within the same clock tick
+var transactionSeq uint64
+
+// applySampling decides whether a payload is kept under the given sample rate,
+// using roll (a uniform random value in [0, 1)) as the coin flip. Kept payloads
+// have their image counts, video durations, and cost scaled by 1/rate so
+// aggregates are preserved.
+func applySampling(payload *MeteringPayload, rate, roll float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if roll >= rate {
+		return false
+	}
+
+	scale := 1 / rate
+	payload.ActualImageCount = scaleInt(payload.ActualImageCount, scale)
+	payload.RequestedImageCount = scaleInt(payload.RequestedImageCount, scale)
+	payload.DurationSeconds = scaleFloat(payload.DurationSeconds, scale)
+	payload.RequestedDurationSeconds = scaleFloat(payload.RequestedDurationSeconds, scale)
+	payload.TotalCost = scaleFloat(payload.TotalCost, scale)
+	payload.Credits = scaleFloat(payload.Credits, scale)
+	payload.InferenceSeconds = scaleFloat(payload.InferenceSeconds, scale)
+	payload.setAttribute("sampled", rate)
+	return true
+}
+
+// scaleInt returns value multiplied by scale and rounded, or nil if value is nil
+func scaleInt(value *int, scale float64) *int {
+	if value == nil {
+		return nil
+	}
+	scaled := int(math.Round(float64(*value) * scale))
+	return &scaled
+}
+
+// scaleFloat returns value multiplied by scale, or nil if value is nil
+func scaleFloat(value *float64, scale float64) *float64 {
+	if value == nil {
+		return nil
+	}
+	scaled := *value * scale
+	return &scaled
+}
+
+// sanitizeJSONMap returns m without any values that cannot be JSON-encoded
+// (functions, channels, cyclic structures, ...), logging a warning naming each
+// dropped key. The input map is never modified; it is returned as-is when all
+// values serialize.
+func sanitizeJSONMap(name string, m map[string]interface{}) map[string]interface{} {
+	var bad []string
+	for k, v := range m {
+		if _, err := json.Marshal(v); err != nil {
+			Warn("Dropping %s[%q] from metering payload: value is not JSON-serializable (%T): %v", name, k, v, err)
+			bad = append(bad, k)
+		}
+	}
+	if len(bad) == 0 {
+		return m
+	}
+
+	sanitized := make(map[string]interface{}, len(m)-len(bad))
+	for k, v := range m {
+		sanitized[k] = v
+	}
+	for _, k := range bad {
+		delete(sanitized, k)
+	}
+	return sanitized
 }
 
 // generateTransactionID generates a unique transaction ID
 func generateTransactionID() string {
-	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), time.Now().UnixNano()%1000)
+	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), atomic.AddUint64(&transactionSeq, 1)%1000)
 }
 
 // MaxPromptLength is the maximum length for captured prompts (in runes).
@@ -164,26 +440,33 @@ const TruncationSuffix = "...[TRUNCATED]"
 //   - JSON string: The formatted inputMessages JSON
 //   - bool: true if the prompt was truncated (exceeded MaxPromptLength)
 func formatPromptAsInputMessages(prompt string) (string, bool) {
+	return formatInputMessages(prompt, "", true)
+}
+
+// formatInputMessages formats a prompt and optional negative prompt as JSON
+// inputMessages. The negative prompt is a separate message with role
+// "negative", so it stays distinct from the positive prompt:
+//
+//	[{"role": "user", "content": "<prompt>"}, {"role": "negative", "content": "<negative prompt>"}]
+//
+// escapeHTML matches the encoding of the enclosing payload (see
+// WithDisableHTMLEscaping).
+func formatInputMessages(prompt, negativePrompt string, escapeHTML bool) (string, bool) {
 	if prompt == "" {
 		return "", false
 	}
 
-	truncated := false
-	runeCount := utf8.RuneCountInString(prompt)
-	if runeCount > MaxPromptLength {
-		// Truncate to MaxPromptLength minus suffix length to ensure final output doesn't exceed limit
-		truncateAt := MaxPromptLength - utf8.RuneCountInString(TruncationSuffix)
-		// Convert to rune slice for proper Unicode handling
-		runes := []rune(prompt)
-		prompt = string(runes[:truncateAt]) + TruncationSuffix
-		truncated = true
-	}
-
+	prompt, truncated := truncatePrompt(prompt)
 	messages := []map[string]string{
 		{"role": "user", "content": prompt},
 	}
+	if negativePrompt != "" {
+		negativePrompt, negativeTruncated := truncatePrompt(negativePrompt)
+		truncated = truncated || negativeTruncated
+		messages = append(messages, map[string]string{"role": "negative", "content": negativePrompt})
+	}
 
-	jsonBytes, err := json.Marshal(messages)
+	jsonBytes, err := encodeJSON(messages, escapeHTML)
 	if err != nil {
 		Warn("Failed to serialize prompt as inputMessages: %v", err)
 		return "", truncated
@@ -192,6 +475,96 @@ func formatPromptAsInputMessages(prompt string) (string, bool) {
 	return string(jsonBytes), truncated
 }
 
+// capturedPrompt is a prompt captured for a payload, kept raw until delivery.
+// Each payload owns its own, so copies of a payload must not share one.
+type capturedPrompt struct {
+	// mu serializes formatting, which both delivery and Drain may do for the
+	// same in-flight payload
+	mu             sync.Mutex
+	formatted      bool
+	prompt         string
+	negativePrompt string
+}
+
+// formatCapturedPrompt formats the payload's captured prompt into
+// InputMessages. Formatting is deferred until just before the payload is sent,
+// so payloads that are sampled out, cancelled, or dropped never pay for it.
+func (p *MeteringPayload) formatCapturedPrompt(escapeHTML bool) {
+	captured := p.capturedPrompt
+	if captured == nil {
+		return
+	}
+	captured.mu.Lock()
+	defer captured.mu.Unlock()
+	if captured.formatted {
+		return
+	}
+	captured.formatted = true
+
+	inputMessages, truncated := formatInputMessages(captured.prompt, captured.negativePrompt, escapeHTML)
+	captured.prompt, captured.negativePrompt = "", ""
+	if inputMessages != "" {
+		p.InputMessages = inputMessages
+	}
+	if truncated {
+		p.PromptsTruncated = true
+	}
+}
+
+// truncatePrompt limits a prompt to MaxPromptLength characters, reporting
+// whether it was truncated
+func truncatePrompt(prompt string) (string, bool) {
+	if utf8.RuneCountInString(prompt) <= MaxPromptLength {
+		return prompt, false
+	}
+	// Truncate to MaxPromptLength minus suffix length to ensure final output doesn't exceed limit
+	truncateAt := MaxPromptLength - utf8.RuneCountInString(TruncationSuffix)
+	// Convert to rune slice for proper Unicode handling
+	runes := []rune(prompt)
+	return string(runes[:truncateAt]) + TruncationSuffix, true
+}
+
+// setAttribute sets a payload attribute, initializing the map if needed
+func (p *MeteringPayload) setAttribute(key string, value interface{}) {
+	if p.Attributes == nil {
+		p.Attributes = make(map[string]interface{})
+	}
+	p.Attributes[key] = value
+}
+
+// cancelled reports whether the payload's WithMeteringCancellation context is done
+func (p *MeteringPayload) cancelled() bool {
+	return p.cancel != nil && p.cancel.Err() != nil
+}
+
+// requestParamsAttribute serializes a Fal request into a structured attribute
+// value for the "falRequest" attribute. The prompt is only included when prompt
+// capture is enabled, so enabling request capture never leaks prompt text.
+func requestParamsAttribute(request *FalRequest, includePrompt bool) map[string]interface{} {
+	if request == nil {
+		return nil
+	}
+
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		Warn("Failed to serialize Fal request for metering: %v", err)
+		return nil
+	}
+
+	var params map[string]interface{}
+	if err := json.Unmarshal(requestJSON, &params); err != nil {
+		Warn("Failed to serialize Fal request for metering: %v", err)
+		return nil
+	}
+
+	if !includePrompt {
+		delete(params, "prompt")
+		delete(params, "negative_prompt")
+	}
+
+	return params
+}
+
 // normalizeModelName ensures the model name follows the LiteLLM naming convention
 // used by the Revenium backend: "fal_ai/{fal_endpoint_id}".
 //
@@ -204,44 +577,364 @@ func formatPromptAsInputMessages(prompt string) (string, bool) {
 //	"fal-ai/flux/dev"            → "fal_ai/fal-ai/flux/dev"
 //	"fal_ai/fal-ai/flux/dev"    → "fal_ai/fal-ai/flux/dev" (already correct)
 //	"fal_ai/flux/dev"            → "fal_ai/fal-ai/flux/dev" (missing inner segment)
+//
+// Names that need more than the fal_ai/ prefix are logged once per client;
+// see ReveniumFal.warnModelName.
 func normalizeModelName(model string) string {
+	normalized, _ := normalizeModel(model)
+	return normalized
+}
+
+// normalizeModel normalizes a model name like normalizeModelName and also
+// returns a warning when the name is missing its fal-ai/ segment
+func normalizeModel(model string) (normalized, warning string) {
 	const litellmPrefix = "fal_ai/"
 	const falEndpointPrefix = "fal-ai/"
 
 	// Already in full LiteLLM format (fal_ai/fal-ai/...)
 	if strings.HasPrefix(model, litellmPrefix+falEndpointPrefix) {
-		return model
+		return model, ""
 	}
 
 	// Has fal_ai/ prefix but missing fal-ai/ segment (e.g., "fal_ai/flux/dev")
 	if strings.HasPrefix(model, litellmPrefix) {
 		remainder := strings.TrimPrefix(model, litellmPrefix)
-		Warn("Model name '%s' has 'fal_ai/' prefix but missing 'fal-ai/' segment. Auto-normalizing.", model)
-		return litellmPrefix + falEndpointPrefix + remainder
+		return litellmPrefix + falEndpointPrefix + remainder,
+			fmt.Sprintf("Model name '%s' has 'fal_ai/' prefix but missing 'fal-ai/' segment. Auto-normalizing.", model)
 	}
 
 	// Has fal-ai/ endpoint prefix but not litellm prefix - prepend fal_ai/
 	if strings.HasPrefix(model, falEndpointPrefix) {
-		return litellmPrefix + model
+		return litellmPrefix + model, ""
 	}
 
 	// Bare model name (e.g., "flux/dev") - add both prefixes
-	Warn("Model name '%s' is missing 'fal-ai/' prefix. Auto-normalizing to '%s%s%s'",
-		model, litellmPrefix, falEndpointPrefix, model)
-	return litellmPrefix + falEndpointPrefix + model
+	return litellmPrefix + falEndpointPrefix + model,
+		fmt.Sprintf("Model name '%s' is missing 'fal-ai/' prefix. Auto-normalizing to '%s%s%s'",
+			model, litellmPrefix, falEndpointPrefix, model)
+}
+
+// Model pricing tiers recorded in attributes["modelTier"]
+const (
+	ModelTierFast     = "fast"
+	ModelTierStandard = "standard"
+	ModelTierPro      = "pro"
+	ModelTierUnknown  = "unknown"
+)
+
+// modelTiers maps Fal endpoint prefixes to their pricing tier
+var modelTiers = []struct {
+	prefix string
+	tier   string
+}{
+	{"fal-ai/flux/schnell", ModelTierFast},
+	{"fal-ai/flux/dev", ModelTierStandard},
+	{"fal-ai/flux-pro", ModelTierPro},
+}
+
+// DefaultModelTier classifies a Fal endpoint ID (e.g. "fal-ai/flux/dev") into
+// its pricing tier: flux/schnell is "fast", flux/dev is "standard", and the
+// flux-pro family is "pro". Other models are "unknown". Short and LiteLLM-style
+// names are accepted, so "flux/dev" and "fal_ai/fal-ai/flux/dev" are
+// classified the same way.
+func DefaultModelTier(model string) string {
+	endpoint := strings.TrimPrefix(model, "fal_ai/")
+	if !strings.HasPrefix(endpoint, "fal-ai/") {
+		endpoint = "fal-ai/" + endpoint
+	}
+	for _, t := range modelTiers {
+		if endpoint == t.prefix || strings.HasPrefix(endpoint, t.prefix+"/") {
+			return t.tier
+		}
+	}
+	return ModelTierUnknown
+}
+
+// canonicalMetadataKeys maps the lowercased form of each recognized metadata
+// key to its canonical casing
+var canonicalMetadataKeys = func() map[string]string {
+	keys := []string{
+		"organizationName", "productName", "organizationId", "productId",
+		"taskType", "agent", "subscriptionId", "traceId", "parentTransactionId",
+		"traceType", "traceName", "environment", "region", "retryNumber",
+		"credentialAlias", "subscriber", "taskId", "videoJobId", "audioJobId",
+		"responseQualityScore", "totalCost", "provider", "modelSource",
+		"costType", "tags",
+	}
+	canonical := make(map[string]string, len(keys))
+	for _, key := range keys {
+		canonical[strings.ToLower(key)] = key
+	}
+	return canonical
+}()
+
+// canonicalizeMetadataKeys returns metadata with recognized keys given in
+// another casing (e.g. "organizationID", "traceID") renamed to their
+// canonical casing, so they aren't silently ignored. When both casings are
+// present with different values, the canonical key wins with a warning.
+// metadata itself is never modified.
+func canonicalizeMetadataKeys(metadata map[string]interface{}) map[string]interface{} {
+	var variants []string
+	for key := range metadata {
+		if canonical, ok := canonicalMetadataKeys[strings.ToLower(key)]; ok && key != canonical {
+			variants = append(variants, key)
+		}
+	}
+	if len(variants) == 0 {
+		return metadata
+	}
+	sort.Strings(variants) // Deterministic winner among several variants
+
+	normalized := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		normalized[k] = v
+	}
+	for _, key := range variants {
+		canonical := canonicalMetadataKeys[strings.ToLower(key)]
+		value := normalized[key]
+		delete(normalized, key)
+		if existing, ok := normalized[canonical]; ok {
+			if !reflect.DeepEqual(existing, value) {
+				Warn("Ignoring metadata key %q: %q is already set to a different value", key, canonical)
+			}
+			continue
+		}
+		normalized[canonical] = value
+	}
+	return normalized
+}
+
+// applyUsageMetadata copies recognized usage metadata fields onto the payload
+func applyUsageMetadata(payload *MeteringPayload, metadata map[string]interface{}) {
+	if metadata == nil {
+		return
+	}
+	metadata = canonicalizeMetadataKeys(metadata)
+
+	// New preferred names
+	if orgName, ok := metadata["organizationName"].(string); ok {
+		payload.OrganizationName = orgName
+	}
+	if productName, ok := metadata["productName"].(string); ok {
+		payload.ProductName = productName
+	}
+	// Deprecated fields (kept for backward compatibility)
+	if orgID, ok := metadata["organizationId"].(string); ok {
+		payload.OrganizationID = orgID
+	}
+	if productID, ok := metadata["productId"].(string); ok {
+		payload.ProductID = productID
+	}
+	if taskType, ok := metadata["taskType"].(string); ok {
+		payload.TaskType = taskType
+	}
+	if agent, ok := metadata["agent"].(string); ok {
+		payload.Agent = agent
+	}
+	if subscriptionID, ok := metadata["subscriptionId"].(string); ok {
+		payload.SubscriptionID = subscriptionID
+	}
+	if traceID, ok := metadata["traceId"].(string); ok {
+		payload.TraceID = traceID
+	}
+	// Distributed tracing fields
+	if parentTransactionID, ok := metadata["parentTransactionId"].(string); ok {
+		payload.ParentTransactionID = parentTransactionID
+	}
+	if traceType, ok := metadata["traceType"].(string); ok {
+		payload.TraceType = traceType
+	}
+	if traceName, ok := metadata["traceName"].(string); ok {
+		payload.TraceName = traceName
+	}
+	if environment, ok := metadata["environment"].(string); ok {
+		payload.Environment = environment
+	}
+	if region, ok := metadata["region"].(string); ok {
+		payload.Region = region
+	}
+	if retryNumber, ok := metadata["retryNumber"].(int); ok {
+		payload.RetryNumber = &retryNumber
+	}
+	if credentialAlias, ok := metadata["credentialAlias"].(string); ok {
+		payload.CredentialAlias = credentialAlias
+	}
+	if subscriber, ok := metadata["subscriber"].(map[string]interface{}); ok {
+		// Copied so a caller reusing its map can't change a queued payload
+		payload.Subscriber = copyMetadataMap(subscriber)
+	}
+	if taskID, ok := metadata["taskId"].(string); ok {
+		payload.TaskID = taskID
+	}
+	if videoJobID, ok := metadata["videoJobId"].(string); ok {
+		payload.VideoJobID = videoJobID
+	}
+	if audioJobID, ok := metadata["audioJobId"].(string); ok {
+		payload.AudioJobID = audioJobID
+	}
+	if responseQualityScore, ok := metadata["responseQualityScore"].(float64); ok {
+		payload.ResponseQualityScore = &responseQualityScore
+	}
+	// Cost override - allows custom pricing when provider pricing unavailable
+	// Handle both float64 and int to avoid silent failures with integer literals
+	if totalCost, ok := metadata["totalCost"].(float64); ok {
+		payload.TotalCost = &totalCost
+	} else if totalCostInt, ok := metadata["totalCost"].(int); ok {
+		totalCostFloat := float64(totalCostInt)
+		payload.TotalCost = &totalCostFloat
+	}
+
+	// Provider/ModelSource overrides (e.g. calls proxied through a reseller)
+	if provider, ok := overrideString(metadata, "provider"); ok {
+		payload.Provider = provider
+	}
+	if modelSource, ok := overrideString(metadata, "modelSource"); ok {
+		payload.ModelSource = modelSource
+	}
+	if costType, ok := overrideString(metadata, "costType"); ok {
+		payload.CostType = costType
+	}
+	if tags := metadataTags(metadata["tags"]); tags != nil {
+		payload.setAttribute("tags", tags)
+	}
+}
+
+// copyMetadataMap deep-copies nested maps and slices of a metadata map.
+// Other values are copied as-is.
+func copyMetadataMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	copied := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		copied[k] = copyMetadataValue(v)
+	}
+	return copied
+}
+
+func copyMetadataValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		return copyMetadataMap(value)
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for i, item := range value {
+			copied[i] = copyMetadataValue(item)
+		}
+		return copied
+	case map[string]string:
+		copied := make(map[string]string, len(value))
+		for k, s := range value {
+			copied[k] = s
+		}
+		return copied
+	case []string:
+		return append([]string(nil), value...)
+	default:
+		return v
+	}
+}
+
+// metadataTags converts a "tags" metadata value (map[string]string or
+// map[string]interface{} with string values) into cost-allocation tags.
+// Non-string tag values are dropped with a warning.
+func metadataTags(raw interface{}) map[string]string {
+	switch value := raw.(type) {
+	case map[string]string:
+		if len(value) == 0 {
+			return nil
+		}
+		tags := make(map[string]string, len(value))
+		for k, v := range value {
+			tags[k] = v
+		}
+		return tags
+	case map[string]interface{}:
+		tags := make(map[string]string, len(value))
+		for k, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				Warn("Ignoring tag %q: expected a string value, got %v", k, v)
+				continue
+			}
+			tags[k] = s
+		}
+		if len(tags) == 0 {
+			return nil
+		}
+		return tags
+	case nil:
+		return nil
+	default:
+		Warn("Ignoring metadata \"tags\": expected a map of strings, got %T", raw)
+		return nil
+	}
+}
+
+// mergeCostAllocationTags adds client-level tags to the payload's "tags"
+// attribute, keeping any per-request tag with the same key
+func mergeCostAllocationTags(payload *MeteringPayload, clientTags map[string]string) {
+	if len(clientTags) == 0 {
+		return
+	}
+	requestTags, _ := payload.Attributes["tags"].(map[string]string)
+	tags := make(map[string]string, len(clientTags)+len(requestTags))
+	for k, v := range clientTags {
+		tags[k] = v
+	}
+	for k, v := range requestTags {
+		tags[k] = v
+	}
+	payload.setAttribute("tags", tags)
+}
+
+// overrideString returns a metadata value that overrides a payload default.
+// Values that are not non-empty strings are ignored with a warning so a bad
+// override never blanks out a required payload field.
+func overrideString(metadata map[string]interface{}, key string) (string, bool) {
+	raw, exists := metadata[key]
+	if !exists {
+		return "", false
+	}
+	value, ok := raw.(string)
+	if !ok || strings.TrimSpace(value) == "" {
+		Warn("Ignoring metadata %q override: expected a non-empty string, got %v", key, raw)
+		return "", false
+	}
+	return value, true
+}
+
+// clampDuration returns zero for a negative duration, logging a warning, so a
+// payload's ResponseTime is never before its RequestTime. Durations measured
+// with time.Since on a time.Now start are monotonic and can't go negative, but
+// a start time without a monotonic reading is exposed to host clock steps
+// (e.g. an NTP adjustment) and Revenium may reject the reversed times.
+func clampDuration(duration time.Duration) time.Duration {
+	if duration < 0 {
+		Warn("Negative request duration %v (host clock adjusted?); clamping ResponseTime to RequestTime", duration)
+		return 0
+	}
+	return duration
 }
 
-// buildImageMeteringPayload builds a metering payload for image generation
+// buildImageMeteringPayload builds a metering payload for image generation.
+// requestedImageCount is the request's NumImages; when zero (unset), the
+// requested count defaults to the number of images returned.
 func buildImageMeteringPayload(
 	model string,
 	imageResp *FalImageResponse,
 	metadata map[string]interface{},
 	duration time.Duration,
 	requestTime time.Time,
+	requestedImageCount int,
 	capturePrompts bool,
+	captureOutputs bool,
 	prompt string,
+	negativePrompt string,
 	outputURLs []string,
+	escapeHTML bool,
 ) *MeteringPayload {
+	duration = clampDuration(duration)
 	payload := &MeteringPayload{
 		StopReason:       "END",
 		CostType:         "AI",
@@ -260,7 +953,11 @@ func buildImageMeteringPayload(
 	if imageResp != nil {
 		imageCount := len(imageResp.Images)
 		payload.ActualImageCount = &imageCount
-		payload.RequestedImageCount = &imageCount // Same as actual for Fal
+		// Fal may return fewer images than requested (partial success)
+		if requestedImageCount <= 0 {
+			requestedImageCount = imageCount
+		}
+		payload.RequestedImageCount = &requestedImageCount
 
 		// Image dimensions go in attributes (metadata, not billing)
 		if len(imageResp.Images) > 0 {
@@ -268,104 +965,461 @@ func buildImageMeteringPayload(
 				"width":  imageResp.Images[0].Width,
 				"height": imageResp.Images[0].Height,
 			}
+			if class := aspectClass(imageResp.Images[0].Width, imageResp.Images[0].Height); class != "" {
+				payload.Attributes["aspectClass"] = class
+			}
+		}
+		if images := imageSeedAttributes(imageResp.Images); images != nil {
+			payload.Attributes["images"] = images
 		}
+
+		applyCredits(payload, imageResp.Credits, imageResp.Cost)
+		applyInferenceTime(payload, imageResp.InferenceTime)
 	}
 
 	// Add metadata fields
-	if metadata != nil {
-		// New preferred names
-		if orgName, ok := metadata["organizationName"].(string); ok {
-			payload.OrganizationName = orgName
+	applyUsageMetadata(payload, metadata)
+
+	// Add prompt capture fields when enabled (opt-in)
+	if capturePrompts && prompt != "" {
+		payload.capturedPrompt = &capturedPrompt{prompt: prompt, negativePrompt: negativePrompt}
+		Debug("Prompt capture enabled: captured %d chars", len(prompt))
+	}
+
+	// Output response contains the generated image URL(s)
+	if captureOutputs && len(outputURLs) > 0 {
+		outputJSON, err := encodeJSON(outputURLs, escapeHTML)
+		if err == nil {
+			payload.OutputResponse = string(outputJSON)
 		}
-		if productName, ok := metadata["productName"].(string); ok {
-			payload.ProductName = productName
+		Debug("Output capture enabled: output %d URLs", len(outputURLs))
+	}
+
+	return payload
+}
+
+// clampQualityScore coerces ResponseQualityScore into [0.0, 1.0], the range
+// Revenium accepts
+func clampQualityScore(payload *MeteringPayload) {
+	if payload.ResponseQualityScore == nil {
+		return
+	}
+	score := *payload.ResponseQualityScore
+	clamped := math.Max(0, math.Min(1, score))
+	if clamped != score {
+		Debug("Clamped responseQualityScore %v to %v for transaction %s", score, clamped, payload.TransactionID)
+		payload.ResponseQualityScore = &clamped
+	}
+}
+
+// applyCredits records Fal credits consumed, preferring the response's
+// "credits" field over its "cost" field. Credits are recorded as-is; the
+// credit-to-dollar conversion happens server-side.
+func applyCredits(payload *MeteringPayload, credits, cost *float64) {
+	if credits == nil {
+		credits = cost
+	}
+	if credits == nil {
+		return
+	}
+	value := *credits
+	payload.Credits = &value
+	payload.setAttribute("credits", value)
+}
+
+// applyInferenceTime records the GPU seconds reported by compute-billed
+// endpoints, also as an attribute for backends that ignore the field
+func applyInferenceTime(payload *MeteringPayload, inferenceTime *float64) {
+	if inferenceTime == nil {
+		return
+	}
+	value := *inferenceTime
+	payload.InferenceSeconds = &value
+	payload.setAttribute("inferenceSeconds", value)
+}
+
+// stopReasonForError maps a failed Fal call to a metering stop reason
+func stopReasonForError(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "TIMEOUT"
+	}
+	return "ERROR"
+}
+
+// Error categories recorded in attributes["errorCategory"] for failed calls
+// metered with WithMeterErrors
+const (
+	ErrorCategoryProvider4xx = "provider_4xx"
+	ErrorCategoryProvider5xx = "provider_5xx"
+	ErrorCategoryNetwork     = "network"
+	ErrorCategoryTimeout     = "timeout"
+	ErrorCategoryValidation  = "validation"
+	ErrorCategoryUnknown     = "unknown"
+)
+
+// errorCategory classifies a failed Fal call from its typed error. Deadline
+// expiry is a timeout whatever error wraps it; provider errors without an
+// HTTP status (e.g. an unparseable response) count as provider_5xx.
+func errorCategory(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorCategoryTimeout
+	}
+	var revErr *ReveniumError
+	if !errors.As(err, &revErr) {
+		return ErrorCategoryUnknown
+	}
+	switch revErr.Type {
+	case ErrorTypeProvider, ErrorTypeAuth:
+		if revErr.StatusCode >= 400 && revErr.StatusCode < 500 || revErr.Type == ErrorTypeAuth {
+			return ErrorCategoryProvider4xx
 		}
-		// Deprecated fields (kept for backward compatibility)
-		if orgID, ok := metadata["organizationId"].(string); ok {
-			payload.OrganizationID = orgID
+		return ErrorCategoryProvider5xx
+	case ErrorTypeNetwork:
+		return ErrorCategoryNetwork
+	case ErrorTypeValidation, ErrorTypeConfig:
+		return ErrorCategoryValidation
+	}
+	return ErrorCategoryUnknown
+}
+
+// maxErrorMessageLength bounds attributes["errorMessage"]
+const maxErrorMessageLength = 500
+
+// Patterns for secrets that may appear in error messages
+var (
+	credentialPattern  = regexp.MustCompile(`(?i)\b(key|bearer|token)(\s*[:=]?\s*)[A-Za-z0-9._~+/:-]{8,}`)
+	reveniumKeyPattern = regexp.MustCompile(`hak_[A-Za-z0-9_-]+`)
+	urlPattern         = regexp.MustCompile(`https?://[^\s"']+`)
+)
+
+// redactErrorMessage strips credentials, URL userinfo, and query strings
+// from an error message and truncates it to maxErrorMessageLength
+func redactErrorMessage(message string) string {
+	message = urlPattern.ReplaceAllStringFunc(message, redactURLQuery)
+	message = reveniumKeyPattern.ReplaceAllString(message, "[REDACTED]")
+	message = credentialPattern.ReplaceAllString(message, "${1}${2}[REDACTED]")
+	if runes := []rune(message); len(runes) > maxErrorMessageLength {
+		message = string(runes[:maxErrorMessageLength]) + TruncationSuffix
+	}
+	return message
+}
+
+// redactURLQuery strips userinfo, the query string (which carries presigned
+// credentials), and the fragment from a URL for logging. Inline data URIs are
+// replaced outright.
+func redactURLQuery(raw string) string {
+	if strings.HasPrefix(raw, "data:") {
+		return "[data URI]"
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[URL]"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// applyDurationSource overrides RequestDuration with Fal's processing time
+// (timeTaken, in seconds) when that source is selected. Zero processing time
+// leaves the wall-clock duration in place.
+func applyDurationSource(payload *MeteringPayload, source DurationSource, timeTaken float64) {
+	if source != DurationSourceProcessingTime {
+		return
+	}
+	if timeTaken <= 0 {
+		Warn("Processing-time duration selected but Fal reported no timeTaken for transaction %s; using wall-clock duration", payload.TransactionID)
+		return
+	}
+	payload.RequestDuration = int64(math.Round(timeTaken * 1000))
+}
+
+// contentTypeAliases maps non-canonical MIME types reported for outputs to
+// their canonical form
+var contentTypeAliases = map[string]string{
+	"image/jpg":    "image/jpeg",
+	"image/pjpeg":  "image/jpeg",
+	"image/x-png":  "image/png",
+	"image/x-webp": "image/webp",
+	"video/x-mp4":  "video/mp4",
+	"video/mov":    "video/quicktime",
+}
+
+// contentTypeByExtension infers the MIME type of an output from its URL when
+// Fal omits content_type
+var contentTypeByExtension = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".webp": "image/webp",
+	".gif":  "image/gif",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".mov":  "video/quicktime",
+}
+
+// normalizeContentType returns the canonical MIME type of an output: the
+// reported type lowercased, without parameters, and with known aliases
+// resolved, or the type implied by the URL's extension when none was
+// reported. Unknown types pass through lowercased; "" means undetermined.
+func normalizeContentType(contentType, outputURL string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		if u, err := url.Parse(outputURL); err == nil {
+			return contentTypeByExtension[strings.ToLower(path.Ext(u.Path))]
 		}
-		if productID, ok := metadata["productId"].(string); ok {
-			payload.ProductID = productID
+		return ""
+	}
+	if canonical, ok := contentTypeAliases[mediaType]; ok {
+		return canonical
+	}
+	return mediaType
+}
+
+// presignedDateLayout is the timestamp format of X-Amz-Date and X-Goog-Date
+const presignedDateLayout = "20060102T150405Z"
+
+// outputURLExpiry parses the expiry of a presigned output URL from its query
+// parameters, reporting false when the URL carries no recognizable expiry
+func outputURLExpiry(rawURL string) (time.Time, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" {
+		return time.Time{}, false
+	}
+	// Parameter names are matched case-insensitively
+	params := make(map[string]string)
+	for key, values := range u.Query() {
+		if len(values) > 0 {
+			params[strings.ToLower(key)] = values[0]
 		}
-		if taskType, ok := metadata["taskType"].(string); ok {
-			payload.TaskType = taskType
+	}
+
+	// Signed-at time plus lifetime: AWS SigV4 and GCS V4
+	for _, prefix := range []string{"x-amz-", "x-goog-"} {
+		date, hasDate := params[prefix+"date"]
+		expires, hasExpires := params[prefix+"expires"]
+		if !hasDate || !hasExpires {
+			continue
 		}
-		if agent, ok := metadata["agent"].(string); ok {
-			payload.Agent = agent
+		signedAt, err := time.Parse(presignedDateLayout, date)
+		seconds, convErr := strconv.ParseInt(expires, 10, 64)
+		if err == nil && convErr == nil && seconds > 0 {
+			return signedAt.Add(time.Duration(seconds) * time.Second), true
 		}
-		if subscriptionID, ok := metadata["subscriptionId"].(string); ok {
-			payload.SubscriptionID = subscriptionID
+	}
+
+	// Absolute Unix time: AWS SigV2, GCS V2, and CloudFront
+	if expires, ok := params["expires"]; ok {
+		if seconds, err := strconv.ParseInt(expires, 10, 64); err == nil && seconds > 0 {
+			return time.Unix(seconds, 0), true
 		}
-		if traceID, ok := metadata["traceId"].(string); ok {
-			payload.TraceID = traceID
+	}
+
+	// Absolute RFC 3339 time: Azure SAS signed expiry
+	if se, ok := params["se"]; ok {
+		if expiresAt, err := time.Parse(time.RFC3339, se); err == nil {
+			return expiresAt, true
 		}
-		// Distributed tracing fields
-		if parentTransactionID, ok := metadata["parentTransactionId"].(string); ok {
-			payload.ParentTransactionID = parentTransactionID
+	}
+	return time.Time{}, false
+}
+
+// earliestOutputExpiry returns the earliest parseable expiry among urls
+func earliestOutputExpiry(urls []string) (time.Time, bool) {
+	var earliest time.Time
+	for _, u := range urls {
+		if expiresAt, ok := outputURLExpiry(u); ok && (earliest.IsZero() || expiresAt.Before(earliest)) {
+			earliest = expiresAt
 		}
-		if traceType, ok := metadata["traceType"].(string); ok {
-			payload.TraceType = traceType
+	}
+	return earliest, !earliest.IsZero()
+}
+
+// imageSeedAttributes describes each image, including its seed, for the
+// "images" attribute so a specific variation can be reproduced. It returns nil
+// when no image reports a seed.
+func imageSeedAttributes(images []FalImage) []map[string]interface{} {
+	hasSeed := false
+	for _, img := range images {
+		if img.Seed != nil {
+			hasSeed = true
+			break
 		}
-		if traceName, ok := metadata["traceName"].(string); ok {
-			payload.TraceName = traceName
+	}
+	if !hasSeed {
+		return nil
+	}
+
+	attrs := make([]map[string]interface{}, len(images))
+	for i, img := range images {
+		attrs[i] = map[string]interface{}{
+			"index":  i,
+			"width":  img.Width,
+			"height": img.Height,
 		}
-		if environment, ok := metadata["environment"].(string); ok {
-			payload.Environment = environment
+		if class := aspectClass(img.Width, img.Height); class != "" {
+			attrs[i]["aspectClass"] = class
 		}
-		if region, ok := metadata["region"].(string); ok {
-			payload.Region = region
+		if img.Seed != nil {
+			attrs[i]["seed"] = *img.Seed
 		}
-		if retryNumber, ok := metadata["retryNumber"].(int); ok {
-			payload.RetryNumber = &retryNumber
+	}
+	return attrs
+}
+
+// Aspect ratio classes recorded in attributes["aspectClass"] for images
+const (
+	AspectClassSquare    = "square"
+	AspectClassLandscape = "landscape"
+	AspectClassPortrait  = "portrait"
+	AspectClassUltrawide = "ultrawide"
+)
+
+// Width/height ratio bounds between aspect classes. Ratios within 10% of 1:1
+// count as square; 2:1 and wider (e.g. 21:9) as ultrawide.
+const (
+	squareAspectTolerance = 1.1
+	ultrawideAspectRatio  = 2.0
+)
+
+// aspectClass classifies an image's aspect ratio from its dimensions,
+// returning "" when either dimension is unknown (zero or negative)
+func aspectClass(width, height int) string {
+	if width <= 0 || height <= 0 {
+		return ""
+	}
+	ratio := float64(width) / float64(height)
+	switch {
+	case ratio >= ultrawideAspectRatio:
+		return AspectClassUltrawide
+	case ratio > squareAspectTolerance:
+		return AspectClassLandscape
+	case ratio >= 1/squareAspectTolerance:
+		return AspectClassSquare
+	default:
+		return AspectClassPortrait
+	}
+}
+
+// videoSegmentSeconds returns the combined duration of a segmented video
+// response, or 0 when it has no segments with a known duration
+func videoSegmentSeconds(videoResp *FalVideoResponse) float64 {
+	if videoResp == nil {
+		return 0
+	}
+	var total float64
+	for _, segment := range videoResp.Segments {
+		total += segment.Duration
+	}
+	return total
+}
+
+// splitImageMeteringPayload splits an aggregated image payload into one payload
+// per generated image, for customers that bill each image as its own line item.
+// Each payload has ActualImageCount 1, its own TransactionID, and that image's
+// dimensions and URL. All payloads share the same TraceID; when the caller did
+// not supply one, the aggregated payload's TransactionID is used to link them.
+// A non-empty reservedID (the transaction ID reserved for the call, which other
+// records may already reference) becomes each payload's ParentTransactionID.
+func splitImageMeteringPayload(payload *MeteringPayload, images []FalImage, captureOutputs, escapeHTML bool, reservedID string, newTransactionID func() string) []*MeteringPayload {
+	if len(images) <= 1 {
+		return []*MeteringPayload{payload}
+	}
+
+	traceID := payload.TraceID
+	if traceID == "" {
+		traceID = payload.TransactionID
+	}
+
+	payloads := make([]*MeteringPayload, 0, len(images))
+	for i, img := range images {
+		p := *payload
+		one := 1
+		p.ActualImageCount = &one
+		p.RequestedImageCount = &one
+		p.TransactionID = newTransactionID()
+		p.TraceID = traceID
+		if captured := payload.capturedPrompt; captured != nil {
+			p.capturedPrompt = &capturedPrompt{prompt: captured.prompt, negativePrompt: captured.negativePrompt}
 		}
-		if credentialAlias, ok := metadata["credentialAlias"].(string); ok {
-			payload.CredentialAlias = credentialAlias
+		if reservedID != "" {
+			p.ParentTransactionID = reservedID
+		}
+
+		attrs := make(map[string]interface{}, len(payload.Attributes)+3)
+		for k, v := range payload.Attributes {
+			attrs[k] = v
 		}
-		if subscriber, ok := metadata["subscriber"].(map[string]interface{}); ok {
-			payload.Subscriber = subscriber
+		attrs["width"] = img.Width
+		attrs["height"] = img.Height
+		if class := aspectClass(img.Width, img.Height); class != "" {
+			attrs["aspectClass"] = class
+		} else {
+			delete(attrs, "aspectClass")
 		}
-		if taskID, ok := metadata["taskId"].(string); ok {
-			payload.TaskID = taskID
+		attrs["imageIndex"] = i
+		delete(attrs, "images")
+		if img.Seed != nil {
+			attrs["seed"] = *img.Seed
 		}
-		if videoJobID, ok := metadata["videoJobId"].(string); ok {
-			payload.VideoJobID = videoJobID
+		if hashes, ok := attrs["outputHashes"].([]string); ok && len(hashes) == len(images) {
+			attrs["outputHashes"] = []string{hashes[i]}
 		}
-		if audioJobID, ok := metadata["audioJobId"].(string); ok {
-			payload.AudioJobID = audioJobID
+		// Keep only this image's moderation labels when they are per image
+		if concepts, ok := attrs["nsfwConcepts"].(NSFWConcepts); ok && len(concepts) == len(images) {
+			attrs["nsfwConcepts"] = concepts[i]
 		}
-		if responseQualityScore, ok := metadata["responseQualityScore"].(float64); ok {
-			payload.ResponseQualityScore = &responseQualityScore
+		p.Attributes = attrs
+
+		// Split credits and inference time evenly so the per-image records
+		// add up to the total
+		if payload.Credits != nil {
+			credits := *payload.Credits / float64(len(images))
+			p.Credits = &credits
+			attrs["credits"] = credits
 		}
-		// Cost override - allows custom pricing when provider pricing unavailable
-		// Handle both float64 and int to avoid silent failures with integer literals
-		if totalCost, ok := metadata["totalCost"].(float64); ok {
-			payload.TotalCost = &totalCost
-		} else if totalCostInt, ok := metadata["totalCost"].(int); ok {
-			totalCostFloat := float64(totalCostInt)
-			payload.TotalCost = &totalCostFloat
+		if payload.InferenceSeconds != nil {
+			seconds := *payload.InferenceSeconds / float64(len(images))
+			p.InferenceSeconds = &seconds
+			attrs["inferenceSeconds"] = seconds
 		}
-	}
 
-	// Add prompt capture fields when enabled (opt-in)
-	if capturePrompts && prompt != "" {
-		inputMessages, truncated := formatPromptAsInputMessages(prompt)
-		if inputMessages != "" {
-			payload.InputMessages = inputMessages
-		}
-		if truncated {
-			payload.PromptsTruncated = true
-		}
-		// Output response contains the generated image URL(s)
-		if len(outputURLs) > 0 {
-			outputJSON, err := json.Marshal(outputURLs)
-			if err == nil {
-				payload.OutputResponse = string(outputJSON)
+		if captureOutputs && payload.OutputResponse != "" && img.URL != "" {
+			if outputJSON, err := encodeJSON([]string{img.URL}, escapeHTML); err == nil {
+				p.OutputResponse = string(outputJSON)
 			}
 		}
-		Debug("Prompt capture enabled: captured %d chars, output %d URLs", len(prompt), len(outputURLs))
+
+		payloads = append(payloads, &p)
 	}
 
-	return payload
+	return payloads
+}
+
+// videoOutputResponse formats the captured video output. When the response
+// carries a thumbnail or preview URL, a JSON object such as
+// {"video": "...", "thumbnail": "..."} is returned; otherwise the plain video
+// URL is returned, as before.
+func videoOutputResponse(videoURL string, videoResp *FalVideoResponse, escapeHTML bool) string {
+	if videoResp == nil || (videoResp.ThumbnailURL == "" && videoResp.PreviewURL == "") {
+		return videoURL
+	}
+
+	output := map[string]string{"video": videoURL}
+	if videoResp.ThumbnailURL != "" {
+		output["thumbnail"] = videoResp.ThumbnailURL
+	}
+	if videoResp.PreviewURL != "" {
+		output["preview"] = videoResp.PreviewURL
+	}
+
+	outputJSON, err := encodeJSON(output, escapeHTML)
+	if err != nil {
+		return videoURL
+	}
+	return string(outputJSON)
 }
 
 // buildVideoMeteringPayload builds a metering payload for video generation
@@ -377,9 +1431,12 @@ func buildVideoMeteringPayload(
 	requestTime time.Time,
 	requestedDuration string,
 	capturePrompts bool,
+	captureOutputs bool,
 	prompt string,
 	outputURL string,
+	escapeHTML bool,
 ) *MeteringPayload {
+	duration = clampDuration(duration)
 	payload := &MeteringPayload{
 		StopReason:       "END",
 		CostType:         "AI",
@@ -416,8 +1473,14 @@ func buildVideoMeteringPayload(
 		payload.RequestedDurationSeconds = &reqDurSeconds
 	}
 
-	// Set DurationSeconds from actual response, or fallback to requested
-	if videoResp != nil && videoResp.Video.Duration > 0 {
+	// Set DurationSeconds from actual response, or fallback to requested.
+	// A segmented clip lasts as long as its segments combined.
+	if segmentSeconds := videoSegmentSeconds(videoResp); segmentSeconds > 0 {
+		payload.DurationSeconds = &segmentSeconds
+		if payload.RequestedDurationSeconds == nil {
+			payload.RequestedDurationSeconds = &segmentSeconds
+		}
+	} else if videoResp != nil && videoResp.Video.Duration > 0 {
 		payload.DurationSeconds = &videoResp.Video.Duration
 		// If user didn't specify duration, use actual as fallback for requested
 		if payload.RequestedDurationSeconds == nil {
@@ -437,100 +1500,40 @@ func buildVideoMeteringPayload(
 		if videoResp.Video.Height > 0 {
 			attrs["height"] = videoResp.Video.Height
 		}
+		if len(videoResp.Segments) > 0 {
+			segments := make([]map[string]interface{}, len(videoResp.Segments))
+			for i, segment := range videoResp.Segments {
+				segments[i] = map[string]interface{}{"duration": segment.Duration}
+				// Segment URLs are outputs, so they follow output capture
+				if captureOutputs && segment.URL != "" {
+					segments[i]["url"] = segment.URL
+				}
+			}
+			attrs["segments"] = segments
+			attrs["segmentCount"] = len(segments)
+		}
 		if len(attrs) > 0 {
 			payload.Attributes = attrs
 		}
+
+		applyCredits(payload, videoResp.Credits, videoResp.Cost)
+		applyInferenceTime(payload, videoResp.InferenceTime)
 	}
 
 	// Add metadata fields
-	if metadata != nil {
-		// New preferred names
-		if orgName, ok := metadata["organizationName"].(string); ok {
-			payload.OrganizationName = orgName
-		}
-		if productName, ok := metadata["productName"].(string); ok {
-			payload.ProductName = productName
-		}
-		// Deprecated fields (kept for backward compatibility)
-		if orgID, ok := metadata["organizationId"].(string); ok {
-			payload.OrganizationID = orgID
-		}
-		if productID, ok := metadata["productId"].(string); ok {
-			payload.ProductID = productID
-		}
-		if taskType, ok := metadata["taskType"].(string); ok {
-			payload.TaskType = taskType
-		}
-		if agent, ok := metadata["agent"].(string); ok {
-			payload.Agent = agent
-		}
-		if subscriptionID, ok := metadata["subscriptionId"].(string); ok {
-			payload.SubscriptionID = subscriptionID
-		}
-		if traceID, ok := metadata["traceId"].(string); ok {
-			payload.TraceID = traceID
-		}
-		// Distributed tracing fields
-		if parentTransactionID, ok := metadata["parentTransactionId"].(string); ok {
-			payload.ParentTransactionID = parentTransactionID
-		}
-		if traceType, ok := metadata["traceType"].(string); ok {
-			payload.TraceType = traceType
-		}
-		if traceName, ok := metadata["traceName"].(string); ok {
-			payload.TraceName = traceName
-		}
-		if environment, ok := metadata["environment"].(string); ok {
-			payload.Environment = environment
-		}
-		if region, ok := metadata["region"].(string); ok {
-			payload.Region = region
-		}
-		if retryNumber, ok := metadata["retryNumber"].(int); ok {
-			payload.RetryNumber = &retryNumber
-		}
-		if credentialAlias, ok := metadata["credentialAlias"].(string); ok {
-			payload.CredentialAlias = credentialAlias
-		}
-		if subscriber, ok := metadata["subscriber"].(map[string]interface{}); ok {
-			payload.Subscriber = subscriber
-		}
-		if taskID, ok := metadata["taskId"].(string); ok {
-			payload.TaskID = taskID
-		}
-		if videoJobID, ok := metadata["videoJobId"].(string); ok {
-			payload.VideoJobID = videoJobID
-		}
-		if audioJobID, ok := metadata["audioJobId"].(string); ok {
-			payload.AudioJobID = audioJobID
-		}
-		if responseQualityScore, ok := metadata["responseQualityScore"].(float64); ok {
-			payload.ResponseQualityScore = &responseQualityScore
-		}
-		// Cost override - allows custom pricing when provider pricing unavailable
-		// Handle both float64 and int to avoid silent failures with integer literals
-		if totalCost, ok := metadata["totalCost"].(float64); ok {
-			payload.TotalCost = &totalCost
-		} else if totalCostInt, ok := metadata["totalCost"].(int); ok {
-			totalCostFloat := float64(totalCostInt)
-			payload.TotalCost = &totalCostFloat
-		}
-	}
+	applyUsageMetadata(payload, metadata)
 
 	// Add prompt capture fields when enabled (opt-in)
 	if capturePrompts && prompt != "" {
-		inputMessages, truncated := formatPromptAsInputMessages(prompt)
-		if inputMessages != "" {
-			payload.InputMessages = inputMessages
-		}
-		if truncated {
-			payload.PromptsTruncated = true
-		}
-		// Output response contains the generated video URL
-		if outputURL != "" {
-			payload.OutputResponse = outputURL
-		}
-		Debug("Prompt capture enabled: captured %d chars, output URL: %s", len(prompt), outputURL)
+		payload.capturedPrompt = &capturedPrompt{prompt: prompt}
+		Debug("Prompt capture enabled: captured %d chars", len(prompt))
+	}
+
+	// Output response contains the generated video URL, plus any
+	// thumbnail/preview URLs as a structured object
+	if captureOutputs && outputURL != "" {
+		payload.OutputResponse = videoOutputResponse(outputURL, videoResp, escapeHTML)
+		Debug("Output capture enabled: output URL: %s", outputURL)
 	}
 
 	return payload
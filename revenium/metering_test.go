@@ -1,6 +1,21 @@
 package revenium
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func TestNormalizeModelName(t *testing.T) {
 	tests := []struct {
@@ -72,3 +87,869 @@ func TestNormalizeModelNameIdempotent(t *testing.T) {
 		}
 	}
 }
+
+func TestWarnModelNameOncePerClient(t *testing.T) {
+	var logs bytes.Buffer
+	logger.SetOutput(&logs)
+	t.Cleanup(func() { logger.SetOutput(os.Stdout) })
+
+	client, _ := newFakeClient(t, &fakeGenerator{})
+	client.warnModelName("warn-once/model-a")
+	client.warnModelName("warn-once/model-a")
+	client.warnModelName("warn-once/model-b")
+	client.warnModelName("fal_ai/warn-once/model-c")
+	client.warnModelName("fal_ai/warn-once/model-c")
+	client.warnModelName("fal-ai/flux/dev")
+
+	for _, model := range []string{"warn-once/model-a", "warn-once/model-b", "fal_ai/warn-once/model-c"} {
+		if got := strings.Count(logs.String(), "Model name '"+model+"'"); got != 1 {
+			t.Errorf("warnings for %q = %d, want 1", model, got)
+		}
+	}
+	if strings.Contains(logs.String(), "'fal-ai/flux/dev'") {
+		t.Error("warned about a full Fal endpoint ID")
+	}
+
+	// Another client warns on its own
+	other, _ := newFakeClient(t, &fakeGenerator{})
+	other.warnModelName("warn-once/model-a")
+	if got := strings.Count(logs.String(), "Model name 'warn-once/model-a'"); got != 2 {
+		t.Errorf("warnings for warn-once/model-a across two clients = %d, want 2", got)
+	}
+
+	// The record of warned names stays bounded
+	for i := 0; i < maxWarnedModelNames+10; i++ {
+		client.warnModelName(fmt.Sprintf("bounded/model-%d", i))
+	}
+	if n := len(client.warnedModels); n > maxWarnedModelNames {
+		t.Errorf("remembered %d model names, want at most %d", n, maxWarnedModelNames)
+	}
+}
+
+func TestWithMeteringTransport(t *testing.T) {
+	cfg := &Config{}
+	WithMeteringTransport(500, 50, 2*time.Minute)(cfg)
+
+	mc, err := NewMeteringClient(cfg)
+	if err != nil {
+		t.Fatalf("NewMeteringClient() error = %v", err)
+	}
+	logging, ok := mc.httpClient.Transport.(*loggingRoundTripper)
+	if !ok {
+		t.Fatalf("transport type = %T, want *loggingRoundTripper", mc.httpClient.Transport)
+	}
+	transport, ok := logging.base.(*http.Transport)
+	if !ok {
+		t.Fatalf("base transport type = %T, want *http.Transport", logging.base)
+	}
+	if transport.MaxIdleConns != 500 {
+		t.Errorf("MaxIdleConns = %d, want 500", transport.MaxIdleConns)
+	}
+	if transport.MaxIdleConnsPerHost != 50 {
+		t.Errorf("MaxIdleConnsPerHost = %d, want 50", transport.MaxIdleConnsPerHost)
+	}
+	if transport.IdleConnTimeout != 2*time.Minute {
+		t.Errorf("IdleConnTimeout = %v, want %v", transport.IdleConnTimeout, 2*time.Minute)
+	}
+}
+
+func TestWithMeteringTimeout(t *testing.T) {
+	const responseDelay = 100 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(responseDelay)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	send := func(timeout time.Duration) error {
+		cfg := &Config{ReveniumBaseURL: server.URL, ReveniumAPIKey: "hak_test"}
+		WithMeteringTimeout(timeout)(cfg)
+		mc, err := NewMeteringClient(cfg)
+		if err != nil {
+			t.Fatalf("NewMeteringClient() error = %v", err)
+		}
+		defer mc.Close()
+		return mc.SendImageMetering(&MeteringPayload{TransactionID: "tx-timeout"})
+	}
+
+	if err := send(responseDelay * 3); err != nil {
+		t.Errorf("timeout above the response time: error = %v, want delivery", err)
+	}
+	if err := send(responseDelay / 2); err == nil {
+		t.Error("timeout below the response time: want an error")
+	}
+
+	mc, _ := NewMeteringClient(&Config{})
+	if mc.httpClient.Timeout != defaultMeteringTimeout {
+		t.Errorf("default Timeout = %v, want %v", mc.httpClient.Timeout, defaultMeteringTimeout)
+	}
+}
+
+func TestWithDisableHTMLEscaping(t *testing.T) {
+	const prompt = `<script>alert("x")</script> & more`
+	const outputURL = "https://fal.media/1.png?a=1&b=2"
+
+	send := func(t *testing.T, opts ...Option) (string, *MeteringPayload) {
+		t.Helper()
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		cfg := &Config{ReveniumBaseURL: server.URL, ReveniumAPIKey: "hak_test"}
+		for _, opt := range opts {
+			opt(cfg)
+		}
+		mc, err := NewMeteringClient(cfg)
+		if err != nil {
+			t.Fatalf("NewMeteringClient() error = %v", err)
+		}
+		defer mc.Close()
+
+		payload := buildImageMeteringPayload("fal-ai/flux/dev", &FalImageResponse{}, nil, time.Second, time.Now(), 1, true, true, prompt, "", []string{outputURL}, !cfg.DisableHTMLEscaping)
+		if err := mc.SendImageMetering(payload); err != nil {
+			t.Fatalf("SendImageMetering() error = %v", err)
+		}
+		var sent MeteringPayload
+		if err := json.Unmarshal(body, &sent); err != nil {
+			t.Fatalf("Unmarshal() error = %v", err)
+		}
+		return string(body), &sent
+	}
+
+	t.Run("disabled escaping", func(t *testing.T) {
+		body, sent := send(t, WithDisableHTMLEscaping(true))
+		if strings.Contains(body, `\u003c`) || strings.Contains(body, `\u0026`) {
+			t.Errorf("body contains unicode escapes: %s", body)
+		}
+		if !strings.Contains(body, "<script>") {
+			t.Errorf("body does not contain the literal prompt: %s", body)
+		}
+		if sent.OutputResponse != `["`+outputURL+`"]` {
+			t.Errorf("outputResponse = %s, want the literal URL", sent.OutputResponse)
+		}
+
+		var messages []map[string]string
+		if err := json.Unmarshal([]byte(sent.InputMessages), &messages); err != nil {
+			t.Fatalf("inputMessages is not valid JSON: %v", err)
+		}
+		if messages[0]["content"] != prompt {
+			t.Errorf("content = %q, want %q", messages[0]["content"], prompt)
+		}
+	})
+
+	t.Run("default escaping", func(t *testing.T) {
+		body, sent := send(t)
+		if strings.Contains(body, "<script>") {
+			t.Errorf("body contains unescaped HTML: %s", body)
+		}
+		// The nested JSON strings are encoded as json.Marshal would
+		wantMessages, _ := json.Marshal([]map[string]string{{"role": "user", "content": prompt}})
+		if sent.InputMessages != string(wantMessages) {
+			t.Errorf("inputMessages = %s, want %s", sent.InputMessages, wantMessages)
+		}
+		wantOutput, _ := json.Marshal([]string{outputURL})
+		if sent.OutputResponse != string(wantOutput) {
+			t.Errorf("outputResponse = %s, want %s", sent.OutputResponse, wantOutput)
+		}
+	})
+}
+
+func TestRetryBudget(t *testing.T) {
+	var attempts atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	cfg := &Config{ReveniumBaseURL: server.URL, ReveniumAPIKey: "hak_test"}
+	WithRetryBudget(0)(cfg)
+	mc, err := NewMeteringClient(cfg)
+	if err != nil {
+		t.Fatalf("NewMeteringClient() error = %v", err)
+	}
+	defer mc.Close()
+
+	// The reserve covers the first five requests' two retries each
+	for i := 0; i < retryBudgetMaxTokens/2; i++ {
+		mc.SendImageMetering(&MeteringPayload{TransactionID: "tx-budget"})
+	}
+	if got := attempts.Load(); got != 3*retryBudgetMaxTokens/2 {
+		t.Fatalf("attempts while budget lasts = %d, want %d", got, 3*retryBudgetMaxTokens/2)
+	}
+
+	// Once depleted, failures are not retried
+	attempts.Store(0)
+	for i := 0; i < 5; i++ {
+		if err := mc.SendImageMetering(&MeteringPayload{TransactionID: "tx-budget"}); err == nil {
+			t.Fatal("SendImageMetering() error = nil, want a metering error")
+		}
+	}
+	if got := attempts.Load(); got != 5 {
+		t.Errorf("attempts after depletion = %d, want 5 (no retries)", got)
+	}
+}
+
+func TestRetryBudgetRefills(t *testing.T) {
+	budget := newRetryBudget(&Config{RetryBudgetRatio: 0.5, retryBudgetSet: true})
+	for budget.withdraw() {
+	}
+
+	budget.deposit()
+	if budget.withdraw() {
+		t.Error("withdraw() after half a token = true, want false")
+	}
+	budget.deposit()
+	if !budget.withdraw() {
+		t.Error("withdraw() after two requests at ratio 0.5 = false, want true")
+	}
+
+	if newRetryBudget(&Config{}) != nil {
+		t.Error("budget without WithRetryBudget should be unlimited (nil)")
+	}
+}
+
+func TestMeteringClientsDoNotShareHTTPClient(t *testing.T) {
+	first, err := NewMeteringClient(&Config{})
+	if err != nil {
+		t.Fatalf("NewMeteringClient() error = %v", err)
+	}
+	second, err := NewMeteringClient(&Config{})
+	if err != nil {
+		t.Fatalf("NewMeteringClient() error = %v", err)
+	}
+
+	if first.httpClient == second.httpClient {
+		t.Error("expected each MeteringClient to own its HTTP client")
+	}
+}
+
+func TestImageSeedAttributes(t *testing.T) {
+	var resp FalImageResponse
+	body := `{"seed":100,"images":[` +
+		`{"url":"https://fal.media/1.png","width":512,"height":512,"seed":100},` +
+		`{"url":"https://fal.media/2.png","width":512,"height":512,"seed":101}]}`
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	payload := buildImageMeteringPayload("fal-ai/flux/dev", &resp, nil, time.Second, time.Now(), 2, false, false, "", "", nil, true)
+	images, ok := payload.Attributes["images"].([]map[string]interface{})
+	if !ok || len(images) != 2 {
+		t.Fatalf("images attribute = %v, want 2 entries", payload.Attributes["images"])
+	}
+	for i, want := range []int{100, 101} {
+		if images[i]["seed"] != want || images[i]["index"] != i {
+			t.Errorf("images[%d] = %v, want index %d and seed %d", i, images[i], i, want)
+		}
+	}
+
+	for i, p := range splitImageMeteringPayload(payload, resp.Images, false, true, "", generateTransactionID) {
+		if p.Attributes["seed"] != 100+i {
+			t.Errorf("split payload %d seed = %v, want %d", i, p.Attributes["seed"], 100+i)
+		}
+		if _, ok := p.Attributes["images"]; ok {
+			t.Errorf("split payload %d carries the full images attribute", i)
+		}
+	}
+
+	// Responses without per-image seeds add no images attribute
+	unseeded := &FalImageResponse{Images: []FalImage{{URL: "https://fal.media/1.png"}, {URL: "https://fal.media/2.png"}}}
+	payload = buildImageMeteringPayload("fal-ai/flux/dev", unseeded, nil, time.Second, time.Now(), 2, false, false, "", "", nil, true)
+	if _, ok := payload.Attributes["images"]; ok {
+		t.Error("images attribute set for a response without seeds")
+	}
+}
+
+func TestMetadataKeyCasing(t *testing.T) {
+	var logs bytes.Buffer
+	logger.SetOutput(&logs)
+	t.Cleanup(func() { logger.SetOutput(os.Stdout) })
+
+	metadata := map[string]interface{}{
+		"organizationId": "org-canonical",
+		"organizationID": "org-variant",
+		"traceID":        "trace-1",
+		"productId":      "prod-1",
+		"ProductId":      "prod-1",
+	}
+	payload := &MeteringPayload{}
+	applyUsageMetadata(payload, metadata)
+
+	if payload.OrganizationID != "org-canonical" {
+		t.Errorf("OrganizationID = %q, want the canonical key's value", payload.OrganizationID)
+	}
+	if payload.TraceID != "trace-1" {
+		t.Errorf("TraceID = %q, want trace-1 from traceID", payload.TraceID)
+	}
+	if payload.ProductID != "prod-1" {
+		t.Errorf("ProductID = %q, want prod-1", payload.ProductID)
+	}
+
+	if got := strings.Count(logs.String(), "[WARN]"); got != 1 {
+		t.Errorf("got %d warnings, want 1 for the conflicting organizationID:\n%s", got, logs.String())
+	}
+	if !strings.Contains(logs.String(), `"organizationID"`) {
+		t.Errorf("warning does not name the ignored key:\n%s", logs.String())
+	}
+	if _, ok := metadata["traceId"]; ok {
+		t.Error("caller's metadata map was modified")
+	}
+}
+
+func TestSplitImageMeteringPayload(t *testing.T) {
+	images := []FalImage{
+		{URL: "https://fal.media/1.png", Width: 512, Height: 512},
+		{URL: "https://fal.media/2.png", Width: 768, Height: 512},
+		{URL: "https://fal.media/3.png", Width: 1024, Height: 768},
+	}
+	resp := &FalImageResponse{Images: images}
+	metadata := map[string]interface{}{"traceId": "trace-123"}
+
+	payload := buildImageMeteringPayload("fal-ai/flux/dev", resp, metadata, time.Second, time.Now(), 0, true, true, "a cat", "", []string{images[0].URL, images[1].URL, images[2].URL}, true)
+	payloads := splitImageMeteringPayload(payload, images, true, true, "", generateTransactionID)
+
+	if len(payloads) != 3 {
+		t.Fatalf("got %d payloads, want 3", len(payloads))
+	}
+
+	seen := make(map[string]bool)
+	for i, p := range payloads {
+		if p.ActualImageCount == nil || *p.ActualImageCount != 1 {
+			t.Errorf("payload %d ActualImageCount = %v, want 1", i, p.ActualImageCount)
+		}
+		if p.TraceID != "trace-123" {
+			t.Errorf("payload %d TraceID = %q, want %q", i, p.TraceID, "trace-123")
+		}
+		if seen[p.TransactionID] {
+			t.Errorf("payload %d reuses TransactionID %q", i, p.TransactionID)
+		}
+		seen[p.TransactionID] = true
+		if p.Attributes["width"] != images[i].Width || p.Attributes["height"] != images[i].Height {
+			t.Errorf("payload %d dimensions = %vx%v, want %dx%d", i, p.Attributes["width"], p.Attributes["height"], images[i].Width, images[i].Height)
+		}
+		if want := `["` + images[i].URL + `"]`; p.OutputResponse != want {
+			t.Errorf("payload %d OutputResponse = %q, want %q", i, p.OutputResponse, want)
+		}
+	}
+}
+
+func TestRequestParamsAttribute(t *testing.T) {
+	request := &FalRequest{Prompt: "a secret cat", NegativePrompt: "dogs", ImageSize: "landscape_16_9", NumInferenceSteps: 28}
+
+	params := requestParamsAttribute(request, false)
+	if _, ok := params["prompt"]; ok {
+		t.Error("prompt included with prompt capture disabled")
+	}
+	if _, ok := params["negative_prompt"]; ok {
+		t.Error("negative_prompt included with prompt capture disabled")
+	}
+	if params["image_size"] != "landscape_16_9" {
+		t.Errorf("image_size = %v, want landscape_16_9", params["image_size"])
+	}
+	if params["num_inference_steps"] != float64(28) {
+		t.Errorf("num_inference_steps = %v, want 28", params["num_inference_steps"])
+	}
+
+	params = requestParamsAttribute(request, true)
+	if params["prompt"] != "a secret cat" {
+		t.Errorf("prompt = %v, want it included with prompt capture enabled", params["prompt"])
+	}
+}
+
+func TestProviderAndModelSourceOverrides(t *testing.T) {
+	resp := &FalImageResponse{Images: []FalImage{{URL: "https://fal.media/1.png"}}}
+
+	payload := buildImageMeteringPayload("fal-ai/flux/dev", resp, nil, time.Second, time.Now(), 0, false, false, "", "", nil, true)
+	if payload.Provider != "fal_ai" || payload.ModelSource != "FAL" {
+		t.Errorf("defaults = %q/%q, want fal_ai/FAL", payload.Provider, payload.ModelSource)
+	}
+
+	metadata := map[string]interface{}{"provider": "reseller", "modelSource": "RESELLER"}
+	payload = buildImageMeteringPayload("fal-ai/flux/dev", resp, metadata, time.Second, time.Now(), 0, false, false, "", "", nil, true)
+	if payload.Provider != "reseller" || payload.ModelSource != "RESELLER" {
+		t.Errorf("overrides = %q/%q, want reseller/RESELLER", payload.Provider, payload.ModelSource)
+	}
+
+	metadata = map[string]interface{}{"provider": "", "modelSource": 42}
+	payload = buildVideoMeteringPayload("fal-ai/kling-video", &FalVideoResponse{}, metadata, time.Second, time.Now(), "5", false, false, "", "", true)
+	if payload.Provider != "fal_ai" || payload.ModelSource != "FAL" {
+		t.Errorf("invalid overrides = %q/%q, want defaults fal_ai/FAL", payload.Provider, payload.ModelSource)
+	}
+}
+
+func TestSanitizeJSONMapDropsUnserializableValues(t *testing.T) {
+	subscriber := map[string]interface{}{
+		"id":       "user-123",
+		"callback": func() {},
+	}
+
+	sanitized := sanitizeJSONMap("subscriber", subscriber)
+	if _, ok := sanitized["callback"]; ok {
+		t.Error("func value was not removed")
+	}
+	if sanitized["id"] != "user-123" {
+		t.Errorf("id = %v, want user-123", sanitized["id"])
+	}
+	if _, ok := subscriber["callback"]; !ok {
+		t.Error("input map was modified")
+	}
+
+	payload := &MeteringPayload{Subscriber: subscriber}
+	payload.Subscriber = sanitizeJSONMap("subscriber", payload.Subscriber)
+	if _, err := json.Marshal(payload); err != nil {
+		t.Errorf("payload still fails to marshal: %v", err)
+	}
+}
+
+func TestApplySamplingScalesTotals(t *testing.T) {
+	count, requested, cost := 2, 2, 0.01
+	payload := &MeteringPayload{ActualImageCount: &count, RequestedImageCount: &requested, TotalCost: &cost}
+
+	if !applySampling(payload, 0.25, 0.1) {
+		t.Fatal("applySampling() dropped a payload whose roll was under the rate")
+	}
+	if *payload.ActualImageCount != 8 {
+		t.Errorf("ActualImageCount = %d, want 8", *payload.ActualImageCount)
+	}
+	if *payload.RequestedImageCount != 8 {
+		t.Errorf("RequestedImageCount = %d, want 8", *payload.RequestedImageCount)
+	}
+	if math.Abs(*payload.TotalCost-0.04) > 1e-9 {
+		t.Errorf("TotalCost = %v, want 0.04", *payload.TotalCost)
+	}
+	if payload.Attributes["sampled"] != 0.25 {
+		t.Errorf("attributes[sampled] = %v, want 0.25", payload.Attributes["sampled"])
+	}
+
+	// Video is billed per second, so both durations scale
+	duration, requestedDuration := 5.0, 5.0
+	video := &MeteringPayload{DurationSeconds: &duration, RequestedDurationSeconds: &requestedDuration}
+	if !applySampling(video, 0.25, 0.1) {
+		t.Fatal("applySampling() dropped a video payload whose roll was under the rate")
+	}
+	if *video.DurationSeconds != 20 || *video.RequestedDurationSeconds != 20 {
+		t.Errorf("durations = %v/%v, want 20/20", *video.DurationSeconds, *video.RequestedDurationSeconds)
+	}
+
+	if applySampling(&MeteringPayload{}, 0.25, 0.5) {
+		t.Error("applySampling() kept a payload whose roll was over the rate")
+	}
+}
+
+func TestVideoOutputResponseWithThumbnail(t *testing.T) {
+	resp := &FalVideoResponse{
+		Video:        FalVideo{URL: "https://fal.media/v.mp4", Duration: 5},
+		ThumbnailURL: "https://fal.media/v.jpg",
+	}
+
+	payload := buildVideoMeteringPayload("fal-ai/kling-video", resp, nil, time.Second, time.Now(), "5", true, true, "a wave", resp.Video.URL, true)
+	want := `{"thumbnail":"https://fal.media/v.jpg","video":"https://fal.media/v.mp4"}`
+	if payload.OutputResponse != want {
+		t.Errorf("OutputResponse = %q, want %q", payload.OutputResponse, want)
+	}
+
+	resp.ThumbnailURL = ""
+	payload = buildVideoMeteringPayload("fal-ai/kling-video", resp, nil, time.Second, time.Now(), "5", true, true, "a wave", resp.Video.URL, true)
+	if payload.OutputResponse != "https://fal.media/v.mp4" {
+		t.Errorf("OutputResponse = %q, want plain video URL", payload.OutputResponse)
+	}
+}
+
+func TestRequestedImageCountFromRequest(t *testing.T) {
+	resp := &FalImageResponse{Images: []FalImage{{URL: "1.png"}, {URL: "2.png"}, {URL: "3.png"}}}
+
+	payload := buildImageMeteringPayload("fal-ai/flux/dev", resp, nil, time.Second, time.Now(), 4, false, false, "", "", nil, true)
+	if payload.RequestedImageCount == nil || *payload.RequestedImageCount != 4 {
+		t.Errorf("RequestedImageCount = %v, want 4", payload.RequestedImageCount)
+	}
+	if payload.ActualImageCount == nil || *payload.ActualImageCount != 3 {
+		t.Errorf("ActualImageCount = %v, want 3", payload.ActualImageCount)
+	}
+
+	// Unset NumImages falls back to the actual count
+	payload = buildImageMeteringPayload("fal-ai/flux/dev", resp, nil, time.Second, time.Now(), 0, false, false, "", "", nil, true)
+	if payload.RequestedImageCount == nil || *payload.RequestedImageCount != 3 {
+		t.Errorf("RequestedImageCount = %v, want 3 when NumImages is unset", payload.RequestedImageCount)
+	}
+}
+
+func TestMeteringEventLogCarriesStatusCode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	var events []MeteringEvent
+	mc, err := NewMeteringClient(&Config{
+		ReveniumAPIKey:   "hak_test_key",
+		ReveniumBaseURL:  server.URL,
+		MeteringEventLog: func(e MeteringEvent) { events = append(events, e) },
+	})
+	if err != nil {
+		t.Fatalf("NewMeteringClient() error = %v", err)
+	}
+
+	payload := &MeteringPayload{TransactionID: "tx-1"}
+	if err := mc.SendImageMetering(payload); err != nil {
+		t.Fatalf("SendImageMetering() error = %v", err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	e := events[0]
+	if e.StatusCode != http.StatusAccepted || !e.Delivered || e.Attempt != 1 {
+		t.Errorf("event = {StatusCode:%d Delivered:%v Attempt:%d}, want {202 true 1}", e.StatusCode, e.Delivered, e.Attempt)
+	}
+	if e.Endpoint != server.URL+"/meter/v2/ai/images" || e.Payload != payload || e.SentAt.IsZero() {
+		t.Errorf("unexpected event: %+v", e)
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatalf("json.Marshal(event) error = %v", err)
+	}
+	var decoded map[string]interface{}
+	json.Unmarshal(data, &decoded)
+	if decoded["statusCode"] != float64(http.StatusAccepted) || decoded["payload"].(map[string]interface{})["transactionId"] != "tx-1" {
+		t.Errorf("unexpected event JSON: %s", data)
+	}
+}
+
+func TestClampQualityScore(t *testing.T) {
+	tests := []struct {
+		score float64
+		want  float64
+	}{
+		{1.02, 1.0},
+		{-0.1, 0.0},
+		{0.5, 0.5},
+	}
+	for _, tt := range tests {
+		score := tt.score
+		payload := &MeteringPayload{ResponseQualityScore: &score}
+		clampQualityScore(payload)
+		if *payload.ResponseQualityScore != tt.want {
+			t.Errorf("clampQualityScore(%v) = %v, want %v", tt.score, *payload.ResponseQualityScore, tt.want)
+		}
+	}
+
+	clampQualityScore(&MeteringPayload{}) // nil score is left alone
+}
+
+func TestNegativePromptCapturedSeparately(t *testing.T) {
+	resp := &FalImageResponse{Images: []FalImage{{URL: "https://fal.media/1.png"}}}
+	payload := buildImageMeteringPayload("fal-ai/flux/dev", resp, nil, time.Second, time.Now(), 0, true, true, "a cat", "blurry, dogs", nil, true)
+	payload.formatCapturedPrompt(true)
+
+	var messages []map[string]string
+	if err := json.Unmarshal([]byte(payload.InputMessages), &messages); err != nil {
+		t.Fatalf("inputMessages is not JSON: %v", err)
+	}
+	want := []map[string]string{
+		{"role": "user", "content": "a cat"},
+		{"role": "negative", "content": "blurry, dogs"},
+	}
+	if len(messages) != len(want) {
+		t.Fatalf("inputMessages = %v, want %v", messages, want)
+	}
+	for i := range want {
+		if messages[i]["role"] != want[i]["role"] || messages[i]["content"] != want[i]["content"] {
+			t.Errorf("message %d = %v, want %v", i, messages[i], want[i])
+		}
+	}
+
+	// No negative prompt keeps the single-message format
+	payload = buildImageMeteringPayload("fal-ai/flux/dev", resp, nil, time.Second, time.Now(), 0, true, true, "a cat", "", nil, true)
+	payload.formatCapturedPrompt(true)
+	if payload.InputMessages != `[{"content":"a cat","role":"user"}]` {
+		t.Errorf("inputMessages = %s, want a single user message", payload.InputMessages)
+	}
+}
+
+func TestInferenceTimeRecorded(t *testing.T) {
+	var resp FalVideoResponse
+	if err := json.Unmarshal([]byte(`{"video":{"url":"https://fal.media/1.mp4"},"inference_time":12.75}`), &resp); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+
+	payload := buildVideoMeteringPayload("fal-ai/kling-video", &resp, nil, time.Second, time.Now(), "5", false, false, "", "", true)
+	if payload.InferenceSeconds == nil || *payload.InferenceSeconds != 12.75 {
+		t.Errorf("InferenceSeconds = %v, want 12.75", payload.InferenceSeconds)
+	}
+	if payload.Attributes["inferenceSeconds"] != 12.75 {
+		t.Errorf("attributes[inferenceSeconds] = %v, want 12.75", payload.Attributes["inferenceSeconds"])
+	}
+
+	payload = buildVideoMeteringPayload("fal-ai/kling-video", &FalVideoResponse{}, nil, time.Second, time.Now(), "5", false, false, "", "", true)
+	if payload.InferenceSeconds != nil {
+		t.Errorf("InferenceSeconds = %v, want nil when not reported", *payload.InferenceSeconds)
+	}
+}
+
+func TestDefaultModelTier(t *testing.T) {
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"fal-ai/flux/schnell", ModelTierFast},
+		{"flux/schnell", ModelTierFast},
+		{"fal-ai/flux/dev", ModelTierStandard},
+		{"fal_ai/fal-ai/flux/dev/image-to-image", ModelTierStandard},
+		{"fal-ai/flux-pro", ModelTierPro},
+		{"fal-ai/flux-pro/v1.1-ultra", ModelTierPro},
+		{"fal-ai/flux/development", ModelTierUnknown},
+		{"fal-ai/kling-video/v2/master/text-to-video", ModelTierUnknown},
+	}
+	for _, tt := range tests {
+		if got := DefaultModelTier(tt.model); got != tt.want {
+			t.Errorf("DefaultModelTier(%q) = %q, want %q", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeContentType(t *testing.T) {
+	tests := []struct {
+		contentType, url, want string
+	}{
+		{"image/jpg", "", "image/jpeg"},
+		{"IMAGE/JPEG", "", "image/jpeg"},
+		{"image/png; charset=binary", "", "image/png"},
+		{"video/mov", "", "video/quicktime"},
+		{"image/avif", "", "image/avif"},
+		{"application/x-custom", "", "application/x-custom"},
+		{"", "https://fal.media/files/out.JPG?token=abc", "image/jpeg"},
+		{"", "https://fal.media/files/clip.mp4", "video/mp4"},
+		{"", "https://fal.media/files/blob", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeContentType(tt.contentType, tt.url); got != tt.want {
+			t.Errorf("normalizeContentType(%q, %q) = %q, want %q", tt.contentType, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestErrorCategory(t *testing.T) {
+	status := func(code int) error {
+		err := NewProviderError(fmt.Sprintf("HTTP %d", code), nil)
+		err.StatusCode = code
+		return err
+	}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"bad request", status(400), ErrorCategoryProvider4xx},
+		{"rate limited", status(429), ErrorCategoryProvider4xx},
+		{"auth", NewAuthError("invalid key", nil), ErrorCategoryProvider4xx},
+		{"server error", status(503), ErrorCategoryProvider5xx},
+		{"unparseable response", NewProviderError("failed to parse response", nil), ErrorCategoryProvider5xx},
+		{"network", NewNetworkError("request failed", errors.New("connection refused")), ErrorCategoryNetwork},
+		{"deadline", NewNetworkError("request failed", context.DeadlineExceeded), ErrorCategoryTimeout},
+		{"bare deadline", context.DeadlineExceeded, ErrorCategoryTimeout},
+		{"validation", NewValidationError("loras[0]: path is required", nil), ErrorCategoryValidation},
+		{"untyped", errors.New("boom"), ErrorCategoryUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorCategory(tt.err); got != tt.want {
+				t.Errorf("errorCategory(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactErrorMessage(t *testing.T) {
+	message := `request failed: Post "https://user:pw@fal.run/fal-ai/flux/dev?fal_key=abc123": Authorization: Key fal-secret-key-123, revenium hak_live_secret`
+	got := redactErrorMessage(message)
+	for _, secret := range []string{"user:pw", "abc123", "fal-secret-key-123", "hak_live_secret"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("redacted message %q still contains %q", got, secret)
+		}
+	}
+	if !strings.Contains(got, "https://fal.run/fal-ai/flux/dev") {
+		t.Errorf("redacted message %q lost the endpoint", got)
+	}
+
+	long := redactErrorMessage(strings.Repeat("x", 2*maxErrorMessageLength))
+	if !strings.HasSuffix(long, TruncationSuffix) || len(long) != maxErrorMessageLength+len(TruncationSuffix) {
+		t.Errorf("long message not truncated: %d chars", len(long))
+	}
+}
+
+func TestSegmentedVideoDuration(t *testing.T) {
+	var resp FalVideoResponse
+	body := `{"video":{"url":"https://fal.media/clip.mp4","width":1280,"height":720},
+		"segments":[{"url":"https://fal.media/seg-0.mp4","duration":5},{"url":"https://fal.media/seg-1.mp4","duration":4.5}]}`
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	payload := buildVideoMeteringPayload("fal-ai/kling-video", &resp, nil, time.Second, time.Now(), "10", false, false, "", "", true)
+	if payload.DurationSeconds == nil || *payload.DurationSeconds != 9.5 {
+		t.Errorf("DurationSeconds = %v, want the summed 9.5", payload.DurationSeconds)
+	}
+	if payload.RequestedDurationSeconds == nil || *payload.RequestedDurationSeconds != 10 {
+		t.Errorf("RequestedDurationSeconds = %v, want 10", payload.RequestedDurationSeconds)
+	}
+	segments, _ := payload.Attributes["segments"].([]map[string]interface{})
+	if len(segments) != 2 || segments[1]["duration"] != 4.5 {
+		t.Errorf("segments = %v, want per-segment durations", payload.Attributes["segments"])
+	}
+	if _, ok := segments[1]["url"]; ok {
+		t.Errorf("segments = %v, want no URLs with output capture disabled", payload.Attributes["segments"])
+	}
+	if payload.Attributes["segmentCount"] != 2 {
+		t.Errorf("segmentCount = %v, want 2", payload.Attributes["segmentCount"])
+	}
+
+	payload = buildVideoMeteringPayload("fal-ai/kling-video", &resp, nil, time.Second, time.Now(), "10", false, true, "", "https://fal.media/clip.mp4", true)
+	segments, _ = payload.Attributes["segments"].([]map[string]interface{})
+	if len(segments) != 2 || segments[1]["url"] != "https://fal.media/seg-1.mp4" {
+		t.Errorf("segments = %v, want per-segment URLs with output capture enabled", payload.Attributes["segments"])
+	}
+
+	// Single videos are unaffected
+	single := &FalVideoResponse{Video: FalVideo{URL: "https://fal.media/clip.mp4", Duration: 5}}
+	payload = buildVideoMeteringPayload("fal-ai/kling-video", single, nil, time.Second, time.Now(), "5", false, false, "", "", true)
+	if payload.DurationSeconds == nil || *payload.DurationSeconds != 5 || payload.Attributes["segments"] != nil {
+		t.Errorf("single video DurationSeconds = %v, segments = %v", payload.DurationSeconds, payload.Attributes["segments"])
+	}
+}
+
+func TestOutputURLExpiry(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string // RFC 3339, or "" when no expiry is expected
+	}{
+		{"aws sigv4", "https://bucket.s3.amazonaws.com/out.png?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Date=20260101T120000Z&X-Amz-Expires=3600&X-Amz-Signature=abc", "2026-01-01T13:00:00Z"},
+		{"gcs v4 lowercase", "https://storage.googleapis.com/b/out.png?x-goog-date=20260101T120000Z&x-goog-expires=900", "2026-01-01T12:15:00Z"},
+		{"legacy expires", "https://bucket.s3.amazonaws.com/out.png?AWSAccessKeyId=AK&Expires=1767268800&Signature=abc", "2026-01-01T12:00:00Z"},
+		{"azure sas", "https://acct.blob.core.windows.net/c/out.png?sv=2022-11-02&se=2026-01-02T00:00:00Z&sig=abc", "2026-01-02T00:00:00Z"},
+		{"no query", "https://fal.media/files/out.png", ""},
+		{"unrelated params", "https://fal.media/files/out.png?width=512", ""},
+		{"malformed expiry", "https://bucket.s3.amazonaws.com/out.png?X-Amz-Date=yesterday&X-Amz-Expires=3600", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := outputURLExpiry(tt.url)
+			if tt.want == "" {
+				if ok {
+					t.Errorf("outputURLExpiry() = %v, want no expiry", got)
+				}
+				return
+			}
+			if !ok || got.UTC().Format(time.RFC3339) != tt.want {
+				t.Errorf("outputURLExpiry() = %v, %v; want %s", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithCaptureOutputExpiry(t *testing.T) {
+	images := []FalImage{
+		{URL: "https://bucket.s3.amazonaws.com/0.png?X-Amz-Date=20260101T120000Z&X-Amz-Expires=7200"},
+		{URL: "https://bucket.s3.amazonaws.com/1.png?X-Amz-Date=20260101T120000Z&X-Amz-Expires=3600"},
+		{URL: "https://fal.media/files/2.png"},
+	}
+	for _, enabled := range []bool{true, false} {
+		payload := meterOneImage(t, &fakeGenerator{image: &FalImageResponse{Images: images}}, "fal-ai/flux/dev", WithCaptureOutputExpiry(enabled))
+		got := payload.Attributes["outputExpiresAt"]
+		if enabled && got != "2026-01-01T13:00:00Z" {
+			t.Errorf("outputExpiresAt = %v, want the earliest expiry", got)
+		}
+		if !enabled && got != nil {
+			t.Errorf("outputExpiresAt = %v without WithCaptureOutputExpiry, want unset", got)
+		}
+	}
+}
+
+func TestNegativeDurationClamped(t *testing.T) {
+	var logs bytes.Buffer
+	logger.SetOutput(&logs)
+	t.Cleanup(func() { logger.SetOutput(os.Stdout) })
+
+	// A wall-clock start time stepped back by NTP yields a negative duration
+	requestTime := time.Now().Round(0)
+	duration := -3 * time.Second
+
+	payloads := []*MeteringPayload{
+		buildImageMeteringPayload("fal-ai/flux/dev", &FalImageResponse{}, nil, duration, requestTime, 1, false, false, "", "", nil, true),
+		buildVideoMeteringPayload("fal-ai/kling-video", nil, nil, duration, requestTime, "", false, false, "", "", true),
+	}
+	for _, payload := range payloads {
+		if !payload.ResponseTime.Equal(payload.RequestTime) || payload.RequestDuration != 0 {
+			t.Errorf("%s: ResponseTime = %v, RequestTime = %v, RequestDuration = %d; want equal times and 0",
+				payload.OperationType, payload.ResponseTime, payload.RequestTime, payload.RequestDuration)
+		}
+	}
+	if got := strings.Count(logs.String(), "Negative request duration"); got != 2 {
+		t.Errorf("logged %d negative duration warnings, want 2:\n%s", got, logs.String())
+	}
+}
+
+// BenchmarkSampledOutPromptCapture measures prompt capture cost when 1% of
+// payloads are kept: deferred formatting only pays for the kept ones, where
+// formatting at build time (as before) pays for every payload.
+func BenchmarkSampledOutPromptCapture(b *testing.B) {
+	prompt := strings.Repeat("a lighthouse at dusk, volumetric fog, ", 50)
+	resp := &FalImageResponse{Images: []FalImage{{URL: "https://fal.media/1.png"}}}
+	const rate = 0.01
+
+	run := func(b *testing.B, formatAtBuild bool) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			payload := buildImageMeteringPayload("fal-ai/flux/dev", resp, nil, time.Second, time.Now(), 1, true, false, prompt, "blurry", nil, true)
+			if formatAtBuild {
+				payload.formatCapturedPrompt(true)
+			}
+			if applySampling(payload, rate, float64(i%100)/100) {
+				payload.formatCapturedPrompt(true)
+			}
+		}
+	}
+	b.Run("format at build", func(b *testing.B) { run(b, true) })
+	b.Run("deferred", func(b *testing.B) { run(b, false) })
+}
+
+func TestAspectClass(t *testing.T) {
+	tests := []struct {
+		width, height int
+		want          string
+	}{
+		{1024, 1024, AspectClassSquare},
+		{1080, 1024, AspectClassSquare},
+		{1024, 768, AspectClassLandscape},
+		{1920, 1080, AspectClassLandscape},
+		{768, 1024, AspectClassPortrait},
+		{512, 1024, AspectClassPortrait},
+		{2048, 1024, AspectClassUltrawide},
+		{2560, 1080, AspectClassUltrawide},
+		{0, 0, ""},
+		{1024, 0, ""},
+	}
+	for _, tt := range tests {
+		if got := aspectClass(tt.width, tt.height); got != tt.want {
+			t.Errorf("aspectClass(%d, %d) = %q, want %q", tt.width, tt.height, got, tt.want)
+		}
+	}
+
+	resp := &FalImageResponse{Images: []FalImage{{URL: "https://fal.media/1.png", Width: 1920, Height: 1080}}}
+	payload := buildImageMeteringPayload("fal-ai/flux/dev", resp, nil, time.Second, time.Now(), 1, false, false, "", "", nil, true)
+	if payload.Attributes["aspectClass"] != AspectClassLandscape {
+		t.Errorf("attributes[aspectClass] = %v, want landscape", payload.Attributes["aspectClass"])
+	}
+
+	// Images without dimensions are metered without a class
+	resp = &FalImageResponse{Images: []FalImage{{URL: "https://fal.media/1.png"}}}
+	payload = buildImageMeteringPayload("fal-ai/flux/dev", resp, nil, time.Second, time.Now(), 1, false, false, "", "", nil, true)
+	if class, ok := payload.Attributes["aspectClass"]; ok {
+		t.Errorf("attributes[aspectClass] = %v for a 0x0 image, want none", class)
+	}
+}
@@ -0,0 +1,47 @@
+package revenium
+
+import (
+	"context"
+	"time"
+)
+
+// MetricsRecorder receives operational metrics for export to a metrics
+// backend; see WithMetricsRecorder. This package depends on no metrics
+// library; adapt the interface to OpenTelemetry, Prometheus, or similar.
+// Implementations must be safe for concurrent use and should not block.
+type MetricsRecorder interface {
+	// RecordGeneration is called once per generation with the duration of
+	// its final Fal attempt and its outcome (err is nil on success)
+	RecordGeneration(ctx context.Context, opType OperationType, model string, duration time.Duration, err error)
+	// AddQueueDepth adjusts the number of metering records awaiting delivery
+	AddQueueDepth(delta int64)
+}
+
+// recordGeneration reports a finished generation to the configured
+// MetricsRecorder, recovering from a panicking recorder so it cannot fail
+// the call
+func (r *ReveniumFal) recordGeneration(ctx context.Context, opType OperationType, model string, duration time.Duration, err error) {
+	if r.config.MetricsRecorder == nil {
+		return
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			Warn("Metrics recorder panicked: %v", p)
+		}
+	}()
+	r.config.MetricsRecorder.RecordGeneration(ctx, opType, model, duration, err)
+}
+
+// addQueueDepth reports a change in pending metering records to the
+// configured MetricsRecorder
+func (r *ReveniumFal) addQueueDepth(delta int64) {
+	if r.config.MetricsRecorder == nil {
+		return
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			Warn("Metrics recorder panicked: %v", p)
+		}
+	}()
+	r.config.MetricsRecorder.AddQueueDepth(delta)
+}
@@ -0,0 +1,69 @@
+package revenium
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// metricsRecorder is a MetricsRecorder that records what it receives
+type metricsRecorder struct {
+	mu          sync.Mutex
+	generations []string
+	queueDepth  int64
+	maxDepth    int64
+}
+
+func (m *metricsRecorder) RecordGeneration(ctx context.Context, opType OperationType, model string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	m.generations = append(m.generations, string(opType)+" "+model+" "+outcome)
+}
+
+func (m *metricsRecorder) AddQueueDepth(delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queueDepth += delta
+	if m.queueDepth > m.maxDepth {
+		m.maxDepth = m.queueDepth
+	}
+}
+
+func TestWithMetricsRecorder(t *testing.T) {
+	fail := false
+	falHandler := func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"detail":"bad prompt"}`))
+			return
+		}
+		imageHandler(w, r)
+	}
+	recorder := &metricsRecorder{}
+	client := newTestClient(t, falHandler, (&meterRecorder{}).ServeHTTP, WithMetricsRecorder(recorder))
+
+	if _, err := client.GenerateImage(context.Background(), "fal-ai/flux/dev", &FalRequest{Prompt: "a cat"}); err != nil {
+		t.Fatalf("GenerateImage() error = %v", err)
+	}
+	fail = true
+	if _, err := client.GenerateImage(context.Background(), "fal-ai/flux/dev", &FalRequest{Prompt: "a cat"}); err == nil {
+		t.Fatal("GenerateImage() error = nil, want the Fal error")
+	}
+	client.Flush()
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	want := []string{"IMAGE fal-ai/flux/dev success", "IMAGE fal-ai/flux/dev error"}
+	if len(recorder.generations) != len(want) || recorder.generations[0] != want[0] || recorder.generations[1] != want[1] {
+		t.Errorf("generations = %v, want %v", recorder.generations, want)
+	}
+	if recorder.maxDepth != 1 || recorder.queueDepth != 0 {
+		t.Errorf("queue depth peaked at %d and ended at %d, want 1 and 0", recorder.maxDepth, recorder.queueDepth)
+	}
+}
@@ -2,32 +2,118 @@ package revenium
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 )
 
 // ReveniumFal is the main middleware client that wraps Fal.ai API calls with metering
 type ReveniumFal struct {
 	config         *Config
-	falClient      *FalClient
-	meteringClient *MeteringClient
+	falClient      FalGenerator
+	meteringClient Meterer
 	mu             sync.RWMutex
 	wg             sync.WaitGroup
+
+	// Metering delivery tracking (used by Drain)
+	meteringMu   sync.Mutex
+	inflight     map[*MeteringPayload]struct{}
+	undelivered  []*MeteringPayload
+	draining     bool
+	shuttingDown bool
+
+	// calls tracks in-flight generation calls, which may still dispatch metering
+	calls sync.WaitGroup
+
+	// batcher accumulates payloads when batched delivery is enabled (nil otherwise)
+	batcher *meteringBatcher
+
+	// syncSends counts metering sends made during the synchronous warm-up
+	syncSends int64
+
+	// traceQueues holds payloads awaiting in-order delivery, keyed by TraceID;
+	// a trace has a key only while its delivery worker is running
+	traceMu     sync.Mutex
+	traceQueues map[string][]queuedMetering
+
+	// batches accumulates the usage of batch traces until FinishBatch
+	batchMu sync.Mutex
+	batches map[string]*batchTotals
+
+	// latency tracks recent Fal call durations for LatencyStats
+	latency latencyRecorder
+
+	// coalescer shares identical in-flight Fal calls (WithRequestCoalescing)
+	coalescer coalescer
+
+	// downloadClient fetches generated outputs for uploading and hashing
+	downloadClient *http.Client
+
+	// warnedModels records model names already warned about by warnModelName
+	warnedModelsMu sync.Mutex
+	warnedModels   map[string]struct{}
 }
 
+// queuedMetering is a payload waiting for ordered delivery
+type queuedMetering struct {
+	opType  OperationType
+	payload *MeteringPayload
+}
+
+// ErrShuttingDown is returned by generation calls made after Shutdown
+var ErrShuttingDown = errors.New("revenium: client is shutting down, no new requests are accepted")
+
 var (
 	globalClient *ReveniumFal
 	globalMu     sync.RWMutex
 	initialized  bool
 )
 
-// Initialize sets up the global Revenium middleware with configuration
+// Initialize sets up the global Revenium middleware with configuration.
+// Calling it again once initialized is a no-op; if the new options conflict
+// with the active configuration a warning names the ignored settings, or an
+// error is returned when WithStrictInit is used.
 func Initialize(opts ...Option) error {
 	globalMu.Lock()
 	defer globalMu.Unlock()
+	return initializeLocked(opts)
+}
+
+// EnsureInitialized initializes the global middleware if needed and returns
+// the global client, for library code that may run before or after the
+// application's own Initialize call. When already initialized, the existing
+// client is returned and opts are handled as by a repeated Initialize call.
+// It is safe to call concurrently; only one call initializes.
+//
+// Example:
+//
+//	client, err := revenium.EnsureInitialized()
+//	if err != nil {
+//	    return err
+//	}
+//	resp, err := client.GenerateImage(ctx, "fal-ai/flux/dev", req)
+func EnsureInitialized(opts ...Option) (*ReveniumFal, error) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	if err := initializeLocked(opts); err != nil {
+		return nil, err
+	}
+	return globalClient, nil
+}
 
+// initializeLocked implements Initialize; the caller must hold globalMu
+func initializeLocked(opts []Option) error {
 	if initialized {
-		return nil
+		return checkReinitialize(globalClient.config, opts)
 	}
 
 	// Initialize logger first
@@ -49,28 +135,52 @@ func Initialize(opts ...Option) error {
 		return err
 	}
 
-	// Create clients
-	falClient, err := NewFalClient(cfg)
-	if err != nil {
+	if err := cfg.checkAllowedHosts(); err != nil {
 		return err
 	}
 
-	meteringClient, err := NewMeteringClient(cfg)
+	if cfg.VerifyConnectivity {
+		if err := cfg.verifyConnectivity(); err != nil {
+			return err
+		}
+	}
+
+	// Create clients
+	client, err := NewReveniumFal(cfg)
 	if err != nil {
 		return err
 	}
 
-	globalClient = &ReveniumFal{
-		config:         cfg,
-		falClient:      falClient,
-		meteringClient: meteringClient,
-	}
+	globalClient = client
+	cfg.logStartupSummary()
 
 	initialized = true
 	Info("Revenium Fal.ai middleware initialized successfully")
 	return nil
 }
 
+// checkReinitialize reports options passed to a repeated Initialize call that
+// differ from the active configuration and will therefore be ignored
+func checkReinitialize(active *Config, opts []Option) error {
+	requested := &Config{}
+	for _, opt := range opts {
+		opt(requested)
+	}
+
+	conflicts := conflictingConfigFields(active, requested)
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	message := fmt.Sprintf("Initialize called again with conflicting options; already initialized, ignoring: %s",
+		strings.Join(conflicts, ", "))
+	if requested.StrictInit || active.StrictInit {
+		return NewConfigError(message, nil)
+	}
+	Warn("%s", message)
+	return nil
+}
+
 // IsInitialized checks if the middleware is properly initialized
 func IsInitialized() bool {
 	globalMu.RLock()
@@ -100,70 +210,376 @@ func NewReveniumFal(cfg *Config) (*ReveniumFal, error) {
 		return nil, err
 	}
 
-	falClient, err := NewFalClient(cfg)
-	if err != nil {
+	if err := cfg.checkAllowedHosts(); err != nil {
 		return nil, err
 	}
 
-	meteringClient, err := NewMeteringClient(cfg)
-	if err != nil {
-		return nil, err
+	// Use an injected FalGenerator (e.g. a test fake) when provided
+	var err error
+	falClient := cfg.FalGenerator
+	if falClient == nil {
+		falClient, err = NewFalClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Use an injected Meterer (e.g. a test fake) when provided
+	meteringClient := cfg.Meterer
+	if meteringClient == nil && cfg.meteringDisabled() {
+		Warn("No valid REVENIUM_METERING_API_KEY: metering is disabled (WithOptionalMetering); Fal.ai calls will not be metered")
+		meteringClient = disabledMeterer{}
+	}
+	if meteringClient == nil {
+		meteringClient, err = NewMeteringClient(cfg)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return &ReveniumFal{
+	r := &ReveniumFal{
 		config:         cfg,
 		falClient:      falClient,
 		meteringClient: meteringClient,
-	}, nil
+		downloadClient: &http.Client{Timeout: cfg.outputDownloadTimeout()},
+	}
+	if _, canBatch := meteringClient.(BatchMeterer); canBatch && cfg.MeteringBatchSize > 1 {
+		r.batcher = newMeteringBatcher(cfg.MeteringBatchSize, cfg.MeteringBatchInterval, func(batch []*MeteringPayload) {
+			go r.deliverBatch(batch)
+		})
+	}
+
+	return r, nil
 }
 
 // GetConfig returns the configuration
+//
+// Deprecated: GetConfig exposes the live configuration, including the raw
+// API keys. Use EffectiveConfig for a read-only view with the keys masked.
 func (r *ReveniumFal) GetConfig() *Config {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	return r.config
 }
 
-// GenerateImage generates images using Fal.ai with automatic metering
-func (r *ReveniumFal) GenerateImage(ctx context.Context, model string, request *FalRequest) (*FalImageResponse, error) {
-	// Extract metadata from context
-	metadata := GetUsageMetadata(ctx)
+// EffectiveConfig returns a redacted, read-only snapshot of the client's
+// resolved configuration, with API keys masked, for support and debugging.
+//
+// Example:
+//
+//	log.Printf("revenium config: %+v", client.EffectiveConfig())
+func (r *ReveniumFal) EffectiveConfig() ConfigSnapshot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.config.snapshot()
+}
 
-	// Record start time
-	startTime := time.Now()
+// GenerateImage generates images using Fal.ai with automatic metering.
+// CallOptions add usage metadata for this call on top of the context metadata.
+//
+// When the model has a fallback chain (WithModelFallback) and fails with a
+// retryable error, the fallbacks are tried in order; the model that succeeds
+// is metered, with attributes["fallbackFrom"] naming the requested model.
+func (r *ReveniumFal) GenerateImage(ctx context.Context, model string, request *FalRequest, opts ...CallOption) (*FalImageResponse, error) {
+	resp, err := r.generateImage(ctx, model, request, nil, opts)
+	for _, fallback := range r.config.ModelFallbacks[model] {
+		if err == nil || !isRetryableFalError(err) || ctx.Err() != nil {
+			break
+		}
+		Warn("Model %s failed with a retryable error, falling back to %s: %v", model, fallback, err)
+		fallbackOpts := append(opts[:len(opts):len(opts)], withCallAttribute("fallbackFrom", model))
+		resp, err = r.generateImage(ctx, fallback, request, nil, fallbackOpts)
+	}
+	return resp, err
+}
 
-	// Capture prompt before API call (for prompt capture feature)
-	var prompt string
+// generateImage runs a metered image generation, reporting each image to
+// onImage as it arrives when it is set. Streaming generations that fail
+// part-way are still metered for the images they delivered; the partial
+// response is returned with the error.
+func (r *ReveniumFal) generateImage(ctx context.Context, model string, request *FalRequest, onImage func(index int, image FalImage), opts []CallOption) (*FalImageResponse, error) {
+	if err := r.beginCall(); err != nil {
+		return nil, err
+	}
+	defer r.calls.Done()
+	r.warnModelName(model)
+
+	// Extract metadata from context, overridden by call options
+	metadata := r.metadataDefaults(callMetadata(r.contextMetadata(ctx), opts))
+
+	request = r.applyModelDefaults(model, request)
+	request, sanitized := r.sanitizeRequest(request)
+	if err := validateLoRAs(request); err != nil {
+		return nil, err
+	}
+
+	// Capture prompt and requested count before API call
+	var prompt, negativePrompt string
+	var requestedImages int
 	if request != nil {
 		prompt = request.Prompt
+		negativePrompt = request.NegativePrompt
+		requestedImages = request.NumImages
+	}
+	if err := r.checkSubscriberQuota(metadata, max(requestedImages, 1)); err != nil {
+		return nil, err
+	}
+	callAttrs := r.callAttributes(ctx, request)
+	for k, v := range callExtraAttributes(opts) {
+		callAttrs[k] = v
+	}
+	if sanitized {
+		callAttrs["promptSanitized"] = true
+	}
+	if request != nil && request.Seed != nil {
+		callAttrs["seed"] = *request.Seed
+	}
+	if request != nil {
+		// Both flags affect output and can affect cost/latency
+		callAttrs["syncMode"] = request.SyncMode
+		// false is omitted from the Fal request, so Fal applies its default;
+		// only an explicit true is known
+		if request.EnableSafetyChecker {
+			callAttrs["enableSafetyChecker"] = true
+		}
+	}
+	ctx, headers := r.captureFalHeaders(ctx)
+	ctx, timing := withQueueTiming(ctx)
+	ctx, endpoint := withFalEndpoint(ctx)
+	ctx, transactionID := r.reserveTransactionID(ctx)
+	meteringCancel := callMeteringCancellation(opts)
+	meteringDone := callMeteringDone(opts)
+
+	onFailure := func(attempt int, attemptStart time.Time, err error) {
+		if r.config.MeterErrors {
+			payload := buildImageMeteringPayload(model, &FalImageResponse{}, r.retryMetadata(metadata, attempt), time.Since(attemptStart), attemptStart, requestedImages, r.config.capturePromptText(), r.config.captureOutputs(), prompt, negativePrompt, nil, !r.config.DisableHTMLEscaping)
+			payload.cancel = meteringCancel
+			payload.logLevel = logLevelOverride(ctx)
+			payload.done = meteringDone
+			r.applyFalHeaders(payload, headers)
+			applyFalEndpoint(payload, endpoint)
+			r.meterFailure(OperationTypeImage, payload, callAttrs, err)
+		}
 	}
 
-	// Call Fal.ai API
-	resp, err := r.falClient.GenerateImage(ctx, model, request)
+	// Call Fal.ai API, retrying if built-in retry is configured
+	debugCtx(ctx, "Generating image with model %s", model)
+	var resp *FalImageResponse
+	var follower bool
+	coalesced := 1
+	emitted := 0
+	emit := func(index int, image FalImage) {
+		// A retried stream restarts from the first image; report each once
+		if index >= emitted {
+			emitted = index + 1
+			onImage(index, image)
+		}
+	}
+	attempt, startTime, err := r.callFal(ctx, func() (err error) {
+		if generator, ok := r.falClient.(StreamingImageGenerator); ok && onImage != nil {
+			resp, err = generator.GenerateImageStream(ctx, model, request, emit)
+			return err
+		}
+		var result interface{}
+		result, follower, coalesced, err = r.coalesce(ctx, OperationTypeImage, model, request, func() (interface{}, error) {
+			return r.falClient.GenerateImage(ctx, model, request)
+		})
+		resp, _ = result.(*FalImageResponse)
+		if coalesced > 1 {
+			// Each sharer gets its own copy to modify
+			resp = cloneImageResponse(resp)
+		}
+		if err == nil && resp != nil && onImage != nil {
+			for i, image := range resp.Images {
+				emit(i, image)
+			}
+		}
+		return err
+	}, onFailure)
 	if err != nil {
-		return nil, err
+		r.recordGeneration(ctx, OperationTypeImage, model, time.Since(startTime), err)
+		if onImage == nil || resp == nil || len(resp.Images) == 0 {
+			return nil, err
+		}
+		// Meter the images the stream delivered before it stopped
+		callAttrs["streamIncomplete"] = true
 	}
+	streamErr := err
+	metadata = r.retryMetadata(metadata, attempt)
 
-	// Calculate duration
+	// Calculate duration of the successful attempt
 	duration := time.Since(startTime)
+	r.latency.record(OperationTypeImage, duration)
+	if streamErr == nil {
+		r.recordGeneration(ctx, OperationTypeImage, model, duration, nil)
+	}
+
+	metadata = r.enrichMetadata(resp, metadata)
+	if uploads := r.uploadOutputs(ctx, resp); uploads != nil {
+		callAttrs["outputUploads"] = uploads
+	}
 
 	// Send metering data asynchronously (fire-and-forget)
-	r.wg.Add(1)
-	go func() {
-		defer r.wg.Done()
-		r.sendImageMetering(resp, model, metadata, duration, startTime, prompt)
-	}()
+	payload := r.buildImagePayload(ctx, resp, model, metadata, duration, startTime, requestedImages, prompt, negativePrompt)
+	payload.cancel = meteringCancel
+	payload.logLevel = logLevelOverride(ctx)
+	payload.done = meteringDone
+	reservedID := applyTraceHandle(ctx, payload)
+	if transactionID != "" {
+		payload.TransactionID = transactionID
+		reservedID = transactionID
+	}
+	for k, v := range callAttrs {
+		payload.setAttribute(k, v)
+	}
+	r.applyFalHeaders(payload, headers)
+	var reportedGPU string
+	if resp != nil {
+		reportedGPU = resp.GPUType
+	}
+	r.applyGPUType(payload, reportedGPU, headers)
+	applyQueueTiming(payload, timing)
+	applyFalEndpoint(payload, endpoint)
+	if !r.applyCoalescing(payload, follower, coalesced) {
+		return resp, streamErr
+	}
+	if r.config.PerImageMetering && resp != nil {
+		for _, p := range splitImageMeteringPayload(payload, resp.Images, r.config.captureOutputs(), !r.config.DisableHTMLEscaping, reservedID, r.config.newTransactionID) {
+			r.dispatchMetering(OperationTypeImage, p)
+		}
+	} else {
+		r.dispatchMetering(OperationTypeImage, payload)
+	}
 
-	return resp, nil
+	return resp, streamErr
 }
 
-// GenerateVideo generates a video using Fal.ai with automatic metering
-func (r *ReveniumFal) GenerateVideo(ctx context.Context, model string, request *FalRequest) (*FalVideoResponse, error) {
-	// Extract metadata from context
-	metadata := GetUsageMetadata(ctx)
+// GenerateImageAwaitMetering behaves like GenerateImage, but only returns
+// once this call's metering has been delivered, or has failed after its
+// retries. Unlike Flush, it waits for this call alone, not for other pending
+// metering, so request handlers can get metering durability without a global
+// barrier. Delivery failures are logged, not returned: a successful
+// generation is never reported as an error.
+func (r *ReveniumFal) GenerateImageAwaitMetering(ctx context.Context, model string, request *FalRequest, opts ...CallOption) (*FalImageResponse, error) {
+	var metered sync.WaitGroup
+	opts = append(opts[:len(opts):len(opts)], awaitMetering(&metered))
+	resp, err := r.GenerateImage(ctx, model, request, opts...)
+	if r.batcher != nil {
+		// Send the queued batch now rather than waiting out the interval
+		r.batcher.flush()
+	}
+	metered.Wait()
+	return resp, err
+}
+
+// GenerateVideo generates a video using Fal.ai with automatic metering.
+// CallOptions add usage metadata for this call on top of the context metadata.
+func (r *ReveniumFal) GenerateVideo(ctx context.Context, model string, request *FalRequest, opts ...CallOption) (*FalVideoResponse, error) {
+	return r.generateVideo(ctx, model, request, nil, opts)
+}
+
+// GenerateVideoBatch generates several videos, one per request, running up to
+// GenerationConcurrency Fal calls at once. Each clip is metered separately with
+// its own requested duration; all payloads share one traceId (the context's,
+// or a generated one) so the batch can be grouped in Revenium.
+//
+// Responses are returned in request order. If some clips fail, the successful
+// responses are still returned (failed slots are nil) together with an error
+// joining each failure, annotated with its request index.
+func (r *ReveniumFal) GenerateVideoBatch(ctx context.Context, model string, requests []*FalRequest, opts ...CallOption) ([]*FalVideoResponse, error) {
+	responses := make([]*FalVideoResponse, len(requests))
+	err := r.runBatch(ctx, len(requests), opts, func(i int, ctx context.Context, opts []CallOption) (err error) {
+		responses[i], err = r.generateVideo(ctx, model, requests[i], nil, opts)
+		return err
+	})
+	return responses, err
+}
+
+// GenerateImageSeedSweep generates baseReq once per seed, for reproducibility
+// testing, running up to GenerationConcurrency Fal calls at once. Each call is
+// metered separately with attributes["seed"] set to its seed; all payloads
+// share one traceId (the context's, or a generated one).
+//
+// Responses are returned in seed order. If some calls fail, the successful
+// responses are still returned (failed slots are nil) together with an error
+// joining each failure, annotated with its seed index.
+//
+// Example:
+//
+//	responses, err := client.GenerateImageSeedSweep(ctx, "fal-ai/flux/dev",
+//	    &revenium.FalRequest{Prompt: "a red fox"}, []int{1, 2, 3})
+func (r *ReveniumFal) GenerateImageSeedSweep(ctx context.Context, model string, baseReq *FalRequest, seeds []int, opts ...CallOption) ([]*FalImageResponse, error) {
+	if baseReq == nil {
+		baseReq = &FalRequest{}
+	}
+
+	responses := make([]*FalImageResponse, len(seeds))
+	err := r.runBatch(ctx, len(seeds), opts, func(i int, ctx context.Context, opts []CallOption) (err error) {
+		request := *baseReq
+		seed := seeds[i]
+		request.Seed = &seed
+		responses[i], err = r.GenerateImage(ctx, model, &request, opts...)
+		return err
+	})
+	return responses, err
+}
+
+// runBatch calls generate for indices 0..n-1, running up to
+// GenerationConcurrency at once. Every call gets the same traceId (the
+// context's, or a generated one) and, under a TraceHandle, its own child
+// handle so each has a distinct transaction ID. Failures are joined and
+// annotated with their index.
+func (r *ReveniumFal) runBatch(ctx context.Context, n int, opts []CallOption, generate func(i int, ctx context.Context, opts []CallOption) error) error {
+	traceID, _ := callMetadata(r.contextMetadata(ctx), opts)["traceId"].(string)
+	if traceID == "" {
+		traceID = r.config.newTransactionID()
+	}
+	opts = append(opts[:len(opts):len(opts)], WithMetadata(map[string]interface{}{"traceId": traceID}))
+
+	errs := make([]error, n)
+	sem := make(chan struct{}, r.config.generationConcurrency())
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			callCtx := ctx
+			if handle, ok := GetTraceHandle(ctx); ok {
+				if handle.newID == nil {
+					handle.newID = r.config.newTransactionID
+				}
+				callCtx, _ = handle.Child(ctx, handle.Name)
+			}
+			if err := generate(i, callCtx, opts); err != nil {
+				errs[i] = fmt.Errorf("request %d: %w", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// generateVideo runs a metered video generation, reporting job progress to
+// onProgress when it is set and the generator supports it
+func (r *ReveniumFal) generateVideo(ctx context.Context, model string, request *FalRequest, onProgress func(ProgressEvent), opts []CallOption) (*FalVideoResponse, error) {
+	if err := r.beginCall(); err != nil {
+		return nil, err
+	}
+	defer r.calls.Done()
+	r.warnModelName(model)
 
-	// Record start time
-	startTime := time.Now()
+	// Extract metadata from context, overridden by call options
+	metadata := r.metadataDefaults(callMetadata(r.contextMetadata(ctx), opts))
+
+	request = r.applyModelDefaults(model, request)
+	request, sanitized := r.sanitizeRequest(request)
+	if err := validateLoRAs(request); err != nil {
+		return nil, err
+	}
 
 	// Capture the requested duration and prompt before the goroutine
 	// Guard against nil request for defensive programming
@@ -173,34 +589,484 @@ func (r *ReveniumFal) GenerateVideo(ctx context.Context, model string, request *
 		requestedDuration = request.Duration
 		prompt = request.Prompt
 	}
+	if err := r.checkSubscriberQuota(metadata, 1); err != nil {
+		return nil, err
+	}
+	callAttrs := r.callAttributes(ctx, request)
+	if sanitized {
+		callAttrs["promptSanitized"] = true
+	}
+	ctx, headers := r.captureFalHeaders(ctx)
+	ctx, timing := withQueueTiming(ctx)
+	ctx, endpoint := withFalEndpoint(ctx)
+	ctx, transactionID := r.reserveTransactionID(ctx)
+	meteringCancel := callMeteringCancellation(opts)
+	meteringDone := callMeteringDone(opts)
 
-	// Call Fal.ai API
-	resp, err := r.falClient.GenerateVideo(ctx, model, request)
+	onFailure := func(attempt int, attemptStart time.Time, err error) {
+		if r.config.MeterErrors {
+			payload := buildVideoMeteringPayload(model, nil, r.retryMetadata(metadata, attempt), time.Since(attemptStart), attemptStart, requestedDuration, r.config.capturePromptText(), r.config.captureOutputs(), prompt, "", !r.config.DisableHTMLEscaping)
+			payload.cancel = meteringCancel
+			payload.logLevel = logLevelOverride(ctx)
+			payload.done = meteringDone
+			r.applyFalHeaders(payload, headers)
+			applyFalEndpoint(payload, endpoint)
+			payload.DurationSeconds = nil // No video was produced
+			r.meterFailure(OperationTypeVideo, payload, callAttrs, err)
+		}
+	}
+
+	// Call Fal.ai API, retrying if built-in retry is configured
+	debugCtx(ctx, "Generating video with model %s", model)
+	var resp *FalVideoResponse
+	var follower bool
+	coalesced := 1
+	attempt, startTime, err := r.callFal(ctx, func() (err error) {
+		if generator, ok := r.falClient.(ProgressVideoGenerator); ok && onProgress != nil {
+			resp, err = generator.GenerateVideoWithProgress(ctx, model, request, onProgress)
+		} else {
+			var result interface{}
+			result, follower, coalesced, err = r.coalesce(ctx, OperationTypeVideo, model, request, func() (interface{}, error) {
+				return r.falClient.GenerateVideo(ctx, model, request)
+			})
+			resp, _ = result.(*FalVideoResponse)
+			if coalesced > 1 {
+				resp = cloneVideoResponse(resp)
+			}
+		}
+		return err
+	}, onFailure)
 	if err != nil {
+		r.recordGeneration(ctx, OperationTypeVideo, model, time.Since(startTime), err)
 		return nil, err
 	}
+	metadata = r.retryMetadata(metadata, attempt)
 
-	// Calculate duration
+	// Calculate duration of the successful attempt
 	duration := time.Since(startTime)
+	r.latency.record(OperationTypeVideo, duration)
+	r.recordGeneration(ctx, OperationTypeVideo, model, duration, nil)
+
+	metadata = r.enrichMetadata(resp, metadata)
 
 	// Send metering data asynchronously (fire-and-forget)
-	r.wg.Add(1)
-	go func() {
-		defer r.wg.Done()
-		r.sendVideoMetering(resp, model, metadata, duration, startTime, requestedDuration, prompt)
-	}()
+	payload := r.buildVideoPayload(ctx, resp, model, metadata, duration, startTime, requestedDuration, prompt)
+	payload.cancel = meteringCancel
+	payload.logLevel = logLevelOverride(ctx)
+	payload.done = meteringDone
+	applyTraceHandle(ctx, payload)
+	if transactionID != "" {
+		payload.TransactionID = transactionID
+	}
+	for k, v := range callAttrs {
+		payload.setAttribute(k, v)
+	}
+	r.applyFalHeaders(payload, headers)
+	var reportedGPU string
+	if resp != nil {
+		reportedGPU = resp.GPUType
+	}
+	r.applyGPUType(payload, reportedGPU, headers)
+	applyQueueTiming(payload, timing)
+	applyFalEndpoint(payload, endpoint)
+	if r.applyCoalescing(payload, follower, coalesced) {
+		r.dispatchMetering(OperationTypeVideo, payload)
+	}
 
 	return resp, nil
 }
 
-// sendImageMetering sends image metering data in the background
-func (r *ReveniumFal) sendImageMetering(resp *FalImageResponse, model string, metadata map[string]interface{}, duration time.Duration, startTime time.Time, prompt string) {
-	defer func() {
-		if rec := recover(); rec != nil {
-			Error("Metering goroutine panic: %v", rec)
+// checkSubscriberQuota returns a *QuotaExceededError when the configured
+// SubscriberQuota reports fewer than requested generations left for the
+// metadata's subscriber
+func (r *ReveniumFal) checkSubscriberQuota(metadata map[string]interface{}, requested int) error {
+	if r.config.SubscriberQuota == nil {
+		return nil
+	}
+	subscriber, _ := metadata["subscriber"].(map[string]interface{})
+	if r.config.NormalizeSubscriberFields {
+		subscriber = NormalizeSubscriber(subscriber)
+	}
+	subscriberID, _ := subscriber["id"].(string)
+	if subscriberID == "" {
+		return nil
+	}
+
+	remaining, ok := r.config.SubscriberQuota(subscriberID)
+	if !ok || remaining >= requested {
+		return nil
+	}
+	Debug("Blocking generation for subscriber %s: quota has %d remaining, %d requested", subscriberID, remaining, requested)
+	return &QuotaExceededError{SubscriberID: subscriberID, Remaining: remaining, Requested: requested}
+}
+
+// captureFalHeaders wires ctx to record Fal response headers when
+// WithCaptureFalHeaders or WithCaptureGPUInfo is configured; otherwise the
+// capture is nil
+func (r *ReveniumFal) captureFalHeaders(ctx context.Context) (context.Context, *falHeaderCapture) {
+	if len(r.config.CaptureFalHeaders) == 0 && !r.config.CaptureGPUInfo {
+		return ctx, nil
+	}
+	return withFalHeaderCapture(ctx)
+}
+
+// applyFalHeaders adds the configured captured headers to the payload as
+// attributes["falHeaders"]
+func (r *ReveniumFal) applyFalHeaders(payload *MeteringPayload, capture *falHeaderCapture) {
+	if capture == nil {
+		return
+	}
+	if headers := capture.selected(r.config.CaptureFalHeaders, r.config.FalHeaderDenylist); headers != nil {
+		payload.setAttribute("falHeaders", headers)
+	}
+}
+
+// applyGPUType records the GPU the job ran on as attributes["gpuType"] when
+// WithCaptureGPUInfo is enabled, preferring the response body's value over the
+// GPU info header
+func (r *ReveniumFal) applyGPUType(payload *MeteringPayload, reported string, capture *falHeaderCapture) {
+	if !r.config.CaptureGPUInfo {
+		return
+	}
+	gpuType := strings.TrimSpace(reported)
+	if gpuType == "" && capture != nil {
+		gpuType = strings.TrimSpace(capture.get(r.config.gpuInfoHeader()))
+	}
+	if gpuType != "" {
+		payload.setAttribute("gpuType", gpuType)
+	}
+}
+
+// reserveTransactionID picks the successful payload's TransactionID before
+// the Fal call when WithSendTransactionHeader is enabled, returning a context
+// that sends it to Fal as the X-Revenium-Transaction-Id header. It returns ""
+// when the header is disabled.
+func (r *ReveniumFal) reserveTransactionID(ctx context.Context) (context.Context, string) {
+	if !r.config.SendTransactionHeader {
+		return ctx, ""
+	}
+	transactionID := r.config.newTransactionID()
+	if handle, ok := GetTraceHandle(ctx); ok {
+		transactionID = handle.TransactionID
+	}
+	return context.WithValue(ctx, transactionHeaderKey{}, transactionID), transactionID
+}
+
+// applyQueueTiming records a queued job's submit and start times as
+// attributes["submitTime"] and attributes["startTime"], so the queue wait is
+// visible; RequestTime stays at the submit time. Sync-host calls record neither.
+func applyQueueTiming(payload *MeteringPayload, timing *queueTiming) {
+	submitted, started := timing.times()
+	if submitted.IsZero() {
+		return
+	}
+	payload.setAttribute("submitTime", submitted.UTC().Format(time.RFC3339Nano))
+	if !started.IsZero() {
+		payload.setAttribute("startTime", started.UTC().Format(time.RFC3339Nano))
+	}
+}
+
+// applyFalEndpoint records the Fal endpoint that was called as
+// attributes["endpoint"], which exposes base URL and model prefix mistakes
+func applyFalEndpoint(payload *MeteringPayload, endpoint *falEndpoint) {
+	if url := endpoint.get(); url != "" {
+		payload.setAttribute("endpoint", url)
+	}
+}
+
+// applyModelDefaults returns a copy of request with its zero-valued fields
+// filled from the model's WithModelDefaults entry, or request itself when the
+// model has no defaults
+func (r *ReveniumFal) applyModelDefaults(model string, request *FalRequest) *FalRequest {
+	defaults, ok := r.config.ModelDefaults[model]
+	if !ok {
+		return request
+	}
+	merged := FalRequest{}
+	if request != nil {
+		merged = *request
+	}
+
+	if merged.Prompt == "" {
+		merged.Prompt = defaults.Prompt
+	}
+	if merged.NegativePrompt == "" {
+		merged.NegativePrompt = defaults.NegativePrompt
+	}
+	if merged.ImageSize == "" {
+		merged.ImageSize = defaults.ImageSize
+	}
+	if merged.NumInferenceSteps == 0 {
+		merged.NumInferenceSteps = defaults.NumInferenceSteps
+	}
+	if merged.GuidanceScale == 0 {
+		merged.GuidanceScale = defaults.GuidanceScale
+	}
+	if merged.NumImages == 0 {
+		merged.NumImages = defaults.NumImages
+	}
+	if merged.Seed == nil && defaults.Seed != nil {
+		seed := *defaults.Seed
+		merged.Seed = &seed
+	}
+	merged.EnableSafetyChecker = merged.EnableSafetyChecker || defaults.EnableSafetyChecker
+	merged.SyncMode = merged.SyncMode || defaults.SyncMode
+	if merged.Duration == "" {
+		merged.Duration = defaults.Duration
+	}
+	if merged.AspectRatio == "" {
+		merged.AspectRatio = defaults.AspectRatio
+	}
+	if len(merged.LoRAs) == 0 && len(defaults.LoRAs) > 0 {
+		merged.LoRAs = append([]LoRA(nil), defaults.LoRAs...)
+	}
+	return &merged
+}
+
+// sanitizeRequest returns a copy of request with its prompt sanitized when
+// prompt sanitization is enabled, reporting whether the prompt changed. The
+// caller's request is never modified.
+func (r *ReveniumFal) sanitizeRequest(request *FalRequest) (*FalRequest, bool) {
+	if !r.config.SanitizePrompts || request == nil {
+		return request, false
+	}
+	prompt := sanitizePrompt(request.Prompt)
+	negativePrompt := sanitizePrompt(request.NegativePrompt)
+	if prompt == request.Prompt && negativePrompt == request.NegativePrompt {
+		return request, false
+	}
+	sanitized := *request
+	sanitized.Prompt = prompt
+	sanitized.NegativePrompt = negativePrompt
+	return &sanitized, true
+}
+
+// LoRA scales accepted by validateLoRAs
+const (
+	minLoRAScale = 0.0
+	maxLoRAScale = 4.0
+)
+
+// validateLoRAs returns a ValidationError for a LoRA without a path or with
+// a scale that is NaN or outside [0, 4], before the request reaches Fal
+func validateLoRAs(request *FalRequest) error {
+	if request == nil {
+		return nil
+	}
+	for i, lora := range request.LoRAs {
+		if lora.Path == "" {
+			return NewValidationError(fmt.Sprintf("loras[%d]: path is required", i), nil)
+		}
+		if lora.Scale == nil {
+			continue
+		}
+		if scale := *lora.Scale; math.IsNaN(scale) || scale < minLoRAScale || scale > maxLoRAScale {
+			return NewValidationError(fmt.Sprintf("loras[%d]: scale %v is outside [%v, %v]", i, scale, minLoRAScale, maxLoRAScale), nil)
+		}
+	}
+	return nil
+}
+
+// sanitizePrompt strips control and invisible format characters (such as
+// zero-width spaces and byte order marks) and trims surrounding whitespace,
+// keeping newlines and tabs inside the prompt
+func sanitizePrompt(prompt string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, prompt)
+	return strings.TrimSpace(cleaned)
+}
+
+// hashPrompt returns the hex SHA-256 of the normalized prompt: sanitized,
+// lowercased, and with whitespace runs collapsed to single spaces, so trivial
+// formatting differences don't split identical prompts
+func hashPrompt(prompt string) string {
+	normalized := strings.ToLower(strings.Join(strings.Fields(sanitizePrompt(prompt)), " "))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// callFal runs a Fal call, retrying retryable failures up to FalMaxRetries
+// times with exponential backoff. onFailure is called for every failed
+// attempt. It returns the index of the last attempt (0 for the first) and
+// when that attempt started.
+func (r *ReveniumFal) callFal(ctx context.Context, call func() error, onFailure func(attempt int, attemptStart time.Time, err error)) (int, time.Time, error) {
+	backoff := r.config.FalRetryBackoff
+	if backoff <= 0 {
+		backoff = defaultFalRetryBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		attemptStart := time.Now()
+		err := call()
+		if err == nil {
+			return attempt, attemptStart, nil
+		}
+		onFailure(attempt, attemptStart, err)
+
+		if attempt >= r.config.FalMaxRetries || ctx.Err() != nil || !isRetryableFalError(err) {
+			return attempt, attemptStart, err
+		}
+
+		debugCtx(ctx, "Fal.ai call failed (attempt %d), retrying in %v: %v", attempt+1, backoff, err)
+		select {
+		case <-ctx.Done():
+			return attempt, attemptStart, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// retryMetadata records the attempt index as retryNumber when built-in retry
+// is enabled, replacing any value set by the caller
+func (r *ReveniumFal) retryMetadata(metadata map[string]interface{}, attempt int) map[string]interface{} {
+	if r.config.FalMaxRetries <= 0 {
+		return metadata
+	}
+	return MergeMetadata(metadata, map[string]interface{}{"retryNumber": attempt})
+}
+
+// callAttributes collects per-call metering attributes before the Fal call, so
+// they reflect the request as sent even if the caller mutates it afterwards
+func (r *ReveniumFal) callAttributes(ctx context.Context, request *FalRequest) map[string]interface{} {
+	attrs := make(map[string]interface{})
+	if requestID := GetRequestID(ctx); requestID != "" {
+		attrs["requestId"] = requestID
+	}
+	if r.config.CaptureRequestParams {
+		if params := requestParamsAttribute(request, r.config.capturePromptText()); params != nil {
+			attrs["falRequest"] = params
 		}
+	}
+	if r.config.PromptHashing && request != nil && request.Prompt != "" {
+		attrs["promptHash"] = hashPrompt(request.Prompt)
+	}
+	if request != nil && len(request.LoRAs) > 0 {
+		// Attribute cost to the fine-tunes used
+		loras := make([]map[string]interface{}, len(request.LoRAs))
+		for i, lora := range request.LoRAs {
+			scale := 1.0 // Fal's default when scale is omitted
+			if lora.Scale != nil {
+				scale = *lora.Scale
+			}
+			loras[i] = map[string]interface{}{"path": lora.Path, "scale": scale}
+		}
+		attrs["loras"] = loras
+		attrs["loraCount"] = len(request.LoRAs)
+	}
+	return attrs
+}
+
+// applyTraceHandle gives a successful call's payload the transaction ID
+// reserved by the context's TraceHandle, so child operations can reference it.
+// It returns the reserved ID, or "" when ctx carries no handle.
+func applyTraceHandle(ctx context.Context, payload *MeteringPayload) string {
+	handle, ok := GetTraceHandle(ctx)
+	if !ok {
+		return ""
+	}
+	payload.TransactionID = handle.TransactionID
+	return handle.TransactionID
+}
+
+// maxWarnedModelNames bounds how many model names warnModelName remembers
+const maxWarnedModelNames = 1024
+
+// warnModelName logs the normalization warning for a model name missing its
+// fal-ai/ segment the first time this client sees it, so intentional short
+// names don't flood the logs. Once maxWarnedModelNames names are remembered
+// the record is cleared, so each may be warned about once more.
+func (r *ReveniumFal) warnModelName(model string) {
+	_, warning := normalizeModel(model)
+	if warning == "" {
+		return
+	}
+
+	r.warnedModelsMu.Lock()
+	if _, warned := r.warnedModels[model]; warned {
+		r.warnedModelsMu.Unlock()
+		return
+	}
+	if r.warnedModels == nil || len(r.warnedModels) >= maxWarnedModelNames {
+		r.warnedModels = make(map[string]struct{})
+	}
+	r.warnedModels[model] = struct{}{}
+	r.warnedModelsMu.Unlock()
+
+	Warn("%s", warning)
+}
+
+// metadataDefaults fills in client-level defaults for metadata keys the
+// request omits
+func (r *ReveniumFal) metadataDefaults(metadata map[string]interface{}) map[string]interface{} {
+	if r.config.DefaultCostType == "" {
+		return metadata
+	}
+	if _, exists := metadata["costType"]; exists {
+		return metadata
+	}
+	return MergeMetadata(metadata, map[string]interface{}{"costType": r.config.DefaultCostType})
+}
+
+// contextMetadata returns the usage metadata for a call, filling in trace fields
+// from a context TraceHandle, then traceId from the configured TraceIDExtractor
+// or a context traceparent, when not set explicitly
+func (r *ReveniumFal) contextMetadata(ctx context.Context) map[string]interface{} {
+	metadata := GetUsageMetadata(ctx)
+	if handle, ok := GetTraceHandle(ctx); ok {
+		metadata = traceHandleMetadata(metadata, handle)
+	}
+	if _, exists := metadata["traceId"]; exists {
+		return metadata
+	}
+
+	var traceID string
+	if r.config.TraceIDExtractor != nil {
+		traceID = r.config.TraceIDExtractor(ctx)
+	}
+	if traceID == "" {
+		traceID = TraceIDFromTraceparent(GetTraceparent(ctx))
+	}
+	if traceID == "" {
+		return metadata
+	}
+
+	return MergeMetadata(metadata, map[string]interface{}{"traceId": traceID})
+}
+
+// enrichMetadata runs the configured ResponseEnricher against a copy of the
+// usage metadata, so the caller's map in the context is never mutated
+func (r *ReveniumFal) enrichMetadata(resp interface{}, metadata map[string]interface{}) map[string]interface{} {
+	if r.config.ResponseEnricher == nil {
+		return metadata
+	}
+
+	enriched := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		enriched[k] = v
+	}
+
+	func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				Error("Response enricher panic: %v", rec)
+			}
+		}()
+		r.config.ResponseEnricher(resp, enriched)
 	}()
 
+	return enriched
+}
+
+// buildImagePayload builds the image metering payload for a completed generation
+func (r *ReveniumFal) buildImagePayload(ctx context.Context, resp *FalImageResponse, model string, metadata map[string]interface{}, duration time.Duration, startTime time.Time, requestedImages int, prompt, negativePrompt string) *MeteringPayload {
 	// Capture output URLs for prompt capture
 	var outputURLs []string
 	if resp != nil {
@@ -209,46 +1075,464 @@ func (r *ReveniumFal) sendImageMetering(resp *FalImageResponse, model string, me
 		}
 	}
 
-	payload := buildImageMeteringPayload(model, resp, metadata, duration, startTime, r.config.CapturePrompts, prompt, outputURLs)
+	payload := buildImageMeteringPayload(model, resp, metadata, duration, startTime, requestedImages, r.config.capturePromptText(), r.config.captureOutputs(), prompt, negativePrompt, outputURLs, !r.config.DisableHTMLEscaping)
+	if resp != nil {
+		applyDurationSource(payload, r.config.DurationSource, resp.TimeTaken)
+		if r.config.CaptureModerationData && len(resp.NSFWConcepts) > 0 {
+			payload.setAttribute("nsfwConcepts", resp.NSFWConcepts)
+		}
+		if hashes := r.outputHashes(ctx, r.config.OutputHashing, outputURLs); hashes != nil {
+			payload.setAttribute("outputHashes", hashes)
+		}
+		if len(resp.Images) > 0 {
+			r.applyContentType(payload, resp.Images[0].ContentType, resp.Images[0].URL)
+		}
+		r.applyOutputExpiry(payload, outputURLs)
+	}
+	r.applyPayloadOptions(payload)
+	return payload
+}
 
-	if err := r.meteringClient.SendImageMetering(payload); err != nil {
-		Error("Failed to send image metering data: %v", err)
+// buildVideoPayload builds the video metering payload for a completed generation
+func (r *ReveniumFal) buildVideoPayload(ctx context.Context, resp *FalVideoResponse, model string, metadata map[string]interface{}, duration time.Duration, startTime time.Time, requestedDuration string, prompt string) *MeteringPayload {
+	// Capture output URL for prompt capture
+	var outputURL string
+	if resp != nil && resp.Video.URL != "" {
+		outputURL = resp.Video.URL
+	}
+
+	payload := buildVideoMeteringPayload(model, resp, metadata, duration, startTime, requestedDuration, r.config.capturePromptText(), r.config.captureOutputs(), prompt, outputURL, !r.config.DisableHTMLEscaping)
+	if resp != nil {
+		applyDurationSource(payload, r.config.DurationSource, resp.TimeTaken)
+		if hashes := r.outputHashes(ctx, r.config.OutputHashing, []string{outputURL}); hashes != nil && outputURL != "" {
+			payload.setAttribute("outputHashes", hashes)
+		}
+		r.applyContentType(payload, resp.Video.ContentType, resp.Video.URL)
+		r.applyOutputExpiry(payload, []string{outputURL})
+	}
+	r.applyPayloadOptions(payload)
+	return payload
+}
+
+// applyContentType records the output's MIME type as attributes["contentType"],
+// normalized unless WithContentTypeNormalization(false) is set
+func (r *ReveniumFal) applyContentType(payload *MeteringPayload, contentType, outputURL string) {
+	if !r.config.DisableContentTypeNormalization {
+		contentType = normalizeContentType(contentType, outputURL)
+	}
+	if contentType != "" {
+		payload.setAttribute("contentType", contentType)
 	}
 }
 
-// sendVideoMetering sends video metering data in the background
-func (r *ReveniumFal) sendVideoMetering(resp *FalVideoResponse, model string, metadata map[string]interface{}, duration time.Duration, startTime time.Time, requestedDuration string, prompt string) {
+// applyOutputExpiry records the earliest presigned URL expiry among the
+// outputs as attributes["outputExpiresAt"] when WithCaptureOutputExpiry is set
+func (r *ReveniumFal) applyOutputExpiry(payload *MeteringPayload, outputURLs []string) {
+	if !r.config.CaptureOutputExpiry {
+		return
+	}
+	if expiresAt, ok := earliestOutputExpiry(outputURLs); ok {
+		payload.setAttribute("outputExpiresAt", expiresAt.UTC().Format(time.RFC3339))
+	}
+}
+
+// meterFailure dispatches a metering payload for a failed Fal call
+func (r *ReveniumFal) meterFailure(opType OperationType, payload *MeteringPayload, callAttrs map[string]interface{}, err error) {
+	payload.StopReason = stopReasonForError(err)
+	payload.setAttribute("errorCategory", errorCategory(err))
+	payload.setAttribute("errorMessage", redactErrorMessage(err.Error()))
+	r.applyPayloadOptions(payload)
+	for k, v := range callAttrs {
+		payload.setAttribute(k, v)
+	}
+	r.dispatchMetering(opType, payload)
+}
+
+// applyPayloadOptions applies client-level configuration to a built payload
+func (r *ReveniumFal) applyPayloadOptions(payload *MeteringPayload) {
+	if r.config.hasCustomTransactionIDs() {
+		payload.TransactionID = r.config.newTransactionID()
+	}
+	if payload.OrganizationID == "" && payload.OrganizationName == "" {
+		payload.OrganizationID = r.config.ReveniumOrgID
+	}
+	if payload.ProductID == "" && payload.ProductName == "" {
+		payload.ProductID = r.config.ReveniumProductID
+	}
+	if payload.CredentialAlias == "" {
+		payload.CredentialAlias = r.config.FalCredentialAlias
+	}
+	if payload.Environment == "" {
+		payload.Environment = r.config.DefaultEnvironment
+	}
+	if payload.Region == "" {
+		payload.Region = r.config.DefaultRegion
+	}
+	if r.config.NormalizeSubscriberFields {
+		payload.Subscriber = NormalizeSubscriber(payload.Subscriber)
+	}
+	if !r.config.DisableQualityScoreClamp {
+		clampQualityScore(payload)
+	}
+	if r.config.BuildVersion != "" {
+		payload.setAttribute("buildVersion", r.config.BuildVersion)
+	}
+	if r.config.GitCommit != "" {
+		payload.setAttribute("gitCommit", r.config.GitCommit)
+	}
+	if r.config.ModelTierClassifier != nil {
+		tier := r.config.ModelTierClassifier(strings.TrimPrefix(payload.Model, "fal_ai/"))
+		if tier == "" {
+			tier = ModelTierUnknown
+		}
+		payload.setAttribute("modelTier", tier)
+	}
+	mergeCostAllocationTags(payload, r.config.CostAllocationTags)
+}
+
+// dispatchMetering sends a metering payload in the background (fire-and-forget).
+// The payload is tracked until delivery completes so Drain can report it if needed.
+func (r *ReveniumFal) dispatchMetering(opType OperationType, payload *MeteringPayload) {
+	r.trackBatchChild(payload)
+	if !applySampling(payload, r.config.sampleRate(), rand.Float64()) {
+		Debug("Metering for transaction %s skipped by sampling", payload.TransactionID)
+		return
+	}
+	if payload.done != nil {
+		payload.done.Add(1)
+	}
+
+	r.meteringMu.Lock()
+	if r.inflight == nil {
+		r.inflight = make(map[*MeteringPayload]struct{})
+	}
+	r.inflight[payload] = struct{}{}
+	r.meteringMu.Unlock()
+	r.addQueueDepth(1)
+
+	r.wg.Add(1)
+	if r.inSyncWarmup() {
+		if !r.deliverMetering(opType, payload) {
+			Error("Metering failed during synchronous warm-up - check REVENIUM_METERING_API_KEY and REVENIUM_METERING_BASE_URL (transaction %s)", payload.TransactionID)
+		}
+		return
+	}
+	if r.batcher != nil {
+		r.batcher.add(payload)
+		return
+	}
+	if r.config.OrderedMeteringPerTrace && payload.TraceID != "" {
+		r.deliverInTraceOrder(opType, payload)
+		return
+	}
+	if r.config.SyncMeteringBudget > 0 {
+		r.deliverWithinBudget(opType, payload, r.config.SyncMeteringBudget)
+		return
+	}
+	go r.deliverMetering(opType, payload)
+}
+
+// deliverInTraceOrder queues a payload behind earlier payloads with the same
+// TraceID, starting a delivery worker for the trace if none is running
+func (r *ReveniumFal) deliverInTraceOrder(opType OperationType, payload *MeteringPayload) {
+	r.traceMu.Lock()
+	if r.traceQueues == nil {
+		r.traceQueues = make(map[string][]queuedMetering)
+	}
+	queue, running := r.traceQueues[payload.TraceID]
+	r.traceQueues[payload.TraceID] = append(queue, queuedMetering{opType, payload})
+	r.traceMu.Unlock()
+
+	if !running {
+		go r.drainTraceQueue(payload.TraceID)
+	}
+}
+
+// drainTraceQueue delivers a trace's queued payloads one at a time, in
+// submission order, until the queue is empty
+func (r *ReveniumFal) drainTraceQueue(traceID string) {
+	for {
+		r.traceMu.Lock()
+		queue := r.traceQueues[traceID]
+		if len(queue) == 0 {
+			delete(r.traceQueues, traceID)
+			r.traceMu.Unlock()
+			return
+		}
+		next := queue[0]
+		r.traceQueues[traceID] = queue[1:]
+		r.traceMu.Unlock()
+
+		r.deliverMetering(next.opType, next.payload)
+	}
+}
+
+// deliverWithinBudget starts delivering a payload and waits up to budget for
+// it to finish; a slower delivery carries on in the background
+func (r *ReveniumFal) deliverWithinBudget(opType OperationType, payload *MeteringPayload, budget time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.deliverMetering(opType, payload)
+	}()
+
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		Debug("Metering for transaction %s exceeded the %v sync budget, continuing in background", payload.TransactionID, budget)
+	}
+}
+
+// inSyncWarmup reports whether this send falls within the synchronous warm-up
+func (r *ReveniumFal) inSyncWarmup() bool {
+	if r.config.SyncMeteringWarmup <= 0 {
+		return false
+	}
+	return atomic.AddInt64(&r.syncSends, 1) <= int64(r.config.SyncMeteringWarmup)
+}
+
+// deliverMetering sends a single metering payload, records the outcome, and
+// reports whether it was delivered. The payload is fully built before delivery
+// starts, so a panic can only come from the send; the payload is then retained
+// for Drain instead of being lost.
+func (r *ReveniumFal) deliverMetering(opType OperationType, payload *MeteringPayload) (delivered bool) {
 	defer func() {
+		panicked := false
 		if rec := recover(); rec != nil {
-			Error("Metering goroutine panic: %v", rec)
+			Error("Metering send panicked for transaction %s, retaining payload for Drain: %v", payload.TransactionID, rec)
+			panicked = true
 		}
+		r.finishMetering(payload, delivered, panicked)
 	}()
 
-	// Capture output URL for prompt capture
-	var outputURL string
-	if resp != nil && resp.Video.URL != "" {
-		outputURL = resp.Video.URL
+	if payload.cancelled() {
+		Debug("Metering for transaction %s cancelled before sending, skipping", payload.TransactionID)
+		return true // Nothing left to deliver
+	}
+	payload.formatCapturedPrompt(!r.config.DisableHTMLEscaping)
+
+	var err error
+	switch opType {
+	case OperationTypeVideo:
+		err = r.meteringClient.SendVideoMetering(payload)
+	default:
+		err = r.meteringClient.SendImageMetering(payload)
+	}
+	if err != nil {
+		Error("Failed to send %s metering data: %v", strings.ToLower(string(opType)), err)
+		return false
 	}
+	return true
+}
 
-	payload := buildVideoMeteringPayload(model, resp, metadata, duration, startTime, requestedDuration, r.config.CapturePrompts, prompt, outputURL)
+// deliverBatch sends a batch of payloads in one request, falling back to
+// per-payload delivery if the batch endpoint fails
+func (r *ReveniumFal) deliverBatch(batch []*MeteringPayload) {
+	pending := batch[:0:0]
+	for _, payload := range batch {
+		if payload.cancelled() {
+			Debug("Metering for transaction %s cancelled before sending, skipping", payload.TransactionID)
+			r.finishMetering(payload, true, false)
+			continue
+		}
+		payload.formatCapturedPrompt(!r.config.DisableHTMLEscaping)
+		pending = append(pending, payload)
+	}
+	if len(pending) == 0 {
+		return
+	}
+	batch = pending
+
+	err := r.sendBatch(batch)
+	if err == nil {
+		for _, payload := range batch {
+			r.finishMetering(payload, true, false)
+		}
+		return
+	}
 
-	if err := r.meteringClient.SendVideoMetering(payload); err != nil {
-		Error("Failed to send video metering data: %v", err)
+	Warn("Batch metering failed, falling back to individual delivery for %d payloads: %v", len(batch), err)
+	for _, payload := range batch {
+		r.deliverMetering(OperationType(payload.OperationType), payload)
 	}
 }
 
+// sendBatch sends a batch through the BatchMeterer, converting a panic into an
+// error so the payloads fall back to individual delivery
+func (r *ReveniumFal) sendBatch(batch []*MeteringPayload) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("batch send panicked: %v", rec)
+		}
+	}()
+	return r.meteringClient.(BatchMeterer).SendBatchMetering(batch)
+}
+
+// maxRetainedPanics caps how many payloads whose send panicked are kept for
+// Drain outside of draining, so a persistently panicking sender can't grow
+// memory without bound
+const maxRetainedPanics = 1000
+
+// finishMetering records the outcome of a dispatched payload. Payloads whose
+// send panicked are retained for Drain even when not draining.
+func (r *ReveniumFal) finishMetering(payload *MeteringPayload, delivered, panicked bool) {
+	defer r.wg.Done()
+	if payload.done != nil {
+		defer payload.done.Done()
+	}
+	defer r.addQueueDepth(-1)
+
+	r.meteringMu.Lock()
+	defer r.meteringMu.Unlock()
+	delete(r.inflight, payload)
+	// Failures are only retained while draining, or (up to a cap) when the
+	// send panicked; otherwise they are logged and dropped to avoid
+	// unbounded memory growth.
+	switch {
+	case delivered:
+	case r.draining:
+		r.undelivered = append(r.undelivered, payload)
+	case panicked && len(r.undelivered) < maxRetainedPanics:
+		r.undelivered = append(r.undelivered, payload)
+	case panicked:
+		Error("Dropping metering for transaction %s: %d panicked payloads already awaiting Drain", payload.TransactionID, maxRetainedPanics)
+	}
+}
+
+// beginCall registers an in-flight generation call, or returns an error if
+// the client no longer accepts requests. Callers must call r.calls.Done().
+func (r *ReveniumFal) beginCall() error {
+	r.meteringMu.Lock()
+	defer r.meteringMu.Unlock()
+	if r.shuttingDown {
+		return ErrShuttingDown
+	}
+	if r.draining {
+		return NewConfigError("client is draining, no new requests are accepted", nil)
+	}
+	r.calls.Add(1)
+	return nil
+}
+
 // Flush waits for all pending metering goroutines to complete.
 // Call this before application shutdown to ensure all metering data is sent.
+// When batching is enabled, any partial batch is sent immediately.
 func (r *ReveniumFal) Flush() {
+	if r.batcher != nil {
+		r.batcher.flush()
+	}
 	r.wg.Wait()
 }
 
+// Drain stops accepting new generation requests, waits for generation calls
+// already in flight and then pending metering deliveries to finish within the
+// context deadline, and returns every payload that could not be delivered:
+// those whose delivery failed during the drain, those whose send panicked at
+// any time, and those still in flight when the context expired. In-flight
+// payloads may still be delivered after Drain returns, so replay should be
+// idempotent on TransactionID.
+//
+// Unlike Flush, Drain gives visibility into undelivered data so callers with
+// strict billing requirements can persist and replay it themselves.
+//
+// Example:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+//	defer cancel()
+//	for _, p := range client.Drain(ctx) {
+//	    persistForReplay(p)
+//	}
+func (r *ReveniumFal) Drain(ctx context.Context) []*MeteringPayload {
+	r.meteringMu.Lock()
+	r.draining = true
+	r.meteringMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		// Calls must finish first: each may still dispatch metering
+		r.calls.Wait()
+		r.Flush()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		Warn("Drain deadline reached with generations or metering still in flight: %v", ctx.Err())
+	}
+
+	r.meteringMu.Lock()
+	defer r.meteringMu.Unlock()
+
+	undelivered := make([]*MeteringPayload, 0, len(r.undelivered)+len(r.inflight))
+	undelivered = append(undelivered, r.undelivered...)
+	for payload := range r.inflight {
+		undelivered = append(undelivered, payload)
+	}
+	r.undelivered = nil
+	// Payloads that never reached delivery still hold their prompt raw;
+	// format it so callers replaying them don't lose it
+	for _, payload := range undelivered {
+		payload.formatCapturedPrompt(!r.config.DisableHTMLEscaping)
+	}
+	return undelivered
+}
+
+// Shutdown gracefully stops the client. New GenerateImage/GenerateVideo calls
+// fail with ErrShuttingDown; Fal calls already in flight are allowed to finish
+// and dispatch their metering; then all pending metering is delivered. Unlike
+// Close, which only waits for metering already dispatched, Shutdown doesn't
+// lose metering for generations that complete during shutdown.
+//
+// If ctx expires first, Shutdown returns ctx.Err() and any remaining calls
+// and deliveries continue in the background.
+//
+// Example:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+//	defer cancel()
+//	if err := client.Shutdown(ctx); err != nil {
+//	    log.Printf("shutdown incomplete: %v", err)
+//	}
+func (r *ReveniumFal) Shutdown(ctx context.Context) error {
+	r.meteringMu.Lock()
+	r.shuttingDown = true
+	r.meteringMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		// Calls must finish first: each may still dispatch metering
+		r.calls.Wait()
+		r.Flush()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		Warn("Shutdown deadline reached with generations or metering still in flight: %v", ctx.Err())
+		return ctx.Err()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if closer, ok := r.meteringClient.(interface{ Close() }); ok {
+		closer.Close()
+	}
+	return nil
+}
+
 // Close closes the client and cleans up resources.
 // It calls Flush() to ensure all pending metering operations complete.
 func (r *ReveniumFal) Close() error {
 	r.Flush()
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if closer, ok := r.meteringClient.(interface{ Close() }); ok {
+		closer.Close()
+	}
 	return nil
 }
 
@@ -0,0 +1,62 @@
+package revenium
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// outputHashes returns the hex SHA-256 of each output under mode, in order.
+// Outputs that cannot be downloaded in bytes mode get an empty hash so the
+// result stays aligned with urls.
+func (r *ReveniumFal) outputHashes(ctx context.Context, mode OutputHashMode, urls []string) []string {
+	if mode == OutputHashNone || len(urls) == 0 {
+		return nil
+	}
+
+	hashes := make([]string, len(urls))
+	for i, url := range urls {
+		if url == "" {
+			continue
+		}
+		switch mode {
+		case OutputHashSHA256OfURL:
+			sum := sha256.Sum256([]byte(url))
+			hashes[i] = hex.EncodeToString(sum[:])
+		case OutputHashSHA256OfBytes:
+			hash, err := r.hashOutputBytes(ctx, url)
+			if err != nil {
+				Warn("Failed to hash output %s: %s", redactURLQuery(url), redactErrorMessage(err.Error()))
+				continue
+			}
+			hashes[i] = hash
+		}
+	}
+	return hashes
+}
+
+// hashOutputBytes downloads url and returns the hex SHA-256 of its body
+func (r *ReveniumFal) hashOutputBytes(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.downloadClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,125 @@
+package revenium
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// ProgressEvent reports the state of a queued Fal.ai job
+type ProgressEvent struct {
+	Status        string  // IN_QUEUE, IN_PROGRESS, or COMPLETED
+	Percent       float64 // 0-100; never decreases over the life of a job
+	Message       string  // Latest log line, or a queue position summary
+	QueuePosition int     // Position in the queue while IN_QUEUE
+}
+
+// VideoResult is the final outcome of SubmitVideoWithProgress
+type VideoResult struct {
+	Response *FalVideoResponse
+	Err      error
+}
+
+// ProgressVideoGenerator is a FalGenerator that can report job progress.
+// FalClient implements it; injected generators that don't are still usable
+// with SubmitVideoWithProgress but emit no progress events.
+type ProgressVideoGenerator interface {
+	GenerateVideoWithProgress(ctx context.Context, model string, request *FalRequest, onProgress func(ProgressEvent)) (*FalVideoResponse, error)
+}
+
+// percentPattern finds percentages such as "45%" or "12.5 %" in job log lines
+var percentPattern = regexp.MustCompile(`(\d{1,3}(?:\.\d+)?)\s*%`)
+
+// progressTracker converts queue status polls into monotonic progress events
+type progressTracker struct {
+	percent float64
+	logSeen int
+	message string
+}
+
+// update folds a status poll into the tracker and returns the resulting event.
+// Percent comes from the status "progress" field when present, otherwise from
+// the most recent percentage found in new job log lines.
+func (p *progressTracker) update(status *falQueueStatus) ProgressEvent {
+	// Status polls with ?logs=1 return the full log so far; only scan new lines
+	if p.logSeen > len(status.Logs) {
+		p.logSeen = 0
+	}
+	for _, line := range status.Logs[p.logSeen:] {
+		p.message = line.Message
+		if m := percentPattern.FindStringSubmatch(line.Message); m != nil {
+			if pct, err := strconv.ParseFloat(m[1], 64); err == nil {
+				p.setPercent(pct)
+			}
+		}
+	}
+	p.logSeen = len(status.Logs)
+
+	if status.Progress != nil {
+		p.setPercent(*status.Progress)
+	}
+
+	message := p.message
+	switch status.Status {
+	case falQueueStatusInQueue:
+		message = fmt.Sprintf("In queue (position %d)", status.QueuePosition)
+	case falQueueStatusCompleted:
+		p.setPercent(100)
+	}
+
+	return ProgressEvent{
+		Status:        status.Status,
+		Percent:       p.percent,
+		Message:       message,
+		QueuePosition: status.QueuePosition,
+	}
+}
+
+// setPercent raises the tracked percentage, clamped to 100
+func (p *progressTracker) setPercent(pct float64) {
+	if pct > 100 {
+		pct = 100
+	}
+	if pct > p.percent {
+		p.percent = pct
+	}
+}
+
+// SubmitVideoWithProgress submits a video generation to the Fal queue and
+// streams progress while it runs. Progress events are sent on the first
+// channel, which is closed when the job finishes; the final response or error
+// is then sent on the second channel, which is closed afterwards. Metering is
+// sent once, on successful completion, exactly as for GenerateVideo.
+//
+// Cancelling ctx stops polling and closes both channels, with the context
+// error delivered as the result. Callers should drain the progress channel
+// (or cancel ctx) to avoid stalling the job's polling loop.
+//
+// Example:
+//
+//	progress, result := client.SubmitVideoWithProgress(ctx, "fal-ai/kling-video/v1/standard/text-to-video", req)
+//	for ev := range progress {
+//	    fmt.Printf("%.0f%% %s\n", ev.Percent, ev.Message)
+//	}
+//	res := <-result
+func (r *ReveniumFal) SubmitVideoWithProgress(ctx context.Context, model string, request *FalRequest, opts ...CallOption) (<-chan ProgressEvent, <-chan VideoResult) {
+	progress := make(chan ProgressEvent, 16)
+	result := make(chan VideoResult, 1)
+
+	go func() {
+		onProgress := func(ev ProgressEvent) {
+			select {
+			case progress <- ev:
+			case <-ctx.Done():
+			}
+		}
+
+		resp, err := r.generateVideo(ctx, model, request, onProgress, opts)
+		close(progress)
+		result <- VideoResult{Response: resp, Err: err}
+		close(result)
+	}()
+
+	return progress, result
+}
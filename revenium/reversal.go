@@ -0,0 +1,80 @@
+package revenium
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+)
+
+// StopReasonReversal marks a metering record that reverses an earlier one
+const StopReasonReversal = "REVERSAL"
+
+// MeterReversal sends a metering record reversing an earlier generation, for
+// example after a disputed output is credited back, so finance can reconcile
+// the charge. The record has StopReason "REVERSAL", references the original
+// as its parentTransactionId and attributes["reversedTransactionId"], and
+// carries the negated totalCost.
+//
+// metadata takes the usual usage metadata keys and must include "totalCost",
+// the amount being reversed (its sign is ignored). The optional "model" and
+// "operationType" ("IMAGE" or "VIDEO", default "IMAGE") keys should match the
+// original record. Context usage metadata and client defaults, such as
+// WithDefaultCostType, fill in keys the metadata omits.
+//
+// Unlike generation metering, the reversal is sent synchronously, is never
+// sampled, and delivery errors are returned.
+//
+// Example:
+//
+//	err := client.MeterReversal(ctx, originalTxID, map[string]interface{}{
+//	    "model":     "fal-ai/flux/dev",
+//	    "totalCost": 0.025,
+//	})
+func (r *ReveniumFal) MeterReversal(ctx context.Context, originalTransactionID string, metadata map[string]interface{}) error {
+	if originalTransactionID == "" {
+		return NewValidationError("original transaction ID is required", nil)
+	}
+	metadata = r.metadataDefaults(MergeMetadata(r.contextMetadata(ctx), metadata))
+
+	opType := OperationTypeImage
+	if value, _ := metadata["operationType"].(string); value != "" {
+		opType = OperationType(strings.ToUpper(value))
+		if opType != OperationTypeImage && opType != OperationTypeVideo {
+			return NewValidationError("operationType must be IMAGE or VIDEO, got "+value, nil)
+		}
+	}
+
+	now := time.Now()
+	payload := &MeteringPayload{
+		StopReason:       StopReasonReversal,
+		CostType:         "AI",
+		OperationType:    string(opType),
+		Provider:         "fal_ai",
+		ModelSource:      "FAL",
+		TransactionID:    generateTransactionID(),
+		RequestTime:      now,
+		ResponseTime:     now,
+		MiddlewareSource: GetMiddlewareSource(),
+	}
+	if model, _ := metadata["model"].(string); model != "" {
+		r.warnModelName(model)
+		payload.Model = normalizeModelName(model)
+	}
+	applyUsageMetadata(payload, metadata)
+	if payload.TotalCost == nil {
+		return NewValidationError("totalCost is required to meter a reversal", nil)
+	}
+	reversed := -math.Abs(*payload.TotalCost)
+	payload.TotalCost = &reversed
+	payload.ParentTransactionID = originalTransactionID
+	payload.logLevel = logLevelOverride(ctx)
+	r.applyPayloadOptions(payload)
+	payload.setAttribute("reversedTransactionId", originalTransactionID)
+
+	debugCtx(ctx, "Metering reversal of transaction %s", originalTransactionID)
+	if opType == OperationTypeVideo {
+		return r.meteringClient.SendVideoMetering(payload)
+	}
+	return r.meteringClient.SendImageMetering(payload)
+}
@@ -0,0 +1,86 @@
+package revenium
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMeterReversal(t *testing.T) {
+	client, meterer := newFakeClient(t, &fakeGenerator{}, WithReveniumOrgID("acme"))
+
+	ctx := WithUsageMetadata(context.Background(), map[string]interface{}{"environment": "production"})
+	err := client.MeterReversal(ctx, "tx-original", map[string]interface{}{
+		"model":         "fal-ai/kling-video",
+		"operationType": "video",
+		"totalCost":     0.25,
+		"subscriber":    map[string]interface{}{"id": "user-1"},
+	})
+	if err != nil {
+		t.Fatalf("MeterReversal() error = %v", err)
+	}
+
+	payloads := meterer.recorded()
+	if len(payloads) != 1 {
+		t.Fatalf("got %d payloads, want 1", len(payloads))
+	}
+	p := payloads[0]
+	if p.StopReason != StopReasonReversal {
+		t.Errorf("StopReason = %q, want %q", p.StopReason, StopReasonReversal)
+	}
+	if p.ParentTransactionID != "tx-original" || p.Attributes["reversedTransactionId"] != "tx-original" {
+		t.Errorf("reversal references %q / %v, want tx-original", p.ParentTransactionID, p.Attributes["reversedTransactionId"])
+	}
+	if p.TransactionID == "" || p.TransactionID == "tx-original" {
+		t.Errorf("TransactionID = %q, want a new ID", p.TransactionID)
+	}
+	if p.TotalCost == nil || *p.TotalCost != -0.25 {
+		t.Errorf("TotalCost = %v, want -0.25", p.TotalCost)
+	}
+	if p.OperationType != string(OperationTypeVideo) || p.Model != "fal_ai/fal-ai/kling-video" {
+		t.Errorf("OperationType = %q, Model = %q, want the original's", p.OperationType, p.Model)
+	}
+	if p.Environment != "production" || p.OrganizationID != "acme" || p.Subscriber["id"] != "user-1" {
+		t.Errorf("business context not applied: %+v", p)
+	}
+}
+
+func TestMeterReversalCostType(t *testing.T) {
+	client, meterer := newFakeClient(t, &fakeGenerator{}, WithDefaultCostType("MEDIA"))
+
+	if err := client.MeterReversal(context.Background(), "tx-1", map[string]interface{}{"totalCost": 1.0}); err != nil {
+		t.Fatalf("MeterReversal() error = %v", err)
+	}
+	if err := client.MeterReversal(context.Background(), "tx-2", map[string]interface{}{"totalCost": 1.0, "costType": "CUSTOM"}); err != nil {
+		t.Fatalf("MeterReversal() error = %v", err)
+	}
+
+	payloads := meterer.recorded()
+	if len(payloads) != 2 {
+		t.Fatalf("got %d payloads, want 2", len(payloads))
+	}
+	if payloads[0].CostType != "MEDIA" || payloads[1].CostType != "CUSTOM" {
+		t.Errorf("CostTypes = %q/%q, want the client default MEDIA, then the request's CUSTOM", payloads[0].CostType, payloads[1].CostType)
+	}
+}
+
+func TestMeterReversalValidation(t *testing.T) {
+	client, meterer := newFakeClient(t, &fakeGenerator{})
+
+	tests := []struct {
+		name     string
+		original string
+		metadata map[string]interface{}
+	}{
+		{"missing original", "", map[string]interface{}{"totalCost": 1.0}},
+		{"missing cost", "tx-original", nil},
+		{"bad operation type", "tx-original", map[string]interface{}{"totalCost": 1.0, "operationType": "AUDIO"}},
+	}
+	for _, tt := range tests {
+		if err := client.MeterReversal(context.Background(), tt.original, tt.metadata); !IsValidationError(err) {
+			t.Errorf("%s: error = %v, want validation error", tt.name, err)
+		}
+	}
+	if n := len(meterer.recorded()); n != 0 {
+		t.Errorf("sent %d payloads for invalid reversals, want 0", n)
+	}
+}
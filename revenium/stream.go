@@ -0,0 +1,226 @@
+package revenium
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ImageResult is one image delivered by GenerateImageStream. A result with a
+// non-nil Err reports that the stream failed; it carries no image and its
+// Index is -1.
+type ImageResult struct {
+	Index int // Position of the image within the generation
+	Image FalImage
+	Err   error
+}
+
+// StreamingImageGenerator is a FalGenerator that can deliver images as they
+// are generated. FalClient implements it; injected generators that don't are
+// still usable with GenerateImageStream but deliver every image at the end.
+type StreamingImageGenerator interface {
+	GenerateImageStream(ctx context.Context, model string, request *FalRequest, onImage func(index int, image FalImage)) (*FalImageResponse, error)
+}
+
+// maxStreamEventBytes bounds a single streamed event, which may hold inline
+// data URIs when SyncMode is set
+const maxStreamEventBytes = 64 << 20
+
+// GenerateImageStream generates images through the model's streaming endpoint
+// ({model}/stream), calling onImage for each image as soon as an event reports
+// it. Events may list every image so far or only the newest ones; either way
+// each image is reported once, in order. The returned response holds all
+// images received.
+//
+// If the stream fails or ctx is cancelled part-way, the images received so
+// far are returned together with the error.
+func (c *FalClient) GenerateImageStream(ctx context.Context, model string, request *FalRequest, onImage func(index int, image FalImage)) (*FalImageResponse, error) {
+	if c.config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.RequestTimeout)
+		defer cancel()
+	}
+
+	requestBody, err := c.marshalRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("%s/fal-ai/%s/stream", c.config.FalBaseURL, getEndpointPath(model))
+	recordFalEndpoint(ctx, endpoint)
+	req, err := c.newRequest(ctx, "POST", endpoint, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, NewNetworkError("request failed", err)
+	}
+	defer resp.Body.Close()
+
+	if capture, ok := ctx.Value(falHeaderCaptureKey{}).(*falHeaderCapture); ok {
+		capture.record(resp.Header)
+	}
+
+	if resp.StatusCode >= 400 {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, NewNetworkError("failed to read response", err)
+		}
+		logResponse(ctx, resp.StatusCode, string(body))
+		return nil, falStatusError(resp.StatusCode, body)
+	}
+
+	result := &FalImageResponse{}
+	err = readStreamEvents(resp.Body, func(event string, data []byte) error {
+		if event == "error" {
+			return falStatusError(http.StatusInternalServerError, data)
+		}
+
+		var update FalImageResponse
+		if err := json.Unmarshal(data, &update); err != nil {
+			return NewProviderError("failed to parse stream event", err)
+		}
+		debugCtx(ctx, "Stream event with %d image(s)", len(update.Images))
+
+		images := newStreamImages(result.Images, update.Images)
+		update.Images = result.Images
+		*result = update
+		for _, image := range images {
+			result.Images = append(result.Images, image)
+			if onImage != nil {
+				onImage(len(result.Images)-1, image)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = NewNetworkError("stream interrupted", ctxErr)
+		}
+		return result, err
+	}
+
+	return result, nil
+}
+
+// newStreamImages returns the images in an event that were not reported
+// before. An event whose first image matches the first one seen lists every
+// image so far; otherwise it holds only new images.
+func newStreamImages(seen, event []FalImage) []FalImage {
+	if len(seen) > 0 && len(event) > 0 && event[0].URL == seen[0].URL {
+		if len(event) <= len(seen) {
+			return nil
+		}
+		return event[len(seen):]
+	}
+	return event
+}
+
+// readStreamEvents parses a server-sent event stream, calling handle with each
+// event's name ("" when unnamed) and data
+func readStreamEvents(body io.Reader, handle func(event string, data []byte) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamEventBytes)
+
+	var event string
+	var data bytes.Buffer
+	dispatch := func() error {
+		defer func() {
+			event = ""
+			data.Reset()
+		}()
+		if data.Len() == 0 {
+			return nil
+		}
+		return handle(event, bytes.TrimSuffix(data.Bytes(), []byte("\n")))
+	}
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		switch {
+		case len(line) == 0:
+			if err := dispatch(); err != nil {
+				return err
+			}
+		case line[0] == ':':
+			// Comment, used by servers as a keep-alive
+		case bytes.HasPrefix(line, []byte("data:")):
+			data.Write(bytes.TrimPrefix(bytes.TrimPrefix(line, []byte("data:")), []byte(" ")))
+			data.WriteByte('\n')
+		case bytes.HasPrefix(line, []byte("event:")):
+			event = string(bytes.TrimSpace(bytes.TrimPrefix(line, []byte("event:"))))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return NewNetworkError("failed to read stream", err)
+	}
+	return dispatch()
+}
+
+// GenerateImageStream generates images and delivers each one on the returned
+// channel as soon as it is ready, for UIs that show variations as they finish.
+// The channel is closed when the generation ends. If Fal.ai fails, a final
+// ImageResult with Err set is sent before closing. One aggregated metering
+// record covering every image is sent at the end, exactly as for GenerateImage.
+//
+// Cancelling ctx stops the stream and closes the channel; the images that
+// completed before cancellation are still metered, with
+// attributes["streamIncomplete"] set to true. Callers should drain the channel
+// (or cancel ctx) to avoid stalling the stream.
+//
+// Errors detected before the generation starts, such as an invalid request or
+// a client that is shutting down, are returned directly.
+//
+// Example:
+//
+//	images, err := client.GenerateImageStream(ctx, "fal-ai/flux/dev", &revenium.FalRequest{
+//	    Prompt:    "a lighthouse at dusk",
+//	    NumImages: 4,
+//	})
+//	if err != nil {
+//	    return err
+//	}
+//	for res := range images {
+//	    if res.Err != nil {
+//	        return res.Err
+//	    }
+//	    gallery.Show(res.Index, res.Image.URL)
+//	}
+func (r *ReveniumFal) GenerateImageStream(ctx context.Context, model string, request *FalRequest, opts ...CallOption) (<-chan ImageResult, error) {
+	if err := r.beginCall(); err != nil {
+		return nil, err
+	}
+	if err := validateLoRAs(r.applyModelDefaults(model, request)); err != nil {
+		r.calls.Done()
+		return nil, err
+	}
+
+	results := make(chan ImageResult, 16)
+	go func() {
+		defer r.calls.Done()
+		defer close(results)
+
+		send := func(res ImageResult) {
+			select {
+			case results <- res:
+			case <-ctx.Done():
+			}
+		}
+
+		_, err := r.generateImage(ctx, model, request, func(index int, image FalImage) {
+			send(ImageResult{Index: index, Image: image})
+		}, opts)
+		if err != nil && ctx.Err() == nil {
+			send(ImageResult{Index: -1, Err: err})
+		}
+	}()
+
+	return results, nil
+}
@@ -0,0 +1,117 @@
+package revenium
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamImageEvent writes one server-sent event listing the first n images
+func streamImageEvent(w http.ResponseWriter, n int) {
+	images := make([]string, n)
+	for i := range images {
+		images[i] = fmt.Sprintf(`{"url":"https://fal.media/%d.png","width":512,"height":512}`, i)
+	}
+	fmt.Fprintf(w, "data: {\"images\":[%s]}\n\n", strings.Join(images, ","))
+	w.(http.Flusher).Flush()
+}
+
+func TestGenerateImageStream(t *testing.T) {
+	received := make(chan int, 3)
+	falHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fal-ai/flux/dev/stream" || r.Header.Get("Accept") != "text/event-stream" {
+			t.Errorf("request = %s (Accept %q), want the stream endpoint", r.URL.Path, r.Header.Get("Accept"))
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for n := 1; n <= 3; n++ {
+			time.Sleep(20 * time.Millisecond)
+			streamImageEvent(w, n)
+			// Only continue once the client has seen this image, proving it
+			// was delivered before the generation finished
+			select {
+			case <-received:
+			case <-time.After(2 * time.Second):
+				t.Errorf("image %d was not delivered before the stream ended", n-1)
+			}
+		}
+		// A final event repeating every image must not duplicate them
+		streamImageEvent(w, 3)
+	}
+	meter := &meterRecorder{}
+	client := newTestClient(t, falHandler, meter.ServeHTTP)
+
+	results, err := client.GenerateImageStream(context.Background(), "fal-ai/flux/dev", &FalRequest{Prompt: "a lighthouse", NumImages: 3})
+	if err != nil {
+		t.Fatalf("GenerateImageStream() error = %v", err)
+	}
+	var urls []string
+	for res := range results {
+		if res.Err != nil {
+			t.Fatalf("stream error = %v", res.Err)
+		}
+		if res.Index != len(urls) {
+			t.Errorf("Index = %d, want %d", res.Index, len(urls))
+		}
+		urls = append(urls, res.Image.URL)
+		received <- res.Index
+	}
+	if len(urls) != 3 || urls[2] != "https://fal.media/2.png" {
+		t.Fatalf("streamed %v, want 3 images in order", urls)
+	}
+
+	client.Flush()
+	payloads := meter.recorded()
+	if len(payloads) != 1 {
+		t.Fatalf("got %d metering payloads, want one aggregated record", len(payloads))
+	}
+	if p := payloads[0]; p.ActualImageCount == nil || *p.ActualImageCount != 3 || p.Attributes["streamIncomplete"] != nil {
+		t.Errorf("payload = %+v, want 3 complete images", p)
+	}
+}
+
+func TestGenerateImageStreamCancel(t *testing.T) {
+	falHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		streamImageEvent(w, 1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+			streamImageEvent(w, 2)
+		}
+	}
+	meter := &meterRecorder{}
+	client := newTestClient(t, falHandler, meter.ServeHTTP)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results, err := client.GenerateImageStream(ctx, "fal-ai/flux/dev", &FalRequest{Prompt: "a lighthouse", NumImages: 2})
+	if err != nil {
+		t.Fatalf("GenerateImageStream() error = %v", err)
+	}
+	if first := <-results; first.Err != nil || first.Image.URL != "https://fal.media/0.png" {
+		t.Fatalf("first result = %+v, want image 0", first)
+	}
+	cancel()
+
+	select {
+	case res, ok := <-results:
+		if ok {
+			t.Errorf("received %+v after cancellation, want channel closed", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("channel not closed after cancellation")
+	}
+
+	client.Flush()
+	payloads := meter.recorded()
+	if len(payloads) != 1 {
+		t.Fatalf("got %d metering payloads, want 1 for the completed image", len(payloads))
+	}
+	p := payloads[0]
+	if p.ActualImageCount == nil || *p.ActualImageCount != 1 || p.Attributes["streamIncomplete"] != true {
+		t.Errorf("payload = %+v, want 1 image marked streamIncomplete", p)
+	}
+}
@@ -0,0 +1,211 @@
+package revenium
+
+import (
+	"fmt"
+	"time"
+)
+
+// traceTypeBatch marks payloads whose usage is summarized by FinishBatch
+const traceTypeBatch = "batch"
+
+// maxOpenBatches bounds how many batch traces are tracked while awaiting
+// FinishBatch; past it the least recently updated trace is dropped, so
+// traces that are never finished cannot grow memory without limit
+const maxOpenBatches = 1024
+
+// batchTotals accumulates the usage of a batch trace's metered children
+type batchTotals struct {
+	template *MeteringPayload // First child, the base for the summary record
+	children int
+
+	actualImages, requestedImages *int
+	durationSeconds               *float64
+	requestedDurationSeconds      *float64
+	totalCost                     *float64
+
+	requestTime, responseTime time.Time
+
+	updated time.Time // When the last child was added, for eviction
+}
+
+// add folds a child payload's usage into the totals
+func (t *batchTotals) add(payload *MeteringPayload) {
+	if t.template == nil {
+		template := *payload
+		t.template = &template
+		t.requestTime, t.responseTime = payload.RequestTime, payload.ResponseTime
+	}
+	t.children++
+	t.updated = time.Now()
+
+	t.actualImages = addInt(t.actualImages, payload.ActualImageCount)
+	t.requestedImages = addInt(t.requestedImages, payload.RequestedImageCount)
+	t.durationSeconds = addFloat(t.durationSeconds, payload.DurationSeconds)
+	t.requestedDurationSeconds = addFloat(t.requestedDurationSeconds, payload.RequestedDurationSeconds)
+	t.totalCost = addFloat(t.totalCost, payload.TotalCost)
+
+	if payload.RequestTime.Before(t.requestTime) {
+		t.requestTime = payload.RequestTime
+	}
+	if payload.ResponseTime.After(t.responseTime) {
+		t.responseTime = payload.ResponseTime
+	}
+}
+
+// summary builds the aggregate payload for the batch. It shares the first
+// child's model and business context and spans from the earliest request to
+// the latest response. The children are already billed, so the summed usage
+// goes in attributes["batchTotals"] and the billing fields are left unset.
+func (t *batchTotals) summary(transactionID string) *MeteringPayload {
+	payload := *t.template
+	payload.TransactionID = transactionID
+	payload.ParentTransactionID = ""
+	payload.TraceType = traceTypeBatch
+	payload.RequestTime = t.requestTime
+	payload.ResponseTime = t.responseTime
+	payload.RequestDuration = t.responseTime.Sub(t.requestTime).Milliseconds()
+	payload.ActualImageCount = nil
+	payload.RequestedImageCount = nil
+	payload.DurationSeconds = nil
+	payload.RequestedDurationSeconds = nil
+	payload.TotalCost = nil
+	payload.Credits = nil
+	payload.InferenceSeconds = nil
+	payload.RetryNumber = nil
+	payload.InputMessages = ""
+	payload.capturedPrompt = nil
+	payload.OutputResponse = ""
+	payload.PromptsTruncated = false
+	payload.cancel = nil
+	payload.done = nil
+	payload.Attributes = map[string]interface{}{
+		"batchSummary": true,
+		"childCount":   t.children,
+		"batchTotals":  t.totals(),
+	}
+	return &payload
+}
+
+// totals returns the summed usage keyed by the payload field names, omitting
+// fields no child reported
+func (t *batchTotals) totals() map[string]interface{} {
+	totals := make(map[string]interface{})
+	if t.actualImages != nil {
+		totals["actualImageCount"] = *t.actualImages
+	}
+	if t.requestedImages != nil {
+		totals["requestedImageCount"] = *t.requestedImages
+	}
+	if t.durationSeconds != nil {
+		totals["durationSeconds"] = *t.durationSeconds
+	}
+	if t.requestedDurationSeconds != nil {
+		totals["requestedDurationSeconds"] = *t.requestedDurationSeconds
+	}
+	if t.totalCost != nil {
+		totals["totalCost"] = *t.totalCost
+	}
+	return totals
+}
+
+func addInt(total, value *int) *int {
+	if value == nil {
+		return total
+	}
+	sum := *value
+	if total != nil {
+		sum += *total
+	}
+	return &sum
+}
+
+func addFloat(total, value *float64) *float64 {
+	if value == nil {
+		return total
+	}
+	sum := *value
+	if total != nil {
+		sum += *total
+	}
+	return &sum
+}
+
+// trackBatchChild records a payload's usage when it belongs to a batch trace
+// (traceType "batch"). Summary records are never tracked.
+func (r *ReveniumFal) trackBatchChild(payload *MeteringPayload) {
+	if payload.TraceType != traceTypeBatch || payload.TraceID == "" {
+		return
+	}
+	if summary, _ := payload.Attributes["batchSummary"].(bool); summary {
+		return
+	}
+
+	r.batchMu.Lock()
+	defer r.batchMu.Unlock()
+	if r.batches == nil {
+		r.batches = make(map[string]*batchTotals)
+	}
+	totals, ok := r.batches[payload.TraceID]
+	if !ok {
+		if len(r.batches) >= maxOpenBatches {
+			r.evictStalestBatchLocked()
+		}
+		totals = &batchTotals{}
+		r.batches[payload.TraceID] = totals
+	}
+	totals.add(payload)
+}
+
+// evictStalestBatchLocked drops the batch trace that has gone longest without
+// a new child. The caller must hold batchMu.
+func (r *ReveniumFal) evictStalestBatchLocked() {
+	var stalest string
+	var oldest time.Time
+	for traceID, totals := range r.batches {
+		if stalest == "" || totals.updated.Before(oldest) {
+			stalest, oldest = traceID, totals.updated
+		}
+	}
+	Warn("Dropping unfinished batch trace %s: more than %d batch traces are awaiting FinishBatch", stalest, maxOpenBatches)
+	delete(r.batches, stalest)
+}
+
+// FinishBatch emits a summary metering record for a batch trace, in addition
+// to the per-item records already sent. Children are the generations metered
+// with metadata traceId set to traceID and traceType "batch"; the summary
+// also has traceType "batch" and attributes batchSummary=true, childCount, and
+// batchTotals, which holds the summed image counts, video durations, and
+// totalCost of its children. The summary's own billing fields are left unset
+// so the batch is not billed a second time.
+//
+// The trace's totals are released once the summary is dispatched, so
+// FinishBatch should be called once, after every child has returned. At most
+// 1024 unfinished traces are tracked; beyond that the least recently active
+// one is dropped. It returns a ValidationError if no children were metered
+// under traceID.
+//
+// Example:
+//
+//	ctx = revenium.WithUsageMetadata(ctx, map[string]interface{}{
+//	    "traceId":   jobID,
+//	    "traceType": "batch",
+//	})
+//	for _, req := range requests {
+//	    client.GenerateImage(ctx, "fal-ai/flux/dev", req)
+//	}
+//	client.FinishBatch(jobID)
+func (r *ReveniumFal) FinishBatch(traceID string) error {
+	r.batchMu.Lock()
+	totals, ok := r.batches[traceID]
+	delete(r.batches, traceID)
+	r.batchMu.Unlock()
+
+	if !ok {
+		return NewValidationError(fmt.Sprintf("no batch generations metered under trace %q", traceID), nil)
+	}
+
+	summary := totals.summary(r.config.newTransactionID())
+	Debug("Metering batch summary for trace %s (%d children)", traceID, totals.children)
+	r.dispatchMetering(OperationType(summary.OperationType), summary)
+	return nil
+}
@@ -0,0 +1,112 @@
+package revenium
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestFinishBatch(t *testing.T) {
+	gen := &fakeGenerator{image: &FalImageResponse{Images: []FalImage{
+		{URL: "https://fal.media/1.png"},
+		{URL: "https://fal.media/2.png"},
+	}}}
+	client, meterer := newFakeClient(t, gen)
+
+	ctx := WithUsageMetadata(context.Background(), map[string]interface{}{
+		"traceId":   "job-42",
+		"traceType": "batch",
+	})
+	for i := 0; i < 3; i++ {
+		if _, err := client.GenerateImage(ctx, "fal-ai/flux/dev", &FalRequest{Prompt: "a cat", NumImages: 2}, WithCost(0.05)); err != nil {
+			t.Fatalf("GenerateImage() error = %v", err)
+		}
+	}
+	// A generation in another trace is not part of the batch
+	other := WithUsageMetadata(context.Background(), map[string]interface{}{"traceId": "job-43", "traceType": "batch"})
+	if _, err := client.GenerateImage(other, "fal-ai/flux/dev", &FalRequest{Prompt: "a dog"}); err != nil {
+		t.Fatalf("GenerateImage() error = %v", err)
+	}
+
+	if err := client.FinishBatch("job-42"); err != nil {
+		t.Fatalf("FinishBatch() error = %v", err)
+	}
+	client.Flush()
+
+	payloads := meterer.recorded()
+	if len(payloads) != 5 {
+		t.Fatalf("got %d payloads, want 4 children and 1 summary", len(payloads))
+	}
+	var summary *MeteringPayload
+	var children []*MeteringPayload
+	for _, p := range payloads {
+		switch {
+		case p.Attributes["batchSummary"] == true:
+			summary = p
+		case p.TraceID == "job-42":
+			children = append(children, p)
+		}
+	}
+	if summary == nil {
+		t.Fatal("no batch summary payload sent")
+	}
+	if summary.Attributes["childCount"] != 3 {
+		t.Errorf("summary childCount = %v, want 3", summary.Attributes["childCount"])
+	}
+	if summary.TraceID != "job-42" || summary.TraceType != "batch" {
+		t.Errorf("summary trace = %s/%s, want job-42/batch", summary.TraceID, summary.TraceType)
+	}
+	// Children are already billed, so the summary carries no billing fields
+	if summary.ActualImageCount != nil || summary.RequestedImageCount != nil || summary.TotalCost != nil {
+		t.Errorf("summary billing fields = %v/%v/%v, want nil", summary.ActualImageCount, summary.RequestedImageCount, summary.TotalCost)
+	}
+	totals, ok := summary.Attributes["batchTotals"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("summary batchTotals = %v, want a map", summary.Attributes["batchTotals"])
+	}
+	if totals["actualImageCount"] != 6 {
+		t.Errorf("batchTotals actualImageCount = %v, want 6", totals["actualImageCount"])
+	}
+	if totals["requestedImageCount"] != 6 {
+		t.Errorf("batchTotals requestedImageCount = %v, want 6", totals["requestedImageCount"])
+	}
+	if cost, _ := totals["totalCost"].(float64); math.Abs(cost-0.15) > 1e-9 {
+		t.Errorf("batchTotals totalCost = %v, want 0.15", totals["totalCost"])
+	}
+	for _, child := range children {
+		if child.TransactionID == summary.TransactionID {
+			t.Error("summary reuses a child's transaction ID")
+		}
+	}
+
+	// The trace's totals are released after the summary
+	if err := client.FinishBatch("job-42"); !IsValidationError(err) {
+		t.Errorf("second FinishBatch() error = %v, want validation error", err)
+	}
+	if err := client.FinishBatch("unknown"); !IsValidationError(err) {
+		t.Errorf("FinishBatch(unknown) error = %v, want validation error", err)
+	}
+}
+
+func TestFinishBatchEvictsStaleTraces(t *testing.T) {
+	client, _ := newFakeClient(t, &fakeGenerator{})
+
+	for i := 0; i < maxOpenBatches+1; i++ {
+		client.trackBatchChild(&MeteringPayload{TraceID: fmt.Sprintf("job-%d", i), TraceType: traceTypeBatch})
+	}
+
+	client.batchMu.Lock()
+	open := len(client.batches)
+	_, oldest := client.batches["job-0"]
+	client.batchMu.Unlock()
+	if open != maxOpenBatches {
+		t.Errorf("open batch traces = %d, want %d", open, maxOpenBatches)
+	}
+	if oldest {
+		t.Error("least recently updated trace was not evicted")
+	}
+	if err := client.FinishBatch(fmt.Sprintf("job-%d", maxOpenBatches)); err != nil {
+		t.Errorf("FinishBatch(newest) error = %v", err)
+	}
+}
@@ -1,6 +1,13 @@
 package revenium
 
-import "time"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
 
 // OperationType represents the type of AI operation
 type OperationType string
@@ -13,24 +20,62 @@ const (
 // FalRequest represents a request to the Fal.ai API
 type FalRequest struct {
 	Prompt              string                 `json:"prompt"`
+	NegativePrompt      string                 `json:"negative_prompt,omitempty"`
 	ImageSize           string                 `json:"image_size,omitempty"`
 	NumInferenceSteps   int                    `json:"num_inference_steps,omitempty"`
 	GuidanceScale       float64                `json:"guidance_scale,omitempty"`
 	NumImages           int                    `json:"num_images,omitempty"`
 	Seed                *int                   `json:"seed,omitempty"`
 	EnableSafetyChecker bool                   `json:"enable_safety_checker,omitempty"`
-	Duration            string                 `json:"duration,omitempty"`    // Video duration: "5" or "10" seconds
+	SyncMode            bool                   `json:"sync_mode,omitempty"`    // Return media inline as data URIs instead of hosted URLs
+	Duration            string                 `json:"duration,omitempty"`     // Video duration: "5" or "10" seconds
 	AspectRatio         string                 `json:"aspect_ratio,omitempty"` // Video aspect ratio: "16:9", "9:16", "1:1"
+	LoRAs               []LoRA                 `json:"loras,omitempty"`        // Custom LoRA weights to apply
 	AdditionalParams    map[string]interface{} `json:"-"`
 }
 
+// LoRA references custom LoRA weights applied to a generation
+type LoRA struct {
+	Path  string   `json:"path"`            // URL or Hugging Face path of the weights
+	Scale *float64 `json:"scale,omitempty"` // Weight strength, 0-4; nil uses Fal's default of 1.0
+}
+
 // FalImageResponse represents the response from Fal.ai image generation
 type FalImageResponse struct {
 	Images      []FalImage `json:"images"`
 	Seed        int        `json:"seed,omitempty"`
 	TimeTaken   float64    `json:"timeTaken,omitempty"`
 	HasNSFWContent []bool  `json:"has_nsfw_content,omitempty"`
+	NSFWConcepts NSFWConcepts `json:"nsfw_concepts,omitempty"` // Detected concept labels, per image
 	Prompt      string     `json:"prompt,omitempty"`
+	// Billing reported by some models, in Fal credits
+	Credits *float64 `json:"credits,omitempty"`
+	Cost    *float64 `json:"cost,omitempty"`
+	// GPU seconds, reported by endpoints billed on inference time
+	InferenceTime *float64 `json:"inference_time,omitempty"`
+	// GPU the job ran on (e.g. "H100"), reported by some endpoints
+	GPUType string `json:"gpu_type,omitempty"`
+}
+
+// NSFWConcepts holds the moderation concept labels detected in each image
+type NSFWConcepts [][]string
+
+// UnmarshalJSON accepts per-image label lists ([["a"], ["b"]]) or a single
+// flat list (["a", "b"]), which is treated as one group. Other shapes are
+// ignored rather than failing the whole response.
+func (c *NSFWConcepts) UnmarshalJSON(data []byte) error {
+	var groups [][]string
+	if err := json.Unmarshal(data, &groups); err == nil {
+		*c = groups
+		return nil
+	}
+	var flat []string
+	if err := json.Unmarshal(data, &flat); err == nil && len(flat) > 0 {
+		*c = NSFWConcepts{flat}
+		return nil
+	}
+	*c = nil
+	return nil
 }
 
 // FalImage represents a single generated image
@@ -39,6 +84,7 @@ type FalImage struct {
 	Width       int    `json:"width"`
 	Height      int    `json:"height"`
 	ContentType string `json:"content_type,omitempty"`
+	Seed        *int   `json:"seed,omitempty"` // Per-variation seed, when the model reports one
 }
 
 // FalVideoResponse represents the response from Fal.ai video generation
@@ -46,6 +92,18 @@ type FalVideoResponse struct {
 	Video       FalVideo `json:"video"`
 	Prompt      string   `json:"prompt,omitempty"`
 	TimeTaken   float64  `json:"timeTaken,omitempty"`
+	// Optional extras returned by some video models
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	PreviewURL   string `json:"preview_url,omitempty"`
+	// Segments that together form the clip, returned by segmented pipelines
+	Segments []FalVideo `json:"segments,omitempty"`
+	// Billing reported by some models, in Fal credits
+	Credits *float64 `json:"credits,omitempty"`
+	Cost    *float64 `json:"cost,omitempty"`
+	// GPU seconds, reported by endpoints billed on inference time
+	InferenceTime *float64 `json:"inference_time,omitempty"`
+	// GPU the job ran on (e.g. "H100"), reported by some endpoints
+	GPUType string `json:"gpu_type,omitempty"`
 }
 
 // FalVideo represents a generated video
@@ -59,17 +117,76 @@ type FalVideo struct {
 
 // FalError represents an error response from Fal.ai
 type FalError struct {
-	ErrorText string `json:"error"`
-	Message   string `json:"message,omitempty"`
-	Status    int    `json:"status,omitempty"`
+	ErrorText string           `json:"error"`
+	Message   string           `json:"message,omitempty"`
+	Status    int              `json:"status,omitempty"`
+	Detail    []FalErrorDetail `json:"detail,omitempty"` // Field-level validation errors (422)
+}
+
+// FalErrorDetail describes a single field validation failure
+type FalErrorDetail struct {
+	Loc  []interface{} `json:"loc,omitempty"` // Path to the offending field, e.g. ["body", "num_images"]
+	Msg  string        `json:"msg"`
+	Type string        `json:"type,omitempty"`
+}
+
+// String formats the detail as "body.num_images: value must be <= 4"
+func (d FalErrorDetail) String() string {
+	if len(d.Loc) == 0 {
+		return d.Msg
+	}
+	loc := make([]string, len(d.Loc))
+	for i, part := range d.Loc {
+		loc[i] = fmt.Sprint(part)
+	}
+	return strings.Join(loc, ".") + ": " + d.Msg
+}
+
+// UnmarshalJSON accepts "detail" either as an array of field errors or as a
+// plain string (used by Fal for non-validation errors)
+func (e *FalError) UnmarshalJSON(data []byte) error {
+	type falErrorAlias FalError
+	var raw struct {
+		falErrorAlias
+		Detail json.RawMessage `json:"detail,omitempty"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*e = FalError(raw.falErrorAlias)
+
+	if len(raw.Detail) == 0 || string(raw.Detail) == "null" {
+		return nil
+	}
+	var detailText string
+	if err := json.Unmarshal(raw.Detail, &detailText); err == nil {
+		if e.Message == "" {
+			e.Message = detailText
+		}
+		return nil
+	}
+	return json.Unmarshal(raw.Detail, &e.Detail)
 }
 
 // Error implements the error interface
 func (e *FalError) Error() string {
-	if e.Message != "" {
-		return e.Message
+	var details []string
+	for _, d := range e.Detail {
+		details = append(details, d.String())
+	}
+
+	message := e.Message
+	if message == "" {
+		message = e.ErrorText
+	}
+	switch {
+	case len(details) == 0:
+		return message
+	case message == "":
+		return "validation failed: " + strings.Join(details, "; ")
+	default:
+		return message + ": " + strings.Join(details, "; ")
 	}
-	return e.ErrorText
 }
 
 // MeteringPayload represents the payload sent to Revenium API
@@ -134,4 +251,39 @@ type MeteringPayload struct {
 
 	// Cost overrides
 	TotalCost        *float64 `json:"totalCost,omitempty"`
+
+	// Fal credits consumed, when the response reports them. Credits are
+	// converted to dollars server-side by Revenium.
+	Credits *float64 `json:"credits,omitempty"`
+
+	// GPU seconds consumed, for endpoints billed on inference time
+	InferenceSeconds *float64 `json:"inferenceSeconds,omitempty"`
+
+	// cancel, set by WithMeteringCancellation, discards the payload if done
+	// before it is sent
+	cancel context.Context
+
+	// logLevel carries the call's WithLogLevel override to metering delivery
+	logLevel *LogLevel
+
+	// done, when set, is signalled once the payload's delivery finishes
+	// (see GenerateImageAwaitMetering)
+	done *sync.WaitGroup
+
+	// capturedPrompt holds the raw prompt until delivery formats it into
+	// InputMessages (see formatCapturedPrompt)
+	capturedPrompt *capturedPrompt
+}
+
+// MeteringEvent records a single metering delivery attempt: the exact payload
+// sent plus how delivery went. Events are emitted to the WithMeteringEventLog
+// callback for audit trails.
+type MeteringEvent struct {
+	Payload    *MeteringPayload `json:"payload"`
+	SentAt     time.Time        `json:"sentAt"`
+	Endpoint   string           `json:"endpoint"`
+	Attempt    int              `json:"attempt"`              // 1-based; retries reuse the same payload
+	StatusCode int              `json:"statusCode,omitempty"` // 0 when no response was received
+	Delivered  bool             `json:"delivered"`
+	Error      string           `json:"error,omitempty"`
 }
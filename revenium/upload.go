@@ -0,0 +1,151 @@
+package revenium
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// DownloadedImage is a generated image fetched for an OutputUploader
+type DownloadedImage struct {
+	Index       int      // Position of the image within the response
+	Image       FalImage // The image as returned by Fal.ai, including its URL
+	Data        []byte
+	ContentType string
+}
+
+// OutputUploader stores a generated image in the caller's storage and returns
+// the URL it is now served from; see WithOutputUploader
+type OutputUploader func(ctx context.Context, image DownloadedImage) (string, error)
+
+// maxConcurrentUploads bounds the downloads and uploads run for one response
+const maxConcurrentUploads = 4
+
+// uploadOutputs downloads each image in resp and passes it to the configured
+// OutputUploader, up to maxConcurrentUploads at once. Uploaded images have
+// their URL replaced in resp. It returns one entry per uploaded image, with
+// the original Fal URL and the new URL, or nil when nothing was uploaded.
+// Failures are logged and leave the image's Fal URL in place.
+func (r *ReveniumFal) uploadOutputs(ctx context.Context, resp *FalImageResponse) []map[string]interface{} {
+	if r.config.OutputUploader == nil || resp == nil || len(resp.Images) == 0 {
+		return nil
+	}
+
+	uploaded := make([]string, len(resp.Images))
+	sem := make(chan struct{}, maxConcurrentUploads)
+	var wg sync.WaitGroup
+	for i, image := range resp.Images {
+		if image.URL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, image FalImage) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			url, err := r.uploadOutput(ctx, i, image)
+			if err != nil {
+				Warn("Failed to upload output %d (%s): %s", i, redactURLQuery(image.URL), redactErrorMessage(err.Error()))
+				return
+			}
+			uploaded[i] = url
+		}(i, image)
+	}
+	wg.Wait()
+
+	var uploads []map[string]interface{}
+	for i, url := range uploaded {
+		if url == "" {
+			continue
+		}
+		uploads = append(uploads, map[string]interface{}{
+			"index":  i,
+			"falUrl": resp.Images[i].URL,
+			"url":    url,
+		})
+		resp.Images[i].URL = url
+	}
+	return uploads
+}
+
+// uploadOutput downloads one image and hands it to the uploader, recovering
+// from a panicking uploader so a bad callback cannot fail the generation
+func (r *ReveniumFal) uploadOutput(ctx context.Context, index int, image FalImage) (url string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("uploader panicked: %v", p)
+		}
+	}()
+
+	data, contentType, err := r.downloadOutput(ctx, image.URL)
+	if err != nil {
+		return "", fmt.Errorf("download failed: %w", err)
+	}
+	if image.ContentType != "" {
+		contentType = image.ContentType
+	}
+
+	url, err = r.config.OutputUploader(ctx, DownloadedImage{
+		Index:       index,
+		Image:       image,
+		Data:        data,
+		ContentType: contentType,
+	})
+	if err != nil {
+		return "", err
+	}
+	if url == "" {
+		return "", fmt.Errorf("uploader returned an empty URL")
+	}
+	return url, nil
+}
+
+// downloadOutput fetches a generated output, decoding it directly when it is
+// an inline data URI (as returned with SyncMode)
+func (r *ReveniumFal) downloadOutput(ctx context.Context, url string) ([]byte, string, error) {
+	if strings.HasPrefix(url, "data:") {
+		return decodeDataURI(url)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := r.downloadClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// decodeDataURI decodes a base64 data URI into its bytes and media type
+func decodeDataURI(uri string) ([]byte, string, error) {
+	header, payload, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok {
+		return nil, "", fmt.Errorf("malformed data URI")
+	}
+	mediaType, isBase64 := strings.CutSuffix(header, ";base64")
+	if !isBase64 {
+		return nil, "", fmt.Errorf("unsupported data URI encoding")
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, mediaType, nil
+}
@@ -0,0 +1,103 @@
+package revenium
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWithOutputUploader(t *testing.T) {
+	media := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png:" + r.URL.Path))
+	}))
+	t.Cleanup(media.Close)
+
+	var mu sync.Mutex
+	received := map[int]DownloadedImage{}
+	uploader := func(ctx context.Context, img DownloadedImage) (string, error) {
+		mu.Lock()
+		received[img.Index] = img
+		mu.Unlock()
+		if img.Index == 2 {
+			return "", errors.New("bucket unavailable")
+		}
+		return "https://cdn.example.com/" + strings.TrimPrefix(img.Image.URL, media.URL+"/"), nil
+	}
+
+	generator := &fakeGenerator{image: &FalImageResponse{Images: []FalImage{
+		{URL: media.URL + "/0.png"},
+		{URL: media.URL + "/1.png"},
+		{URL: media.URL + "/2.png"},
+	}}}
+	client, meterer := newFakeClient(t, generator, WithOutputUploader(uploader))
+
+	resp, err := client.GenerateImage(context.Background(), "fal-ai/flux/dev", &FalRequest{Prompt: "a cat", NumImages: 3})
+	if err != nil {
+		t.Fatalf("GenerateImage() error = %v, want upload failures ignored", err)
+	}
+	client.Flush()
+
+	if got := string(received[1].Data); got != "png:/1.png" || received[1].ContentType != "image/png" {
+		t.Errorf("uploader received %q (%s), want the downloaded image", got, received[1].ContentType)
+	}
+	if resp.Images[0].URL != "https://cdn.example.com/0.png" || resp.Images[1].URL != "https://cdn.example.com/1.png" {
+		t.Errorf("response URLs = %v, want rewritten to the uploaded URLs", resp.Images)
+	}
+	if resp.Images[2].URL != media.URL+"/2.png" {
+		t.Errorf("failed upload URL = %q, want the Fal URL kept", resp.Images[2].URL)
+	}
+
+	uploads, _ := meterer.recorded()[0].Attributes["outputUploads"].([]map[string]interface{})
+	if len(uploads) != 2 {
+		t.Fatalf("outputUploads = %v, want the 2 successful uploads", uploads)
+	}
+	if uploads[1]["index"] != 1 || uploads[1]["falUrl"] != media.URL+"/1.png" || uploads[1]["url"] != "https://cdn.example.com/1.png" {
+		t.Errorf("outputUploads[1] = %v, want both URLs", uploads[1])
+	}
+}
+
+func TestOutputDownloadTimeoutAndRedaction(t *testing.T) {
+	var logs bytes.Buffer
+	logger.SetOutput(&logs)
+	t.Cleanup(func() { logger.SetOutput(os.Stdout) })
+
+	release := make(chan struct{})
+	media := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(media.Close)
+	t.Cleanup(func() { close(release) })
+
+	uploader := func(ctx context.Context, img DownloadedImage) (string, error) {
+		return "https://cdn.example.com/0.png", nil
+	}
+	presigned := media.URL + "/0.png?X-Amz-Signature=secret-signature"
+	generator := &fakeGenerator{image: &FalImageResponse{Images: []FalImage{{URL: presigned}}}}
+	client, _ := newFakeClient(t, generator, WithOutputUploader(uploader), WithOutputDownloadTimeout(20*time.Millisecond))
+
+	start := time.Now()
+	resp, err := client.GenerateImage(context.Background(), "fal-ai/flux/dev", &FalRequest{Prompt: "a cat"})
+	if err != nil {
+		t.Fatalf("GenerateImage() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("GenerateImage() took %v, want the download cut off by the configured timeout", elapsed)
+	}
+	if resp.Images[0].URL != presigned {
+		t.Errorf("URL = %q, want the Fal URL kept after a failed download", resp.Images[0].URL)
+	}
+	if !strings.Contains(logs.String(), "Failed to upload output 0") {
+		t.Fatalf("logs = %q, want an upload failure warning", logs.String())
+	}
+	if strings.Contains(logs.String(), "secret-signature") {
+		t.Errorf("logs = %q, want the presigned query stripped", logs.String())
+	}
+}
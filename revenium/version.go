@@ -63,3 +63,21 @@ func GetVersion() string {
 
 	return version
 }
+
+// applicationBuildInfo returns the main (application) module's version and
+// VCS commit as embedded by the Go toolchain, or empty strings if unavailable
+func applicationBuildInfo() (version, commit string) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", ""
+	}
+	if info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			commit = setting.Value
+		}
+	}
+	return version, commit
+}